@@ -0,0 +1,327 @@
+package hsm
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Overflow specifies what an [ActiveInstance] does with an event when its mailbox is full.
+type Overflow int
+
+const (
+	OverflowBlock Overflow = iota // wait until there's room in the mailbox
+	OverflowDrop                  // silently discard the event
+	OverflowError                 // reject the event with ErrMailboxFull
+)
+
+var (
+	// ErrMailboxFull is returned when an event is rejected by an ActiveInstance using OverflowError policy.
+	ErrMailboxFull = errors.New("hsm: mailbox full")
+	// ErrStopped is returned when an event is sent to an ActiveInstance which has stopped, or is stopping.
+	ErrStopped = errors.New("hsm: active instance stopped")
+)
+
+// ActiveInstance runs a StateMachineInstance in its own goroutine,
+// feeding it the events from a bounded mailbox.
+// Unlike StateMachineInstance, ActiveInstance is safe for concurrent use by multiple goroutines.
+// ActiveInstance also takes the instance's time transitions as they become due,
+// using the instance's Clock.
+//
+// Set the Instance field, and optionally the mailbox size and overflow policy, then call Start().
+// Once started, the instance must only be accessed through the ActiveInstance,
+// e.g. using [ActiveInstance.Do].
+//
+// If an action or guard fails, by panicking or by returning an error (see [TransitionBuilder.ActionE]),
+// the goroutine recovers and exits, leaving the instance where the failure occurred, and Err reports the failure.
+// Any other panic, e.g. in the function passed to Do, crashes the program, as it would if raised by the caller.
+type ActiveInstance[E any] struct {
+	Instance    *StateMachineInstance[E]
+	MailboxSize int      // capacity of the mailbox; 0 means unbuffered
+	Overflow    Overflow // what to do with an event when the mailbox is full
+
+	mailbox  chan message[E]
+	mu       sync.RWMutex // guards stopped, held for reading while posting to the mailbox
+	stopped  bool
+	stopping chan struct{}
+	done     chan struct{}
+	dropped  atomic.Uint64
+	err      error
+}
+
+// message is an item in the mailbox: either an event, or a function to run against the instance.
+type message[E any] struct {
+	e     Event
+	f     func(*StateMachineInstance[E])
+	reply chan result[E] // nil for asynchronous events
+}
+
+// result is the outcome of delivering a synchronously sent event.
+type result[E any] struct {
+	handled bool
+	src     *State[E]
+}
+
+// Start initializes the instance with the event e and starts the goroutine processing the events.
+// The goroutine runs until Stop() is called, or until the ctx is canceled,
+// in which case any events left in the mailbox are discarded.
+func (ai *ActiveInstance[E]) Start(ctx context.Context, e Event) {
+	ai.mu.Lock()
+	defer ai.mu.Unlock()
+	if ai.mailbox != nil {
+		panic("active instance already started")
+	}
+	if ai.stopped {
+		panic("active instance already stopped")
+	}
+	ai.mailbox = make(chan message[E], ai.MailboxSize)
+	ai.stopping = make(chan struct{})
+	ai.doneChan()
+	go ai.run(ctx, e)
+}
+
+// Post delivers the event asynchronously, without waiting for it to be processed.
+// If the mailbox is full, the outcome depends on the Overflow policy.
+// Post returns ErrStopped if the active instance is stopping or has stopped.
+func (ai *ActiveInstance[E]) Post(e Event) error {
+	return ai.post(nil, message[E]{e: e})
+}
+
+// Send delivers the event and waits for it to be processed,
+// returning whether the event was handled, and in which state (see [StateMachineInstance.Deliver]).
+// If the mailbox is full, the outcome depends on the Overflow policy; with OverflowDrop, Send returns ErrMailboxFull.
+// Send returns early with the ctx error if the ctx is canceled.
+// In that case, the event may or may not get delivered.
+func (ai *ActiveInstance[E]) Send(ctx context.Context, e Event) (handled bool, src *State[E], err error) {
+	reply := make(chan result[E], 1)
+	if err = ai.post(ctx, message[E]{e: e, reply: reply}); err != nil {
+		return
+	}
+	select {
+	case r := <-reply:
+		return r.handled, r.src, nil
+	case <-ctx.Done():
+		return false, nil, ctx.Err()
+	case <-ai.done:
+		return false, nil, ErrStopped
+	}
+}
+
+// Do runs the function f in the goroutine owning the instance, between processing the events, and waits for it to return.
+// Use Do to safely inspect the instance, e.g. by calling [StateMachineInstance.Current].
+// Function f must not retain the instance, nor call its Deliver method.
+// Function f must not call the methods of the ActiveInstance either: in particular, calling Stop from f deadlocks,
+// since Stop waits for the goroutine running f to exit.
+// Do waits for room in the mailbox regardless of the Overflow policy.
+func (ai *ActiveInstance[E]) Do(ctx context.Context, f func(smi *StateMachineInstance[E])) error {
+	reply := make(chan result[E], 1)
+	ai.mu.RLock()
+	defer ai.mu.RUnlock()
+	if ai.isStopped() {
+		return ErrStopped
+	}
+	select {
+	case ai.mailbox <- message[E]{f: f, reply: reply}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-ai.done:
+		return ErrStopped
+	}
+	select {
+	case <-reply:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-ai.done:
+		return ErrStopped
+	}
+}
+
+// post puts the message into the mailbox, applying the Overflow policy.
+// A nil ctx means the wait for room in the mailbox can not be canceled.
+func (ai *ActiveInstance[E]) post(ctx context.Context, m message[E]) error {
+	ai.mu.RLock()
+	defer ai.mu.RUnlock()
+	if ai.isStopped() {
+		return ErrStopped
+	}
+	select {
+	case ai.mailbox <- m:
+		return nil
+	default:
+	}
+	switch ai.Overflow {
+	case OverflowDrop:
+		ai.dropped.Add(1)
+		if m.reply != nil {
+			return ErrMailboxFull
+		}
+		return nil
+	case OverflowError:
+		return ErrMailboxFull
+	}
+	var canceled <-chan struct{}
+	if ctx != nil {
+		canceled = ctx.Done()
+	}
+	select {
+	case ai.mailbox <- m:
+		return nil
+	case <-canceled:
+		return ctx.Err()
+	case <-ai.done:
+		return ErrStopped
+	}
+}
+
+// isStopped returns whether the active instance is stopping or has stopped, either by calling Stop,
+// or by canceling the ctx passed to Start. It must be called with ai.mu held.
+func (ai *ActiveInstance[E]) isStopped() bool {
+	if ai.stopped || ai.mailbox == nil {
+		return true
+	}
+	select {
+	case <-ai.done:
+		return true // goroutine exited, but hasn't marked the active instance stopped yet
+	default:
+		return false
+	}
+}
+
+// Dropped returns the number of events dropped due to OverflowDrop policy.
+func (ai *ActiveInstance[E]) Dropped() uint64 {
+	return ai.dropped.Load()
+}
+
+// Stop stops the active instance gracefully: no more events are accepted,
+// while the events already in the mailbox are processed.
+// Stop waits for the goroutine to exit. It is safe to call Stop more than once,
+// and before Start, in which case the active instance can no longer be started.
+// Stop must not be called from the function passed to Do, which would deadlock.
+func (ai *ActiveInstance[E]) Stop() {
+	ai.mu.Lock()
+	started := ai.mailbox != nil
+	if !ai.stopped {
+		ai.stopped = true
+		if started {
+			close(ai.stopping)
+		} else {
+			close(ai.doneChan()) // the goroutine will never run
+		}
+	}
+	ai.mu.Unlock()
+	if started {
+		<-ai.done
+	}
+}
+
+// Done returns a channel that's closed once the goroutine processing the events exits,
+// or once Stop is called, if the active instance was never started.
+// Done may be called before Start.
+func (ai *ActiveInstance[E]) Done() <-chan struct{} {
+	ai.mu.Lock()
+	defer ai.mu.Unlock()
+	return ai.doneChan()
+}
+
+// doneChan returns the done channel, creating it if needed. It must be called with ai.mu held for writing.
+func (ai *ActiveInstance[E]) doneChan() chan struct{} {
+	if ai.done == nil {
+		ai.done = make(chan struct{})
+	}
+	return ai.done
+}
+
+// Err returns the ctx error if the active instance was stopped by canceling the ctx passed to Start,
+// an *ActionError if the goroutine exited because an action or guard failed, or nil otherwise.
+// Err should be called only after the Done channel is closed.
+func (ai *ActiveInstance[E]) Err() error {
+	return ai.err
+}
+
+// run is the goroutine owning the instance.
+func (ai *ActiveInstance[E]) run(ctx context.Context, e Event) {
+	smi := ai.Instance
+	current := e // event being processed, for reporting failed actions
+	defer func() {
+		if v := recover(); v != nil {
+			if !smi.user {
+				panic(v)
+			}
+			ai.err = newActionError(current, v)
+		}
+		// done must be closed first, to release any senders waiting for room in the mailbox
+		close(ai.done)
+		ai.mu.Lock()
+		ai.stopped = true
+		ai.mu.Unlock()
+	}()
+	clock := smi.Clock
+	if clock == nil {
+		clock = SystemClock
+	}
+
+	var (
+		timer  Timer
+		timerC <-chan time.Time
+		armed  time.Time // deadline of the timer
+	)
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	smi.Initialize(e)
+	for {
+		// keep the timer in sync with the earliest armed time transition
+		deadline, ok := smi.NextDeadline()
+		if timer != nil && (!ok || !deadline.Equal(armed)) {
+			timer.Stop()
+			timer, timerC = nil, nil
+		}
+		if ok && timer == nil {
+			timer, armed = clock.NewTimer(deadline.Sub(clock.Now())), deadline
+			timerC = timer.C()
+		}
+
+		select {
+		case <-ctx.Done():
+			ai.err = ctx.Err()
+			return
+		case <-ai.stopping:
+			// no more messages can be posted; process the remaining ones
+			for {
+				select {
+				case m := <-ai.mailbox:
+					current = m.e
+					ai.handle(m)
+				default:
+					return
+				}
+			}
+		case m := <-ai.mailbox:
+			current = m.e
+			ai.handle(m)
+		case <-timerC:
+			timer, timerC = nil, nil
+			current = Event{Id: TimeEvent}
+			smi.ProcessTimers()
+		}
+	}
+}
+
+// handle processes a single message from the mailbox.
+func (ai *ActiveInstance[E]) handle(m message[E]) {
+	if m.f != nil {
+		m.f(ai.Instance)
+		m.reply <- result[E]{}
+		return
+	}
+	handled, src := ai.Instance.Deliver(m.e)
+	if m.reply != nil {
+		m.reply <- result[E]{handled: handled, src: src}
+	}
+}
@@ -0,0 +1,204 @@
+package hsm_test
+
+import (
+	"context"
+	"github.com/dragomit/hsm"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newSwitch() (*hsm.StateMachine[*int], *hsm.State[*int], *hsm.State[*int]) {
+	const evToggle = 0
+	sm := hsm.StateMachine[*int]{}
+	off := sm.State("off").Initial().Build()
+	on := sm.State("on").Build()
+	off.Transition(evToggle, on).Action("count", func(_ hsm.Event, n *int) { *n++ }).Build()
+	on.AddTransition(evToggle, off)
+	sm.Finalize()
+	return &sm, off, on
+}
+
+func TestActiveInstance(t *testing.T) {
+	const evToggle = 0
+	sm, off, on := newSwitch()
+	ai := hsm.ActiveInstance[*int]{Instance: &hsm.StateMachineInstance[*int]{SM: sm, Ext: new(int)}, MailboxSize: 10}
+	ai.Start(context.Background(), hsm.Event{})
+
+	ctx := context.Background()
+	handled, src, err := ai.Send(ctx, hsm.Event{Id: evToggle})
+	assert.NoError(t, err)
+	assert.True(t, handled)
+	assert.Equal(t, off, src)
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, ai.Post(hsm.Event{Id: evToggle}))
+	}
+	var current *hsm.State[*int]
+	var count int
+	assert.NoError(t, ai.Do(ctx, func(smi *hsm.StateMachineInstance[*int]) {
+		current, count = smi.Current(), *smi.Ext
+	}))
+	assert.Equal(t, off, current)
+	assert.Equal(t, 3, count)
+
+	// events posted before Stop are still processed
+	assert.NoError(t, ai.Post(hsm.Event{Id: evToggle}))
+	ai.Stop()
+	assert.Equal(t, on, ai.Instance.Current())
+	assert.NoError(t, ai.Err())
+	assert.Equal(t, hsm.ErrStopped, ai.Post(hsm.Event{Id: evToggle}))
+	_, _, err = ai.Send(ctx, hsm.Event{Id: evToggle})
+	assert.Equal(t, hsm.ErrStopped, err)
+	ai.Stop()
+}
+
+func TestActiveInstanceCancel(t *testing.T) {
+	sm, _, _ := newSwitch()
+	ctx, cancel := context.WithCancel(context.Background())
+	ai := hsm.ActiveInstance[*int]{Instance: &hsm.StateMachineInstance[*int]{SM: sm, Ext: new(int)}}
+	ai.Start(ctx, hsm.Event{})
+	cancel()
+	<-ai.Done()
+	assert.Equal(t, context.Canceled, ai.Err())
+	assert.Equal(t, hsm.ErrStopped, ai.Post(hsm.Event{}))
+}
+
+func TestActiveInstanceCancelBuffered(t *testing.T) {
+	sm, _, _ := newSwitch()
+	ctx, cancel := context.WithCancel(context.Background())
+	ai := hsm.ActiveInstance[*int]{Instance: &hsm.StateMachineInstance[*int]{SM: sm, Ext: new(int)}, MailboxSize: 10}
+	ai.Start(ctx, hsm.Event{})
+	cancel()
+	<-ai.Done()
+	// there's room in the mailbox, but the events would never be processed
+	assert.Equal(t, hsm.ErrStopped, ai.Post(hsm.Event{}))
+	_, _, err := ai.Send(context.Background(), hsm.Event{})
+	assert.Equal(t, hsm.ErrStopped, err)
+	assert.Equal(t, hsm.ErrStopped, ai.Do(context.Background(), func(*hsm.StateMachineInstance[*int]) {}))
+	ai.Stop()
+}
+
+func TestActiveInstanceStopBeforeStart(t *testing.T) {
+	sm, _, _ := newSwitch()
+	ai := hsm.ActiveInstance[*int]{Instance: &hsm.StateMachineInstance[*int]{SM: sm, Ext: new(int)}}
+	ai.Stop()
+	ai.Stop()
+	<-ai.Done()
+	assert.NoError(t, ai.Err())
+	assert.Equal(t, hsm.ErrStopped, ai.Post(hsm.Event{}))
+	assert.PanicsWithValue(t, "active instance already stopped", func() { ai.Start(context.Background(), hsm.Event{}) })
+}
+
+func TestActiveInstanceDoneBeforeStart(t *testing.T) {
+	sm, _, _ := newSwitch()
+	ai := hsm.ActiveInstance[*int]{Instance: &hsm.StateMachineInstance[*int]{SM: sm, Ext: new(int)}}
+	done := ai.Done()
+	ai.Start(context.Background(), hsm.Event{})
+	assert.Equal(t, done, ai.Done())
+	ai.Stop()
+	<-done
+}
+
+func TestActiveInstanceFailedAction(t *testing.T) {
+	const evBoom = 0
+	sm := hsm.StateMachine[struct{}]{}
+	idle := sm.State("idle").Initial().Build()
+	idle.Transition(evBoom, idle).Action("boom", func(hsm.Event, struct{}) { panic("boom") }).Build()
+	sm.Finalize()
+	ai := hsm.ActiveInstance[struct{}]{Instance: &hsm.StateMachineInstance[struct{}]{SM: &sm}}
+	ai.Start(context.Background(), hsm.Event{})
+
+	// the goroutine exits, rather than crashing the program
+	_, _, err := ai.Send(context.Background(), hsm.Event{Id: evBoom})
+	assert.Equal(t, hsm.ErrStopped, err)
+	<-ai.Done()
+	var ae *hsm.ActionError
+	assert.ErrorAs(t, ai.Err(), &ae)
+	assert.Equal(t, evBoom, ae.Event.Id)
+	assert.Equal(t, "boom", ae.Panic)
+	assert.Equal(t, hsm.ErrStopped, ai.Post(hsm.Event{Id: evBoom}))
+	ai.Stop()
+}
+
+func TestActiveInstanceOverflow(t *testing.T) {
+	const evToggle = 0
+	sm, _, _ := newSwitch()
+
+	// block the goroutine, so that the mailbox fills up
+	blocked := func(ai *hsm.ActiveInstance[*int]) chan struct{} {
+		release, started := make(chan struct{}), make(chan struct{})
+		go ai.Do(context.Background(), func(*hsm.StateMachineInstance[*int]) {
+			close(started)
+			<-release
+		})
+		<-started
+		return release
+	}
+
+	t.Run("error", func(t *testing.T) {
+		ai := hsm.ActiveInstance[*int]{Instance: &hsm.StateMachineInstance[*int]{SM: sm, Ext: new(int)},
+			MailboxSize: 1, Overflow: hsm.OverflowError}
+		ai.Start(context.Background(), hsm.Event{})
+		release := blocked(&ai)
+		assert.NoError(t, ai.Post(hsm.Event{Id: evToggle}))
+		assert.Equal(t, hsm.ErrMailboxFull, ai.Post(hsm.Event{Id: evToggle}))
+		close(release)
+		ai.Stop()
+		assert.Equal(t, 1, *ai.Instance.Ext)
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		ai := hsm.ActiveInstance[*int]{Instance: &hsm.StateMachineInstance[*int]{SM: sm, Ext: new(int)},
+			MailboxSize: 1, Overflow: hsm.OverflowDrop}
+		ai.Start(context.Background(), hsm.Event{})
+		release := blocked(&ai)
+		assert.NoError(t, ai.Post(hsm.Event{Id: evToggle}))
+		assert.NoError(t, ai.Post(hsm.Event{Id: evToggle}))
+		_, _, err := ai.Send(context.Background(), hsm.Event{Id: evToggle})
+		assert.Equal(t, hsm.ErrMailboxFull, err)
+		assert.Equal(t, uint64(2), ai.Dropped())
+		close(release)
+		ai.Stop()
+		assert.Equal(t, 1, *ai.Instance.Ext)
+	})
+
+	t.Run("block", func(t *testing.T) {
+		ai := hsm.ActiveInstance[*int]{Instance: &hsm.StateMachineInstance[*int]{SM: sm, Ext: new(int)},
+			MailboxSize: 1, Overflow: hsm.OverflowBlock}
+		ai.Start(context.Background(), hsm.Event{})
+		release := blocked(&ai)
+		assert.NoError(t, ai.Post(hsm.Event{Id: evToggle}))
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, _, err := ai.Send(ctx, hsm.Event{Id: evToggle})
+		assert.Equal(t, context.DeadlineExceeded, err)
+		close(release)
+		handled, _, err := ai.Send(context.Background(), hsm.Event{Id: evToggle})
+		assert.NoError(t, err)
+		assert.True(t, handled)
+		ai.Stop()
+		assert.Equal(t, 1, *ai.Instance.Ext)
+	})
+}
+
+func TestActiveInstanceTimers(t *testing.T) {
+	sm := hsm.StateMachine[struct{}]{}
+	a := sm.State("a").Initial().Build()
+	b := sm.State("b").Build()
+	a.After(time.Minute, b).Build()
+	sm.Finalize()
+
+	clock := hsm.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	ai := hsm.ActiveInstance[struct{}]{Instance: &hsm.StateMachineInstance[struct{}]{SM: &sm, Clock: clock}}
+	ai.Start(context.Background(), hsm.Event{})
+	defer ai.Stop()
+
+	current := func() (s *hsm.State[struct{}]) {
+		ai.Do(context.Background(), func(smi *hsm.StateMachineInstance[struct{}]) { s = smi.Current() })
+		return
+	}
+	assert.Equal(t, a, current())
+	clock.Advance(time.Minute)
+	assert.Eventually(t, func() bool { return current() == b }, time.Second, time.Millisecond)
+}
@@ -0,0 +1,175 @@
+package hsm
+
+// Analysis is the result of the static analysis of a state machine structure, see [StateMachine.Analyze].
+// All the lists are in document order.
+type Analysis[E any] struct {
+	// Unreachable lists the states that can never be entered.
+	Unreachable []*State[E]
+	// DeadEnds lists the reachable leaf states with no way out:
+	// neither the state nor any of its super-states has a transition that would exit it,
+	// nor does any state in the sibling regions of its orthogonal super-states have a transition exiting them.
+	DeadEnds []*State[E]
+	// Shadowed lists the transitions that can never fire,
+	// because an earlier unguarded transition of the same state is triggered the same way.
+	Shadowed []ShadowedTransition[E]
+}
+
+// ShadowedTransition identifies a transition that can never fire, because it is shadowed by an earlier one.
+// Index and By are the positions of the shadowed and the shadowing transition in State.Transitions().
+type ShadowedTransition[E any] struct {
+	State *State[E]
+	Index int
+	By    int
+}
+
+// Analyze analyzes the structure of a finalized state machine, looking for states and transitions
+// that are likely to be mistakes, such as states that can never be entered.
+//
+// A state is reachable if it's entered by the initial transition of the state machine,
+// by a transition from a reachable state, treating all guards as possibly true,
+// or by the transition into the error state (see [StateMachine.ErrorState]), taken after a failed action.
+// Shadowed transitions are ignored, both when looking for reachable states and for dead ends.
+// Entering a state also enters its super-states, its default sub-states,
+// and the default sub-states of any orthogonal regions it is not in.
+// Transitions into history are treated as entering the target's default sub-states,
+// since history can only restore sub-states that were previously entered.
+// Branches of choice and junction pseudostates are followed as well.
+func (sm *StateMachine[E]) Analyze() Analysis[E] {
+	if !sm.finalized {
+		panic("state machine not finalized")
+	}
+	var a Analysis[E]
+	shadowed := make(map[*transition[E]]bool)
+	sm.Walk(func(s *State[E]) {
+		for _, st := range s.shadowed() {
+			a.Shadowed = append(a.Shadowed, st)
+			shadowed[s.transitions[st.Index]] = true
+		}
+	})
+
+	reached := make(map[*State[E]]bool)
+	var queue []*State[E]
+	mark := func(s *State[E]) {
+		if !reached[s] {
+			reached[s] = true
+			queue = append(queue, s)
+		}
+	}
+	// enterDefault marks the default sub-states of state s
+	var enterDefault func(s *State[E])
+	enterDefault = func(s *State[E]) {
+		if s.isOrthogonal() {
+			for _, r := range s.children {
+				mark(r)
+				enterDefault(r)
+			}
+		} else if s.initial != nil {
+			mark(s.initial)
+			enterDefault(s.initial)
+		}
+	}
+	// enter marks state s when it's the target of a transition
+	enter := func(s *State[E]) {
+		for s1 := s; s1.parent != nil; s1 = s1.parent {
+			mark(s1)
+			if !s1.region {
+				continue
+			}
+			for _, r := range s1.parent.children {
+				if r != s1 {
+					mark(r)
+					enterDefault(r)
+				}
+			}
+		}
+		enterDefault(s)
+	}
+
+	enterDefault(&sm.top)
+	if sm.ErrorState != nil {
+		enter(sm.ErrorState)
+	}
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+		for _, t := range s.transitions {
+			if !t.internal && t.target != &sm.terminal && !shadowed[t] {
+				enter(t.target)
+			}
+		}
+	}
+
+	sm.Walk(func(s *State[E]) {
+		if !reached[s] {
+			a.Unreachable = append(a.Unreachable, s)
+		} else if s.IsLeaf() && s.pseudo == pseudoNone && !s.hasWayOut(shadowed) {
+			a.DeadEnds = append(a.DeadEnds, s)
+		}
+	})
+	return a
+}
+
+// hasWayOut returns whether the state or any of its super-states has a transition exiting it,
+// or a state in a sibling region of any of its orthogonal super-states has a transition exiting that super-state,
+// other than the shadowed transitions.
+func (s *State[E]) hasWayOut(shadowed map[*transition[E]]bool) bool {
+	for ; s != nil; s = s.parent {
+		for _, t := range s.transitions {
+			if !t.internal && !shadowed[t] {
+				return true
+			}
+		}
+		if !s.region {
+			continue
+		}
+		for _, r := range s.parent.children {
+			if r != s && r.exits(s.parent, shadowed) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// exits returns whether the state or any of its sub-states has a transition exiting state p,
+// other than the shadowed transitions.
+func (s *State[E]) exits(p *State[E], shadowed map[*transition[E]]bool) bool {
+	for _, t := range s.transitions {
+		if !t.internal && !shadowed[t] && isAncestor(t.domain, p) {
+			return true
+		}
+	}
+	for _, s1 := range s.children {
+		if s1.exits(p, shadowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// shadowed returns the transitions of the state shadowed by earlier unguarded transitions triggered the same way.
+// Transitions into junctions are never considered unguarded, since the junction may have no enabled branch.
+func (s *State[E]) shadowed() []ShadowedTransition[E] {
+	var result []ShadowedTransition[E]
+	for i, t := range s.transitions {
+		for j, t1 := range s.transitions[:i] {
+			if t1.guard == nil && t1.target.pseudo != pseudoJunction && t1.sameTrigger(t) {
+				result = append(result, ShadowedTransition[E]{State: s, Index: i, By: j})
+				break
+			}
+		}
+	}
+	return result
+}
+
+// sameTrigger returns whether the two transitions are triggered by the same event, or are both completion transitions.
+// Time-triggered transitions are never triggered the same way, since each one is triggered by its own time event.
+func (t *transition[E]) sameTrigger(t1 *transition[E]) bool {
+	switch {
+	case t.trigger == triggerEvent && t1.trigger == triggerEvent:
+		return t.eventId == t1.eventId
+	case t.trigger == triggerCompletion && t1.trigger == triggerCompletion:
+		return true
+	}
+	return false
+}
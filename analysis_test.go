@@ -0,0 +1,96 @@
+package hsm_test
+
+import (
+	"github.com/dragomit/hsm"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestAnalyze(t *testing.T) {
+	sm := hsm.StateMachine[struct{}]{}
+	yes := func(hsm.Event, struct{}) bool { return true }
+
+	idle := sm.State("Idle").Initial().Build()
+	busy := sm.State("Busy").Build()
+	working := busy.State("Working").Initial().Build()
+	waiting := busy.State("Waiting").Build()
+	stuck := sm.State("Stuck").Build()
+	orphan := sm.State("Orphan").Build()
+	orphanChild := orphan.State("Orphan child").Initial().Build()
+	on := sm.State("On").Build()
+	r1 := on.Region("r1")
+	x := r1.State("x").Initial().Build()
+	r2 := on.Region("r2")
+	y := r2.State("y").Initial().Build()
+	z := r2.State("z").Build()
+	hist := sm.State("Hist").Build()
+	h1 := hist.State("h1").Initial().Build()
+	h2 := hist.State("h2").Build()
+	c := sm.Choice("c")
+
+	idle.AddTransition(evNewData, busy)
+	idle.Transition(evNewData, stuck).Guard("never", yes).Build() // shadowed by the previous one
+	idle.AddTransition(evFailed, x)                               // enters y by default, but not z
+	idle.Transition(evResume, hist).History(hsm.HistoryShallow).Build()
+	h1.Transition(evPause, h1).Internal().Build()
+	h1.Transition(evPause, h2).Build() // shadowed by the internal transition, so h1 is a dead end and h2 unreachable
+	working.Transition(evSucceeded, c).Build()
+	c.Completion(stuck).Guard("yes", yes).Build()
+	c.Completion(idle).Build()
+	c.Completion(busy).Build() // shadowed by the previous branch
+	waiting.Transition(evNewData, waiting).Internal().Build()
+	busy.AddTransition(evAborted, nil)
+	x.After(time.Second, x).Build()
+	x.After(time.Second, x).Build() // each time event has its own timer, so this isn't shadowed
+	sm.Finalize()
+
+	a := sm.Analyze()
+	assert.Equal(t, []*hsm.State[struct{}]{waiting, orphan, orphanChild, z, h2}, a.Unreachable)
+	assert.Equal(t, []*hsm.State[struct{}]{stuck, y, h1}, a.DeadEnds)
+	assert.Equal(t, []hsm.ShadowedTransition[struct{}]{
+		{State: idle, Index: 1, By: 0},
+		{State: h1, Index: 1, By: 0},
+		{State: c, Index: 2, By: 1},
+	}, a.Shadowed)
+}
+
+func TestAnalyzeOrthogonalWayOut(t *testing.T) {
+	sm := hsm.StateMachine[struct{}]{}
+	on := sm.State("On").Initial().Build()
+	off := sm.State("Off").Build()
+	r1 := on.Region("r1")
+	x1 := r1.State("x1").Initial().Build()
+	x2 := r1.State("x2").Build()
+	on.Region("r2").State("y").Initial().Build() // exited along with On
+	other := sm.State("Other").Build()
+	o1 := other.Region("o1")
+	p := o1.State("p").Initial().Build()
+	p2 := o1.State("p2").Build()
+	q := other.Region("o2").State("q").Initial().Build()
+
+	x1.AddTransition(evNewData, x2)
+	x2.AddTransition(evSucceeded, off) // the only way out of On, from region r1
+	off.AddTransition(evResume, other)
+	p.AddTransition(evFailed, p2) // stays within region o1, so neither p2 nor q can exit Other
+	sm.Finalize()
+
+	a := sm.Analyze()
+	assert.Empty(t, a.Unreachable)
+	assert.Equal(t, []*hsm.State[struct{}]{p2, q}, a.DeadEnds)
+}
+
+func TestAnalyzeErrorState(t *testing.T) {
+	sm := hsm.StateMachine[struct{}]{}
+	idle := sm.State("Idle").Initial().Build()
+	failed := sm.State("Failed").Build()
+	failedChild := failed.State("Failed child").Initial().Build()
+	failedChild.AddTransition(evResume, idle)
+	sm.ErrorState = failed
+	sm.Finalize()
+
+	// the error state is entered after failed actions, rather than by a transition
+	a := sm.Analyze()
+	assert.Empty(t, a.Unreachable)
+	assert.Equal(t, []*hsm.State[struct{}]{idle}, a.DeadEnds)
+}
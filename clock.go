@@ -0,0 +1,124 @@
+package hsm
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for the time events (see [State.After] and [State.At]).
+// Unless the Clock of a state machine instance is set, the system clock is used.
+// Tests may use [FakeClock] to advance time deterministically.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// NewTimer creates a timer which sends the current time on its channel after at least duration d.
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a single-shot timer created by a Clock, analogous to [time.Timer].
+type Timer interface {
+	// C returns the channel on which the time is delivered.
+	C() <-chan time.Time
+	// Stop prevents the timer from firing, returning false if the timer has already fired or been stopped.
+	Stop() bool
+}
+
+// SystemClock is the Clock backed by the time package.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+type systemTimer struct {
+	t *time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t systemTimer) Stop() bool {
+	return t.t.Stop()
+}
+
+// FakeClock is a Clock whose time only moves when advanced explicitly.
+// FakeClock is safe for concurrent use.
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// NewFakeClock creates a FakeClock set to the given time.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the current fake time.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer creates a timer which fires once the clock has been advanced by at least d.
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, deadline: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- c.now
+		return t
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d, firing any timers which expire in the meantime.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	keep := c.timers[:0]
+	for _, t := range c.timers {
+		if t.deadline.After(c.now) {
+			keep = append(keep, t)
+			continue
+		}
+		t.c <- c.now
+	}
+	for i := len(keep); i < len(c.timers); i++ {
+		c.timers[i] = nil
+	}
+	c.timers = keep
+}
+
+type fakeTimer struct {
+	clock    *FakeClock
+	deadline time.Time
+	c        chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, t1 := range c.timers {
+		if t1 == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package hsm_test
+
+import (
+	"bytes"
+	"github.com/dragomit/hsm"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCompletionTransitions(t *testing.T) {
+	const (
+		evSubmit = iota
+		evRetry
+	)
+
+	type order struct {
+		valid bool
+	}
+
+	var buf bytes.Buffer
+	makeA := func(txt string) func(hsm.Event, *order) {
+		return func(hsm.Event, *order) {
+			buf.WriteString(txt)
+			buf.WriteByte('|')
+		}
+	}
+	isValid := func(_ hsm.Event, o *order) bool { return o.valid }
+	isInvalid := func(_ hsm.Event, o *order) bool { return !o.valid }
+
+	sm := hsm.StateMachine[*order]{}
+	editing := sm.State("Editing").Entry("enter Editing", makeA("enter Editing")).Initial().Build()
+	validating := sm.State("Validating").Entry("enter Validating", makeA("enter Validating")).
+		Exit("exit Validating", makeA("exit Validating")).Build()
+	accepted := sm.State("Accepted").Entry("enter Accepted", makeA("enter Accepted")).Build()
+	rejected := sm.State("Rejected").Entry("enter Rejected", makeA("enter Rejected")).Build()
+
+	editing.AddTransition(evSubmit, validating)
+	validating.Completion(accepted).Guard("valid", isValid).Action("accept", makeA("accept")).Build()
+	validating.Completion(rejected).Guard("invalid", isInvalid).Build()
+	rejected.AddTransition(evRetry, validating)
+	accepted.Completion(nil).Build()
+
+	sm.Finalize()
+
+	t.Run("valid", func(t *testing.T) {
+		buf.Reset()
+		smi := hsm.StateMachineInstance[*order]{SM: &sm, Ext: &order{valid: true}}
+		smi.Initialize(hsm.Event{})
+		assert.Equal(t, editing, smi.Current())
+		handled, src := smi.Deliver(hsm.Event{Id: evSubmit})
+		assert.True(t, handled)
+		assert.Equal(t, editing, src)
+		assert.Nil(t, smi.Current())
+		assert.Equal(t, "enter Editing|enter Validating|exit Validating|accept|enter Accepted|", buf.String())
+	})
+
+	t.Run("invalid then valid", func(t *testing.T) {
+		buf.Reset()
+		smi := hsm.StateMachineInstance[*order]{SM: &sm, Ext: &order{}}
+		smi.Initialize(hsm.Event{})
+		smi.Deliver(hsm.Event{Id: evSubmit})
+		assert.Equal(t, rejected, smi.Current())
+		smi.Ext.valid = true
+		// guard is evaluated only once the state is entered
+		smi.Deliver(hsm.Event{Id: evSubmit})
+		assert.Equal(t, rejected, smi.Current())
+		smi.Deliver(hsm.Event{Id: evRetry})
+		assert.Nil(t, smi.Current())
+	})
+
+	wantsDiagram := `@startuml
+
+state Editing
+Editing : entry / enter Editing
+[*] --> Editing
+state Validating
+Validating : entry / enter Validating
+Validating : exit / exit Validating
+state Accepted
+Accepted : entry / enter Accepted
+state Rejected
+Rejected : entry / enter Rejected
+Editing --> Validating : submit
+Validating --> Accepted : [valid] / accept
+Validating --> Rejected : [invalid]
+Accepted --> [*]
+Rejected --> Validating : retry
+
+@enduml
+`
+	assert.Equal(t, wantsDiagram, sm.DiagramPUML(func(ev int) string { return []string{"submit", "retry"}[ev] }))
+}
+
+func TestCompletionOnInitialize(t *testing.T) {
+	sm := hsm.StateMachine[struct{}]{}
+	parent := sm.State("parent").Initial().Build()
+	a := parent.State("a").Initial().Build()
+	b := parent.State("b").Build()
+	c := sm.State("c").Build()
+	a.Completion(b).Build()
+	// child's completion transition takes precedence over parent's
+	parent.Completion(c).Build()
+	sm.Finalize()
+
+	smi := hsm.StateMachineInstance[struct{}]{SM: &sm}
+	smi.Initialize(hsm.Event{})
+	// parent's completion transition was not taken, since parent was not re-entered when entering b
+	assert.Equal(t, b, smi.Current())
+}
+
+func TestCompletionLoop(t *testing.T) {
+	sm := hsm.StateMachine[struct{}]{}
+	a := sm.State("a").Initial().Build()
+	b := sm.State("b").Build()
+	a.Completion(b).Build()
+	b.Completion(a).Build()
+	sm.Finalize()
+
+	smi := hsm.StateMachineInstance[struct{}]{SM: &sm}
+	assert.Panics(t, func() { smi.Initialize(hsm.Event{}) })
+}
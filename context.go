@@ -0,0 +1,90 @@
+package hsm
+
+import "unsafe"
+
+// Context provides actions and guards with access to the state machine instance executing them.
+// Actions and guards receive the Context when they are defined using
+// [StateBuilder.EntryCtx], [StateBuilder.ExitCtx], [TransitionBuilder.ActionCtx] or [TransitionBuilder.GuardCtx].
+// Context is only valid while the action or guard is executing, and must not be retained.
+type Context[E any] struct {
+	smi *StateMachineInstance[E]
+}
+
+// ctx returns the instance's context, passed into actions and guards.
+// The context lives inside the instance and points back at it. Both pointers are hidden from
+// escape analysis, so that handing the context to user functions doesn't by itself force
+// the instance onto the heap. This is safe as long as the context is not retained (see above).
+func (smi *StateMachineInstance[E]) ctx() *Context[E] {
+	smi.context.smi = (*StateMachineInstance[E])(noescape(unsafe.Pointer(smi)))
+	return (*Context[E])(noescape(unsafe.Pointer(&smi.context)))
+}
+
+// noescape hides a pointer from escape analysis, like the function of the same name in strings.Builder.
+//
+//go:nosplit
+//go:nocheckptr
+func noescape(p unsafe.Pointer) unsafe.Pointer {
+	x := uintptr(p)
+	return *(*unsafe.Pointer)(unsafe.Pointer(&x))
+}
+
+// Post posts an event to the instance's internal event queue.
+// The event will be delivered after the currently processed event has been fully processed,
+// and after any events posted earlier. Events posted using PostFront take precedence.
+// Deliver() does not return until all the posted events have been processed.
+// Events posted after the state machine has terminated are ignored.
+func (ctx *Context[E]) Post(e Event) {
+	ctx.smi.queue.push(e)
+}
+
+// PostFront posts an event to the priority lane of the instance's internal event queue.
+// Events in the priority lane are delivered in the order in which they were posted,
+// but before any events posted using Post.
+func (ctx *Context[E]) PostFront(e Event) {
+	ctx.smi.urgent.push(e)
+}
+
+// IsIn returns whether state s is active. See [StateMachineInstance.IsIn] for the semantics
+// while the state machine is taking a transition.
+func (ctx *Context[E]) IsIn(s *State[E]) bool {
+	return ctx.smi.IsIn(s)
+}
+
+// ActivePath returns the current state followed by its super-states. See [StateMachineInstance.ActivePath].
+func (ctx *Context[E]) ActivePath() []*State[E] {
+	return ctx.smi.ActivePath()
+}
+
+// eventQueue is a FIFO queue of events.
+type eventQueue struct {
+	events []Event
+	head   int
+}
+
+func (q *eventQueue) push(e Event) {
+	q.events = append(q.events, e)
+}
+
+func (q *eventQueue) pop() (e Event, ok bool) {
+	if q.head == len(q.events) {
+		return
+	}
+	e = q.events[q.head]
+	q.events[q.head] = Event{} // don't hold on to the event data
+	q.head++
+	if q.head == len(q.events) {
+		// queue is empty, reuse the storage
+		q.events, q.head = q.events[:0], 0
+	}
+	return e, true
+}
+
+func (q *eventQueue) len() int {
+	return len(q.events) - q.head
+}
+
+func (q *eventQueue) clear() {
+	for q.len() > 0 {
+		q.pop()
+	}
+}
@@ -0,0 +1,109 @@
+package hsm
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// DataTransitionBuilder builds a transition bound to event data of type T, see [OnData].
+type DataTransitionBuilder[E, T any] struct {
+	tb       *TransitionBuilder[E]
+	mismatch *State[E] // target of the transition taken when data is not of type T
+	route    bool      // events with data not of type T are routed to the mismatch state
+	panics   bool      // events with data not of type T cause a panic
+}
+
+// OnData binds the transition being built by tb to event data of type T.
+// The guards and actions of the returned builder receive the event data as T, rather than the whole event.
+// The event data is checked by a guard, evaluated before the guards specified using the returned builder.
+// The check is part of the Go code of the transition, like its guards and actions: it has no name,
+// so it's not shown in diagrams, and not exported by [StateMachine.Definition] or [StateMachine.SCXML].
+// By default, events whose data is not of type T are ignored, as if the guard returned false.
+// Use PanicOnMismatch or MismatchTo to treat such events as errors instead.
+// Other aspects of the transition, such as its type, must be specified using tb before calling OnData:
+//
+//	hsm.OnData[*Reading](s.Transition(evReading, s).Internal()).
+//		Guard("in range", func(r *Reading, e *eState) bool { return r.Value < e.limit }).
+//		Action("record", func(r *Reading, e *eState) { e.record(r) }).
+//		Build()
+func OnData[T, E any](tb *TransitionBuilder[E]) *DataTransitionBuilder[E, T] {
+	dtb := &DataTransitionBuilder[E, T]{tb: tb}
+	tb.addGuard(namedGuard[E]{implicit: true, guard: func(ctx *Context[E], event Event, _ E) bool {
+		if _, ok := event.Data.(T); ok {
+			return true
+		}
+		if dtb.panics && !ctx.smi.peeking {
+			panic(fmt.Sprintf("event %d: data is %T, rather than %s", event.Id, event.Data,
+				reflect.TypeOf((*T)(nil)).Elem()))
+		}
+		return false
+	}})
+	return dtb
+}
+
+// Guard specifies a guard condition receiving the event data as T, see [TransitionBuilder.Guard].
+func (dtb *DataTransitionBuilder[E, T]) Guard(name string, f func(T, E) bool) *DataTransitionBuilder[E, T] {
+	dtb.tb.GuardCtx(name, func(_ *Context[E], event Event, e E) bool {
+		return f(event.Data.(T), e)
+	})
+	return dtb
+}
+
+// GuardCtx is like Guard, but the guard function also receives the [Context] of the state machine instance.
+func (dtb *DataTransitionBuilder[E, T]) GuardCtx(name string, f func(*Context[E], T, E) bool) *DataTransitionBuilder[E, T] {
+	dtb.tb.GuardCtx(name, func(ctx *Context[E], event Event, e E) bool {
+		return f(ctx, event.Data.(T), e)
+	})
+	return dtb
+}
+
+// Action specifies a transition action receiving the event data as T, see [TransitionBuilder.Action].
+func (dtb *DataTransitionBuilder[E, T]) Action(name string, f func(T, E)) *DataTransitionBuilder[E, T] {
+	dtb.tb.ActionCtx(name, func(_ *Context[E], event Event, e E) {
+		f(event.Data.(T), e)
+	})
+	return dtb
+}
+
+// ActionCtx is like Action, but the action function also receives the [Context] of the state machine instance.
+func (dtb *DataTransitionBuilder[E, T]) ActionCtx(name string, f func(*Context[E], T, E)) *DataTransitionBuilder[E, T] {
+	dtb.tb.ActionCtx(name, func(ctx *Context[E], event Event, e E) {
+		f(ctx, event.Data.(T), e)
+	})
+	return dtb
+}
+
+// PanicOnMismatch specifies that events whose data is not of type T cause a panic,
+// which happens while evaluating the guard, before any state is exited.
+// Queries such as [StateMachineInstance.EnabledEvents] and [StateMachineInstance.CanHandle] don't panic,
+// treating the transition as not enabled instead.
+func (dtb *DataTransitionBuilder[E, T]) PanicOnMismatch() *DataTransitionBuilder[E, T] {
+	dtb.panics, dtb.route = true, false
+	return dtb
+}
+
+// MismatchTo specifies that events whose data is not of type T cause an external transition
+// from the source state into the given error state, or termination of the state machine if the state is nil.
+// The error transition is added to the source state right after the transition being built,
+// with the same trigger, and a guard checking the event data.
+func (dtb *DataTransitionBuilder[E, T]) MismatchTo(state *State[E]) *DataTransitionBuilder[E, T] {
+	dtb.mismatch, dtb.route, dtb.panics = state, true, false
+	return dtb
+}
+
+// Build completes building the transition, along with the error transition specified by MismatchTo, if any.
+func (dtb *DataTransitionBuilder[E, T]) Build() {
+	tb := dtb.tb
+	n := len(tb.src.transitions)
+	tb.Build()
+	if !dtb.route || len(tb.src.transitions) == n {
+		return // no error transition, or the builder was reused
+	}
+	etb := tb.src.newTransition(tb.t.eventId, dtb.mismatch, tb.t.trigger)
+	etb.t.after, etb.t.at = tb.t.after, tb.t.at
+	mismatch := func(event Event, _ E) bool {
+		_, ok := event.Data.(T)
+		return !ok
+	}
+	etb.addGuard(namedGuard[E]{implicit: true, guard: plainGuard(mismatch), plain: mismatch}).Build()
+}
@@ -0,0 +1,116 @@
+package hsm_test
+
+import (
+	"testing"
+
+	"github.com/dragomit/hsm"
+	"github.com/stretchr/testify/assert"
+)
+
+type reading struct {
+	value int
+}
+
+type meter struct {
+	total int
+}
+
+type meterBinding func(tb *hsm.TransitionBuilder[*meter], failed *hsm.State[*meter]) *hsm.DataTransitionBuilder[*meter, *reading]
+
+func meterMachine(bind meterBinding) (*hsm.StateMachine[*meter], *hsm.State[*meter], *hsm.State[*meter]) {
+	sm := hsm.StateMachine[*meter]{}
+	measuring := sm.State("measuring").Initial().Build()
+	failed := sm.State("failed").Build()
+	bind(measuring.Transition(0, measuring).Internal(), failed).
+		Guard("positive", func(r *reading, m *meter) bool { return r.value > 0 }).
+		Action("add", func(r *reading, m *meter) { m.total += r.value }).
+		Build()
+	sm.Finalize()
+	return &sm, measuring, failed
+}
+
+func TestOnData(t *testing.T) {
+	sm, measuring, _ := meterMachine(func(tb *hsm.TransitionBuilder[*meter], _ *hsm.State[*meter]) *hsm.DataTransitionBuilder[*meter, *reading] {
+		return hsm.OnData[*reading](tb)
+	})
+	m := &meter{}
+	smi := hsm.StateMachineInstance[*meter]{SM: sm, Ext: m}
+	smi.Initialize(hsm.Event{})
+
+	handled, _ := smi.Deliver(hsm.Event{Id: 0, Data: &reading{value: 3}})
+	assert.True(t, handled)
+	handled, _ = smi.Deliver(hsm.Event{Id: 0, Data: &reading{value: -1}})
+	assert.False(t, handled)
+	handled, _ = smi.Deliver(hsm.Event{Id: 0, Data: 5}) // ignored
+	assert.False(t, handled)
+	handled, _ = smi.Deliver(hsm.Event{Id: 0})
+	assert.False(t, handled)
+	assert.Equal(t, 3, m.total)
+	assert.Equal(t, measuring, smi.Current())
+	// the data check is not part of the guard name
+	assert.Equal(t, "positive", measuring.Transitions()[0].Guard)
+}
+
+func TestOnDataPanic(t *testing.T) {
+	sm, _, _ := meterMachine(func(tb *hsm.TransitionBuilder[*meter], _ *hsm.State[*meter]) *hsm.DataTransitionBuilder[*meter, *reading] {
+		return hsm.OnData[*reading](tb).PanicOnMismatch()
+	})
+	smi := hsm.StateMachineInstance[*meter]{SM: sm, Ext: &meter{}}
+	smi.Initialize(hsm.Event{})
+	assert.PanicsWithValue(t, "event 0: data is string, rather than *hsm_test.reading", func() {
+		smi.Deliver(hsm.Event{Id: 0, Data: "3"})
+	})
+}
+
+func TestOnDataPanicQueries(t *testing.T) {
+	sm, _, _ := meterMachine(func(tb *hsm.TransitionBuilder[*meter], _ *hsm.State[*meter]) *hsm.DataTransitionBuilder[*meter, *reading] {
+		return hsm.OnData[*reading](tb).PanicOnMismatch()
+	})
+	smi := hsm.StateMachineInstance[*meter]{SM: sm, Ext: &meter{}}
+	smi.Initialize(hsm.Event{})
+	// queries don't panic, treating the transition as not enabled
+	assert.Empty(t, smi.EnabledEvents(true))
+	assert.Len(t, smi.EnabledEvents(false), 1)
+	assert.False(t, smi.CanHandle(hsm.Event{Id: 0, Data: "3"}))
+	assert.True(t, smi.CanHandle(hsm.Event{Id: 0, Data: &reading{value: 3}}))
+	// but delivery still does
+	assert.Panics(t, func() { smi.Deliver(hsm.Event{Id: 0}) })
+}
+
+func TestOnDataMismatchTo(t *testing.T) {
+	sm, measuring, failed := meterMachine(func(tb *hsm.TransitionBuilder[*meter], failed *hsm.State[*meter]) *hsm.DataTransitionBuilder[*meter, *reading] {
+		return hsm.OnData[*reading](tb).MismatchTo(failed)
+	})
+	m := &meter{}
+	smi := hsm.StateMachineInstance[*meter]{SM: sm, Ext: m}
+	smi.Initialize(hsm.Event{})
+
+	handled, _ := smi.Deliver(hsm.Event{Id: 0, Data: &reading{value: -1}}) // guard fails, but data is fine
+	assert.False(t, handled)
+	assert.Equal(t, measuring, smi.Current())
+	handled, src := smi.Deliver(hsm.Event{Id: 0, Data: 5})
+	assert.True(t, handled)
+	assert.Equal(t, measuring, src)
+	assert.Equal(t, failed, smi.Current())
+	assert.Equal(t, 0, m.total)
+
+	tis := measuring.Transitions()
+	assert.Len(t, tis, 2)
+	assert.Equal(t, failed, tis[1].Target)
+	assert.True(t, tis[1].Guarded)
+	assert.Equal(t, "", tis[1].Guard)
+}
+
+func TestOnDataExport(t *testing.T) {
+	sm, _, _ := meterMachine(func(tb *hsm.TransitionBuilder[*meter], failed *hsm.State[*meter]) *hsm.DataTransitionBuilder[*meter, *reading] {
+		return hsm.OnData[*reading](tb).MismatchTo(failed)
+	})
+	evName := func(int) string { return "reading" }
+	for _, doc := range []string{sm.DiagramMermaid(evName), sm.DiagramPUML(evName), sm.DiagramDOT(evName),
+		sm.SCXML(evName), sm.YAML(evName)} {
+		assert.NotContains(t, doc, "data is")
+		assert.NotContains(t, doc, "_unnamed")
+	}
+	assert.Contains(t, sm.DiagramMermaid(evName), "measuring --> failed : reading\n")
+	assert.Contains(t, sm.SCXML(evName), `<transition event="reading" cond="positive">`)
+}
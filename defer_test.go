@@ -0,0 +1,95 @@
+package hsm_test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/dragomit/hsm"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDeferredEvents(t *testing.T) {
+	const (
+		evConnect = iota
+		evConnected
+		evSend
+		evClose
+		evAuth
+	)
+
+	var buf bytes.Buffer
+	send := func(e hsm.Event, _ struct{}) {
+		fmt.Fprintf(&buf, "send %v|", e.Data)
+	}
+
+	sm := hsm.StateMachine[struct{}]{}
+	idle := sm.State("Idle").Initial().Build()
+	connecting := sm.State("Connecting").Defer(evSend, evClose).Build()
+	connected := sm.State("Connected").Build()
+	authenticating := connected.State("Authenticating").Initial().Defer(evSend).Build()
+	ready := connected.State("Ready").Build()
+
+	idle.AddTransition(evConnect, connecting)
+	connecting.AddTransition(evConnected, connected)
+	authenticating.AddTransition(evAuth, ready)
+	connected.Transition(evSend, connected).Internal().Action("send", send).Build()
+	connected.AddTransition(evClose, idle)
+
+	sm.Finalize()
+
+	smi := hsm.StateMachineInstance[struct{}]{SM: &sm}
+	smi.Initialize(hsm.Event{})
+
+	// not deferred in Idle, so it is discarded
+	handled, _ := smi.Deliver(hsm.Event{Id: evSend, Data: 0})
+	assert.False(t, handled)
+
+	smi.Deliver(hsm.Event{Id: evConnect})
+	handled, src := smi.Deliver(hsm.Event{Id: evSend, Data: 1})
+	assert.True(t, handled)
+	assert.Equal(t, connecting, src)
+	smi.Deliver(hsm.Event{Id: evSend, Data: 2})
+	smi.Deliver(hsm.Event{Id: evClose})
+	assert.Equal(t, "", buf.String())
+
+	// sends are still deferred while authenticating, but close is handled by Connected,
+	// and once back in Idle the sends are discarded
+	smi.Deliver(hsm.Event{Id: evConnected})
+	assert.Equal(t, idle, smi.Current())
+	assert.Equal(t, "", buf.String())
+
+	smi.Deliver(hsm.Event{Id: evConnect})
+	smi.Deliver(hsm.Event{Id: evSend, Data: 3})
+	smi.Deliver(hsm.Event{Id: evConnected})
+	smi.Deliver(hsm.Event{Id: evSend, Data: 4})
+	assert.Equal(t, authenticating, smi.Current())
+	assert.Equal(t, "", buf.String())
+
+	smi.Deliver(hsm.Event{Id: evAuth})
+	assert.Equal(t, ready, smi.Current())
+	assert.Equal(t, "send 3|send 4|", buf.String())
+
+	wantsDiagram := `@startuml
+
+state Idle
+[*] --> Idle
+state Connecting
+Connecting : send / defer
+Connecting : close / defer
+state Connected {
+   state Authenticating
+   Authenticating : send / defer
+   [*] --> Authenticating
+   state Ready
+}
+Connected : send / send
+Idle --> Connecting : connect
+Connecting --> Connected : connected
+Authenticating --> Ready : auth
+Connected --> Idle : close
+
+@enduml
+`
+	names := []string{"connect", "connected", "send", "close", "auth"}
+	assert.Equal(t, wantsDiagram, sm.DiagramBuilder(func(ev int) string { return names[ev] }).Build())
+}
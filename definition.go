@@ -0,0 +1,434 @@
+package hsm
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"strings"
+	"time"
+)
+
+// Definition is a declarative definition of the state machine structure,
+// which can be stored as a YAML or JSON document.
+// Actions, guards and events are referred to by their names.
+// Use [LoadDefinition] (or [LoadYAML] and [LoadJSON]) to build a state machine from a definition,
+// and [StateMachine.Definition] (or [StateMachine.YAML] and [StateMachine.JSON]) to go the other way.
+type Definition struct {
+	States []StateDef `json:"states" yaml:"states"`
+}
+
+// StateDef defines a state, along with its sub-states and outgoing transitions.
+// Kind is empty for regular states, and "choice" or "junction" for pseudostates.
+// Orthogonal regions of a state are listed as Regions, rather than States.
+// Entry and Exit list the names of entry and exit actions, and Defer the names of deferred events.
+type StateDef struct {
+	Name        string          `json:"name" yaml:"name"`
+	Kind        string          `json:"kind,omitempty" yaml:"kind,omitempty"`
+	Initial     bool            `json:"initial,omitempty" yaml:"initial,omitempty"`
+	Entry       []string        `json:"entry,omitempty" yaml:"entry,omitempty"`
+	Exit        []string        `json:"exit,omitempty" yaml:"exit,omitempty"`
+	Defer       []string        `json:"defer,omitempty" yaml:"defer,omitempty"`
+	Transitions []TransitionDef `json:"transitions,omitempty" yaml:"transitions,omitempty"`
+	States      []StateDef      `json:"states,omitempty" yaml:"states,omitempty"`
+	Regions     []StateDef      `json:"regions,omitempty" yaml:"regions,omitempty"`
+}
+
+// TransitionDef defines a transition.
+// The transition is triggered by the named Event, by the time event given by After (a duration, such as "5s")
+// or At (a time in RFC 3339 format), or else it's a completion transition.
+// Target is the name of the target state, or its path (see [State.Path]) if the name is not unique.
+// Target is omitted for internal transitions, and for transitions terminating the state machine,
+// which set Terminate instead.
+// History is either "shallow" or "deep", for transitions into history.
+type TransitionDef struct {
+	Event     string   `json:"event,omitempty" yaml:"event,omitempty"`
+	After     string   `json:"after,omitempty" yaml:"after,omitempty"`
+	At        string   `json:"at,omitempty" yaml:"at,omitempty"`
+	Target    string   `json:"target,omitempty" yaml:"target,omitempty"`
+	Terminate bool     `json:"terminate,omitempty" yaml:"terminate,omitempty"`
+	Guards    []string `json:"guards,omitempty" yaml:"guards,omitempty"`
+	Actions   []string `json:"actions,omitempty" yaml:"actions,omitempty"`
+	Internal  bool     `json:"internal,omitempty" yaml:"internal,omitempty"`
+	Local     bool     `json:"local,omitempty" yaml:"local,omitempty"`
+	History   string   `json:"history,omitempty" yaml:"history,omitempty"`
+}
+
+// LoadYAML builds a finalized state machine from a YAML document. See [LoadDefinition] for details.
+func LoadYAML[E any](r io.Reader, reg Registry[E], events map[string]int) (*StateMachine[E], error) {
+	var def Definition
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	if err := dec.Decode(&def); err != nil {
+		return nil, fmt.Errorf("definition: %w", err)
+	}
+	return LoadDefinition(&def, reg, events)
+}
+
+// LoadJSON builds a finalized state machine from a JSON document. See [LoadDefinition] for details.
+func LoadJSON[E any](r io.Reader, reg Registry[E], events map[string]int) (*StateMachine[E], error) {
+	var def Definition
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&def); err != nil {
+		return nil, fmt.Errorf("definition: %w", err)
+	}
+	return LoadDefinition(&def, reg, events)
+}
+
+// LoadDefinition builds a finalized state machine from the definition.
+// Actions and guards are looked up by name in the registry,
+// while event names are mapped to event ids using the events table.
+// Unresolved names and problems with the structure of the state machine are reported as errors,
+// and no state machine is returned in that case.
+func LoadDefinition[E any](def *Definition, reg Registry[E], events map[string]int) (*StateMachine[E], error) {
+	sm := &StateMachine[E]{CollectErrors: true}
+	sm.top.sm = sm
+	sm.top.name = "machine"
+	l := defLoader[E]{
+		sm:     sm,
+		reg:    reg,
+		events: events,
+		byPath: make(map[string]*State[E]),
+		byName: make(map[string][]*State[E]),
+	}
+	l.buildStates(&sm.top, def.States, false)
+	l.buildTransitions(&sm.top, def.States)
+	if len(l.errs) > 0 {
+		return nil, errors.Join(l.errs...)
+	}
+	if err := sm.FinalizeE(); err != nil {
+		return nil, err
+	}
+	sm.CollectErrors = false
+	return sm, nil
+}
+
+// defLoader keeps track of the state machine being built from a definition
+type defLoader[E any] struct {
+	sm     *StateMachine[E]
+	reg    Registry[E]
+	events map[string]int
+	byPath map[string]*State[E]
+	byName map[string][]*State[E]
+	errs   []error
+}
+
+func (l *defLoader[E]) errorf(format string, args ...any) {
+	l.errs = append(l.errs, fmt.Errorf("definition: "+format, args...))
+}
+
+// child returns the sub-state of s with the given name, as built by buildStates.
+func (l *defLoader[E]) child(s *State[E], name string) *State[E] {
+	path := name
+	if s != &l.sm.top {
+		path = s.Path() + "/" + name
+	}
+	return l.byPath[path]
+}
+
+// buildStates builds the sub-states (or regions) of state s.
+func (l *defLoader[E]) buildStates(s *State[E], defs []StateDef, regions bool) {
+	for i := range defs {
+		d := &defs[i]
+		if l.child(s, d.Name) != nil {
+			l.errorf("duplicate state %s in %s", d.Name, s.name)
+			continue
+		}
+		if len(d.States) > 0 && len(d.Regions) > 0 {
+			l.errorf("state %s can not have both sub-states and regions", d.Name)
+		}
+		var s1 *State[E]
+		switch {
+		case regions:
+			if d.Kind != "" || d.Initial || len(d.Entry) > 0 || len(d.Exit) > 0 || len(d.Defer) > 0 ||
+				len(d.Transitions) > 0 || len(d.Regions) > 0 {
+				l.errorf("region %s can only have a name and states", d.Name)
+			}
+			s1 = s.Region(d.Name)
+		case d.Kind == "choice":
+			s1 = s.Choice(d.Name)
+		case d.Kind == "junction":
+			s1 = s.Junction(d.Name)
+		case d.Kind != "":
+			l.errorf("state %s: unknown kind %s", d.Name, d.Kind)
+			continue
+		default:
+			s1 = l.buildState(s, d)
+		}
+		if s1.pseudo != pseudoNone && (d.Initial || len(d.Entry) > 0 || len(d.Exit) > 0 || len(d.Defer) > 0 ||
+			len(d.States) > 0 || len(d.Regions) > 0) {
+			l.errorf("%s %s can only have a name and transitions", d.Kind, d.Name)
+		}
+		l.byPath[s1.Path()] = s1
+		l.byName[d.Name] = append(l.byName[d.Name], s1)
+		l.buildStates(s1, d.States, false)
+		l.buildStates(s1, d.Regions, true)
+	}
+}
+
+// buildState builds the regular sub-state of parent state p.
+func (l *defLoader[E]) buildState(p *State[E], d *StateDef) *State[E] {
+	sb := p.State(d.Name)
+	if d.Initial {
+		sb.Initial()
+	}
+	for _, name := range d.Entry {
+		if f, err := l.reg.action(name); err != nil {
+			l.errorf("state %s entry: %v", d.Name, err)
+		} else {
+			sb.Entry(name, f)
+		}
+	}
+	for _, name := range d.Exit {
+		if f, err := l.reg.action(name); err != nil {
+			l.errorf("state %s exit: %v", d.Name, err)
+		} else {
+			sb.Exit(name, f)
+		}
+	}
+	for _, ev := range d.Defer {
+		if id, ok := l.events[ev]; ok {
+			sb.Defer(id)
+		} else {
+			l.errorf("state %s: unknown deferred event %s", d.Name, ev)
+		}
+	}
+	return sb.Build()
+}
+
+// buildTransitions builds the transitions of the sub-states (or regions) of state s.
+func (l *defLoader[E]) buildTransitions(s *State[E], defs []StateDef) {
+	for i := range defs {
+		d := &defs[i]
+		s1 := l.child(s, d.Name)
+		if s1 == nil {
+			continue // failed to build
+		}
+		if !s1.region { // transitions of regions are reported by buildStates
+			for j := range d.Transitions {
+				l.buildTransition(s1, &d.Transitions[j])
+			}
+		}
+		l.buildTransitions(s1, d.States)
+		l.buildTransitions(s1, d.Regions)
+	}
+}
+
+// target finds the state with the given path, or with the given name if the name is unique.
+func (l *defLoader[E]) target(name string) (*State[E], error) {
+	if s := l.byPath[name]; s != nil {
+		return s, nil
+	}
+	switch states := l.byName[name]; len(states) {
+	case 0:
+		return nil, fmt.Errorf("unknown target %s", name)
+	case 1:
+		return states[0], nil
+	default:
+		return nil, fmt.Errorf("ambiguous target %s, use its path instead", name)
+	}
+}
+
+// buildTransition builds the transition from state s.
+func (l *defLoader[E]) buildTransition(s *State[E], d *TransitionDef) {
+	nErrs := len(l.errs)
+
+	var target *State[E]
+	switch {
+	case d.Target != "":
+		var err error
+		if target, err = l.target(d.Target); err != nil {
+			l.errorf("state %s: %v", s.name, err)
+		}
+	case d.Internal:
+		target = s
+	case !d.Terminate:
+		l.errorf("state %s: transition must have a target, or be internal or terminating", s.name)
+	case d.Local:
+		l.errorf("state %s: terminating transition can not be local", s.name)
+	}
+	if d.Terminate && (d.Target != "" || d.Internal) {
+		l.errorf("state %s: terminating transition can not have a target, or be internal", s.name)
+	}
+
+	history := HistoryNone
+	switch d.History {
+	case "":
+	case "shallow":
+		history = HistoryShallow
+	case "deep":
+		history = HistoryDeep
+	default:
+		l.errorf("state %s: unknown history type %s", s.name, d.History)
+	}
+
+	guards := make([]func(Event, E) bool, len(d.Guards))
+	for i, name := range d.Guards {
+		var err error
+		if guards[i], err = l.reg.guard(name); err != nil {
+			l.errorf("state %s transition: %v", s.name, err)
+		}
+	}
+	actions := make([]func(Event, E), len(d.Actions))
+	for i, name := range d.Actions {
+		var err error
+		if actions[i], err = l.reg.action(name); err != nil {
+			l.errorf("state %s transition: %v", s.name, err)
+		}
+	}
+
+	var tb *TransitionBuilder[E]
+	switch {
+	case d.Event != "":
+		if id, ok := l.events[d.Event]; ok {
+			tb = s.Transition(id, target)
+		} else {
+			l.errorf("state %s: unknown event %s", s.name, d.Event)
+		}
+	case d.After != "":
+		if dur, err := time.ParseDuration(d.After); err != nil {
+			l.errorf("state %s: invalid after: %v", s.name, err)
+		} else {
+			tb = s.After(dur, target)
+		}
+	case d.At != "":
+		if t, err := time.Parse(time.RFC3339Nano, d.At); err != nil {
+			l.errorf("state %s: invalid at: %v", s.name, err)
+		} else {
+			tb = s.At(t, target)
+		}
+	default:
+		tb = s.Completion(target)
+	}
+	if len(l.errs) > nErrs {
+		return // the state machine is discarded anyway
+	}
+
+	if d.Internal {
+		tb.Internal()
+	}
+	if d.Local {
+		tb.Local(true)
+	}
+	if history != HistoryNone {
+		tb.History(history)
+	}
+	for i, name := range d.Guards {
+		tb.Guard(name, guards[i])
+	}
+	for i, name := range d.Actions {
+		tb.Action(name, actions[i])
+	}
+	tb.Build()
+}
+
+// Definition returns the definition of a finalized state machine.
+// evNameMapper provides mapping of event ids to event names.
+// Actions and guards with no name are exported as "_unnamed", which LoadDefinition refuses to resolve,
+// so that the definition can't be loaded without them by mistake.
+func (sm *StateMachine[E]) Definition(evNameMapper func(int) string) *Definition {
+	if !sm.finalized {
+		panic("state machine not finalized")
+	}
+	count := make(map[string]int)
+	var countNames func(s *State[E])
+	countNames = func(s *State[E]) {
+		for _, s1 := range s.children {
+			count[s1.name]++
+			countNames(s1)
+		}
+	}
+	countNames(&sm.top)
+	target := func(s *State[E]) string {
+		if count[s.name] > 1 {
+			return s.Path()
+		}
+		return s.name
+	}
+
+	var stateDef func(s *State[E]) StateDef
+	stateDef = func(s *State[E]) StateDef {
+		d := StateDef{
+			Name:    s.name,
+			Initial: s.parent.initial == s && !s.parent.isOrthogonal(),
+			Entry:   definitionNames(s.entryNames),
+			Exit:    definitionNames(s.exitNames),
+		}
+		if s.pseudo != pseudoNone {
+			d.Kind = s.pseudo.String()
+		}
+		for _, id := range s.deferred {
+			d.Defer = append(d.Defer, evNameMapper(id))
+		}
+		for _, t := range s.transitions {
+			td := TransitionDef{
+				Guards:   definitionNames(t.guardNames),
+				Actions:  definitionNames(t.actionNames),
+				Internal: t.internal,
+				Local:    t.local,
+			}
+			switch t.trigger {
+			case triggerEvent:
+				td.Event = evNameMapper(t.eventId)
+			case triggerAfter:
+				td.After = t.after.String()
+			case triggerAt:
+				td.At = t.at.Format(time.RFC3339Nano)
+			}
+			switch {
+			case t.target == &sm.terminal:
+				td.Terminate = true
+			case !t.internal:
+				td.Target = target(t.target)
+			}
+			switch t.history {
+			case HistoryShallow:
+				td.History = "shallow"
+			case HistoryDeep:
+				td.History = "deep"
+			}
+			d.Transitions = append(d.Transitions, td)
+		}
+		for _, child := range s.children {
+			if s.isOrthogonal() {
+				d.Regions = append(d.Regions, stateDef(child))
+			} else {
+				d.States = append(d.States, stateDef(child))
+			}
+		}
+		return d
+	}
+
+	def := &Definition{}
+	for _, s := range sm.top.children {
+		def.States = append(def.States, stateDef(s))
+	}
+	return def
+}
+
+// YAML returns the definition of a finalized state machine as a YAML document.
+// evNameMapper provides mapping of event ids to event names.
+func (sm *StateMachine[E]) YAML(evNameMapper func(int) string) string {
+	var bld strings.Builder
+	enc := yaml.NewEncoder(&bld)
+	enc.SetIndent(2)
+	if err := enc.Encode(sm.Definition(evNameMapper)); err != nil {
+		panic(err) // can't happen, definition consists of plain values only
+	}
+	return bld.String()
+}
+
+// JSON returns the definition of a finalized state machine as an indented JSON document.
+// evNameMapper provides mapping of event ids to event names.
+func (sm *StateMachine[E]) JSON(evNameMapper func(int) string) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(sm.Definition(evNameMapper)); err != nil {
+		panic(err) // can't happen, definition consists of plain values only
+	}
+	return buf.String()
+}
@@ -0,0 +1,236 @@
+package hsm_test
+
+import (
+	"github.com/dragomit/hsm"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestDefinitionExport(t *testing.T) {
+	sm := hsm.StateMachine[struct{}]{}
+	nop := func(hsm.Event, struct{}) {}
+	yes := func(hsm.Event, struct{}) bool { return true }
+
+	idle := sm.State("Idle").Initial().Build()
+	busy := sm.State("Busy").Entry("start", nop).Defer(evPause).Build()
+	working := busy.State("Working").Initial().Build()
+	idle.Transition(evNewData, busy).Guard("valid", yes).Action("store", nop).Build()
+	working.Transition(evNewData, working).Internal().Action("store", nop).Build()
+	busy.Transition(evSucceeded, idle).Build()
+	idle.AddTransition(evAborted, nil)
+	sm.Finalize()
+
+	wants := `states:
+  - name: Idle
+    initial: true
+    transitions:
+      - event: New data
+        target: Busy
+        guards:
+          - valid
+        actions:
+          - store
+      - event: Aborted
+        terminate: true
+  - name: Busy
+    entry:
+      - start
+    defer:
+      - Pause
+    transitions:
+      - event: Succeeded
+        target: Idle
+    states:
+      - name: Working
+        initial: true
+        transitions:
+          - event: New data
+            actions:
+              - store
+            internal: true
+`
+	assert.Equal(t, wants, sm.YAML(scxmlEvName))
+	assert.Contains(t, sm.JSON(scxmlEvName), `{
+  "states": [
+    {
+      "name": "Idle",
+      "initial": true,
+      "transitions": [
+        {
+          "event": "New data",
+          "target": "Busy",`)
+}
+
+func TestDefinitionRoundTrip(t *testing.T) {
+	nop := func(hsm.Event, struct{}) {}
+	yes := func(hsm.Event, struct{}) bool { return true }
+	sm := scxmlMachine(nop, yes)
+	reg := hsm.Registry[struct{}]{
+		Actions: map[string]func(hsm.Event, struct{}){"start": nop, "stop": nop, "store": nop, "save": nop, "close": nop},
+		Guards:  map[string]func(hsm.Event, struct{}) bool{"full": yes, "retry": yes},
+	}
+	events := make(map[string]int)
+	for id, name := range scxmlNames {
+		events[name] = id
+	}
+
+	// states with the same name are targeted by their path
+	doc := sm.YAML(scxmlEvName)
+	assert.Contains(t, doc, "target: On/r1/State1\n")
+	loaded, err := hsm.LoadYAML(strings.NewReader(doc), reg, events)
+	assert.NoError(t, err)
+	assert.Equal(t, doc, loaded.YAML(scxmlEvName))
+	assert.Equal(t, sm.SCXML(scxmlEvName), loaded.SCXML(scxmlEvName))
+
+	doc = sm.JSON(scxmlEvName)
+	loaded, err = hsm.LoadJSON(strings.NewReader(doc), reg, events)
+	assert.NoError(t, err)
+	assert.Equal(t, doc, loaded.JSON(scxmlEvName))
+}
+
+func TestDefinitionUnnamed(t *testing.T) {
+	sm := hsm.StateMachine[struct{}]{}
+	nop := func(hsm.Event, struct{}) {}
+	yes := func(hsm.Event, struct{}) bool { return true }
+	idle := sm.State("Idle").Initial().Exit("", nop).Build()
+	idle.Transition(evNewData, idle).Guard("", yes).Action("store", nop).Action("", nop).Build()
+	sm.Finalize()
+
+	doc := sm.YAML(scxmlEvName)
+	assert.Equal(t, `states:
+  - name: Idle
+    initial: true
+    exit:
+      - _unnamed
+    transitions:
+      - event: New data
+        target: Idle
+        guards:
+          - _unnamed
+        actions:
+          - store
+          - _unnamed
+`, doc)
+
+	// the placeholder is never resolved, even if registered
+	reg := hsm.Registry[struct{}]{
+		Actions: map[string]func(hsm.Event, struct{}){"store": nop, "_unnamed": nop},
+		Guards:  map[string]func(hsm.Event, struct{}) bool{"_unnamed": yes},
+	}
+	_, err := hsm.LoadYAML(strings.NewReader(doc), reg, map[string]int{"New data": evNewData})
+	assert.EqualError(t, err, `definition: state Idle exit: action with no name can not be resolved
+definition: state Idle transition: guard with no name can not be resolved
+definition: state Idle transition: action with no name can not be resolved`)
+}
+
+func TestLoadYAML(t *testing.T) {
+	const (
+		evSubmit = iota
+		evApprove
+		evReject
+	)
+	events := map[string]int{"submit": evSubmit, "approve": evApprove, "reject": evReject}
+	var log []string
+	notify := func(e hsm.Event, _ *int) { log = append(log, "notify") }
+	reg := hsm.Registry[*int]{
+		Actions: map[string]func(hsm.Event, *int){
+			"notify": notify,
+			"count":  func(_ hsm.Event, n *int) { *n++ },
+		},
+		Guards: map[string]func(hsm.Event, *int) bool{
+			"under limit": func(_ hsm.Event, n *int) bool { return *n < 2 },
+		},
+	}
+
+	doc := `
+states:
+  - name: Draft
+    initial: true
+    transitions:
+      - event: submit
+        target: Review
+        actions: [count]
+  - name: Review
+    entry: [notify]
+    transitions:
+      - event: approve
+        terminate: true
+      - event: reject
+        target: Draft
+        guards: [under limit]
+`
+	sm, err := hsm.LoadYAML(strings.NewReader(doc), reg, events)
+	assert.NoError(t, err)
+
+	smi := hsm.StateMachineInstance[*int]{SM: sm, Ext: new(int)}
+	smi.Initialize(hsm.Event{})
+	smi.Deliver(hsm.Event{Id: evSubmit})
+	smi.Deliver(hsm.Event{Id: evReject})
+	smi.Deliver(hsm.Event{Id: evSubmit})
+	assert.Equal(t, "Review", smi.Current().Name())
+	handled, _ := smi.Deliver(hsm.Event{Id: evReject})
+	assert.False(t, handled)
+	smi.Deliver(hsm.Event{Id: evApprove})
+	assert.Nil(t, smi.Current())
+	assert.Equal(t, []string{"notify", "notify"}, log)
+}
+
+func TestLoadDefinitionErrors(t *testing.T) {
+	doc := `{"states": [
+  {"name": "a", "initial": true, "entry": ["hello"], "transitions": [
+    {"event": "go", "target": "b", "guards": ["ready"]},
+    {"event": "stop", "target": "c"},
+    {"event": "stop"}
+  ]},
+  {"name": "b", "kind": "fork"}
+]}`
+	_, err := hsm.LoadJSON(strings.NewReader(doc), hsm.Registry[struct{}]{}, map[string]int{"stop": 0})
+	assert.EqualError(t, err, `definition: state a entry: unknown action "hello"
+definition: state b: unknown kind fork
+definition: state a: unknown target b
+definition: state a transition: unknown guard "ready"
+definition: state a: unknown event go
+definition: state a: unknown target c
+definition: state a: transition must have a target, or be internal or terminating`)
+
+	// problems with the structure are reported as well
+	doc = `
+states:
+  - name: a
+  - name: b
+`
+	_, err = hsm.LoadYAML(strings.NewReader(doc), hsm.Registry[struct{}]{}, nil)
+	var structureErrs hsm.StructureErrors
+	assert.ErrorAs(t, err, &structureErrs)
+
+	_, err = hsm.LoadYAML(strings.NewReader("states:\n  - name: a\n    color: red\n"), hsm.Registry[struct{}]{}, nil)
+	assert.ErrorContains(t, err, "field color not found")
+}
+
+func TestLoadDefinitionConflicts(t *testing.T) {
+	doc := `
+states:
+  - name: a
+    initial: true
+    transitions:
+      - event: stop
+        target: b
+        terminate: true
+      - event: stop
+        internal: true
+        terminate: true
+  - name: b
+    regions:
+      - name: r1
+        regions:
+          - name: r2
+            states:
+              - name: c
+                initial: true
+`
+	_, err := hsm.LoadYAML(strings.NewReader(doc), hsm.Registry[struct{}]{}, map[string]int{"stop": 0})
+	assert.EqualError(t, err, `definition: region r1 can only have a name and states
+definition: state a: terminating transition can not have a target, or be internal
+definition: state a: terminating transition can not have a target, or be internal`)
+}
@@ -10,15 +10,30 @@ type edge[E any] struct {
 	src, dst *State[E]
 }
 
-// DiagramBuilder allows minor customizations of PlantUML diagram layout before building the diagram.
+// DiagramBuilder allows minor customizations of PlantUML or Mermaid diagram layout before building the diagram.
 // To create a builder, use StateMachine.DiagramBuilder().
 type DiagramBuilder[E any] struct {
 	sm           *StateMachine[E]
 	evNameMapper func(int) string
 	defaultArrow string
 	arrows       map[edge[E]]string
+	labels       map[edge[E]]string
 }
 
+// diagramSyntax captures the differences between the supported diagram languages,
+// which otherwise share the same syntax for state diagrams.
+type diagramSyntax struct {
+	header, footer string
+	newline        string // separates multiple labels of the same arrow
+	arrows         bool   // whether arrow styles are supported
+	historyNodes   bool   // whether history targets must be declared as separate nodes
+}
+
+var (
+	pumlSyntax    = diagramSyntax{header: "@startuml\n\n", footer: "\n@enduml\n", newline: "\\n", arrows: true}
+	mermaidSyntax = diagramSyntax{header: "stateDiagram-v2\n", newline: "<br>", historyNodes: true}
+)
+
 // DefaultArrow changes the arrow style used for transitions. The default is "-->".
 func (db *DiagramBuilder[E]) DefaultArrow(arrow string) *DiagramBuilder[E] {
 	db.defaultArrow = arrow
@@ -26,17 +41,46 @@ func (db *DiagramBuilder[E]) DefaultArrow(arrow string) *DiagramBuilder[E] {
 }
 
 // Arrow specifies the arrow style used for all transitions from src to dst state.
+// Use nil dst for transitions terminating the state machine.
 // See here for available arrow styles: https://crashedmind.github.io/PlantUMLHitchhikersGuide/layout/layout.html
 func (db *DiagramBuilder[E]) Arrow(src, dst *State[E], arrow string) *DiagramBuilder[E] {
-	db.arrows[edge[E]{src, dst}] = arrow
+	db.arrows[db.edge(src, dst)] = arrow
+	return db
+}
+
+// edge returns the edge from src to dst, where nil dst stands for the terminal state.
+func (db *DiagramBuilder[E]) edge(src, dst *State[E]) edge[E] {
+	if dst == nil {
+		dst = &db.sm.terminal
+	}
+	return edge[E]{src, dst}
+}
+
+// Label replaces the labels of all transitions from src to dst state with the given label.
+// Use nil dst for transitions terminating the state machine.
+func (db *DiagramBuilder[E]) Label(src, dst *State[E], label string) *DiagramBuilder[E] {
+	db.labels[db.edge(src, dst)] = label
 	return db
 }
 
 // Build creates and returns PlantUML diagram as a string.
 func (db *DiagramBuilder[E]) Build() string {
+	return db.build(pumlSyntax)
+}
+
+// BuildMermaid creates and returns Mermaid (stateDiagram-v2) diagram as a string.
+// Mermaid supports only one arrow style, so the arrow styles specified by the builder are ignored.
+// Mermaid has no notation for history either, so history is drawn as a state named H (or H* for deep history)
+// within the composite state.
+func (db *DiagramBuilder[E]) BuildMermaid() string {
+	return db.build(mermaidSyntax)
+}
+
+// build creates the diagram using the given syntax.
+func (db *DiagramBuilder[E]) build(syntax diagramSyntax) string {
 	sm := db.sm
 	evNameMapper := db.evNameMapper
-	if !sm.top.validated {
+	if !sm.finalized {
 		panic("state machine not finalized")
 	}
 
@@ -45,6 +89,14 @@ func (db *DiagramBuilder[E]) Build() string {
 		dump          func(indent int, s *State[E])
 	)
 
+	// label returns transition label; completion transitions have no event, and so may be unlabeled
+	label := func(t *transition[E]) string {
+		if t.trigger != triggerEvent {
+			return strings.TrimSpace(t.String())
+		}
+		return evNameMapper(t.eventId) + t.String()
+	}
+
 	dump = func(indent int, s *State[E]) {
 		prefix := strings.Repeat("   ", indent)
 
@@ -53,8 +105,33 @@ func (db *DiagramBuilder[E]) Build() string {
 		} else {
 			fmt.Fprintf(&bld, "%sstate \"%s\" as %s", prefix, s.name, s.alias)
 		}
-		if !s.IsLeaf() {
+		if s.pseudo != pseudoNone {
+			// PlantUML has no notation for junctions, so both junctions and choices are drawn as choices
+			bld.WriteString(" <<choice>>")
+		}
+		if s.isOrthogonal() {
+			// regions are separated by "--"
+			bld.WriteString(" {\n")
+			for i, r := range s.children {
+				if i > 0 {
+					fmt.Fprintf(&bld, "%s   --\n", prefix)
+				}
+				for _, child := range r.children {
+					dump(indent+1, child)
+				}
+			}
+			bld.WriteString(prefix)
+			bld.WriteString("}")
+		} else if !s.IsLeaf() {
 			bld.WriteString(" {\n")
+			if syntax.historyNodes {
+				if s.history&HistoryShallow != 0 {
+					fmt.Fprintf(&bld, "%s   state \"H\" as %s_H\n", prefix, s.alias)
+				}
+				if s.history&HistoryDeep != 0 {
+					fmt.Fprintf(&bld, "%s   state \"H*\" as %s_Hx\n", prefix, s.alias)
+				}
+			}
 			for _, child := range s.children {
 				dump(indent+1, child)
 			}
@@ -68,6 +145,9 @@ func (db *DiagramBuilder[E]) Build() string {
 		if s.exit != nil {
 			fmt.Fprintf(&bld, "%s%s : exit / %s\n", prefix, s.alias, s.exitName)
 		}
+		for _, id := range s.deferred {
+			fmt.Fprintf(&bld, "%s%s : %s / defer\n", prefix, s.alias, evNameMapper(id))
+		}
 
 		if s.parent.initial == s {
 			fmt.Fprintf(&bld, "%s[*] --> %s\n", prefix, s.alias)
@@ -89,11 +169,17 @@ func (db *DiagramBuilder[E]) Build() string {
 			var hist string
 			if t.history == HistoryShallow {
 				hist = "[H]"
+				if syntax.historyNodes {
+					hist = "_H"
+				}
 			} else if t.history == HistoryDeep {
 				hist = "[H*]"
+				if syntax.historyNodes {
+					hist = "_Hx"
+				}
 			}
 			if t.internal {
-				fmt.Fprintf(&bld, "%s%s : %s%s\n", prefix, s.alias, evNameMapper(t.eventId), t)
+				fmt.Fprintf(&bld, "%s%s : %s\n", prefix, s.alias, label(t))
 				continue
 			}
 			var m *om.OrderedMap[edgeH, []string] // maps edgeH to label above edgeH
@@ -104,27 +190,42 @@ func (db *DiagramBuilder[E]) Build() string {
 			}
 			e := edgeH{src: s, dst: t.target, hist: hist}
 			labels, _ := m.Get(e)
-			m.Set(e, append(labels, evNameMapper(t.eventId)+t.String()))
+			m.Set(e, append(labels, label(t)))
 		}
 
 		arrow := func(src, dst *State[E]) string {
+			if !syntax.arrows {
+				return "-->"
+			}
 			if a, ok := db.arrows[edge[E]{src, dst}]; ok {
 				return a
 			}
 			return db.defaultArrow
 		}
+		joinLabels := func(src, dst *State[E], labels []string) string {
+			joined, ok := db.labels[edge[E]{src, dst}]
+			if !ok {
+				joined = strings.Join(labels, syntax.newline)
+			}
+			if joined == "" {
+				return ""
+			}
+			return " : " + joined
+		}
 
 		for pair := local.Oldest(); pair != nil; pair = pair.Next() {
 			e, labels := pair.Key, pair.Value
-			fmt.Fprintf(&bld, "%s%s %s %s%s : %s\n", prefix, e.src.alias, arrow(e.src, e.dst), e.dst.alias, e.hist, strings.Join(labels, "\\n"))
+			fmt.Fprintf(&bld, "%s%s %s %s%s%s\n", prefix, e.src.alias, arrow(e.src, e.dst), e.dst.alias, e.hist,
+				joinLabels(e.src, e.dst, labels))
 		}
 		for pair := normal.Oldest(); pair != nil; pair = pair.Next() {
 			e, labels := pair.Key, pair.Value
-			fmt.Fprintf(&bldTrans, "%s %s %s%s : %s\n", e.src.alias, arrow(e.src, e.dst), e.dst.alias, e.hist, strings.Join(labels, "\\n"))
+			fmt.Fprintf(&bldTrans, "%s %s %s%s%s\n", e.src.alias, arrow(e.src, e.dst), e.dst.alias, e.hist,
+				joinLabels(e.src, e.dst, labels))
 		}
 	}
 
-	bld.WriteString("@startuml\n\n")
+	bld.WriteString(syntax.header)
 	sm.terminal.alias = "[*]"
 	for _, s := range sm.top.children {
 		if s != &sm.terminal {
@@ -132,11 +233,11 @@ func (db *DiagramBuilder[E]) Build() string {
 		}
 	}
 	bld.WriteString(bldTrans.String())
-	bld.WriteString("\n@enduml\n")
+	bld.WriteString(syntax.footer)
 	return bld.String()
 }
 
-// DiagramBuilder creates builder for customizing PlantUML diagram before building it.
+// DiagramBuilder creates builder for customizing PlantUML or Mermaid diagram before building it.
 // evNameMapper provides mapping of event ids to event names.
 func (sm *StateMachine[E]) DiagramBuilder(evNameMapper func(int) string) *DiagramBuilder[E] {
 	return &DiagramBuilder[E]{
@@ -144,6 +245,7 @@ func (sm *StateMachine[E]) DiagramBuilder(evNameMapper func(int) string) *Diagra
 		evNameMapper: evNameMapper,
 		defaultArrow: "-->",
 		arrows:       make(map[edge[E]]string),
+		labels:       make(map[edge[E]]string),
 	}
 }
 
@@ -152,3 +254,9 @@ func (sm *StateMachine[E]) DiagramBuilder(evNameMapper func(int) string) *Diagra
 func (sm *StateMachine[E]) DiagramPUML(evNameMapper func(int) string) string {
 	return sm.DiagramBuilder(evNameMapper).Build()
 }
+
+// DiagramMermaid builds a Mermaid diagram of a finalized state machine.
+// This method is a shorthand for sm.DiagramBuilder(evNameMapper).BuildMermaid().
+func (sm *StateMachine[E]) DiagramMermaid(evNameMapper func(int) string) string {
+	return sm.DiagramBuilder(evNameMapper).BuildMermaid()
+}
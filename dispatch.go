@@ -0,0 +1,195 @@
+package hsm
+
+// candidate is a transition that may be taken in response to an event, along with its source state.
+// Candidate with nil transition marks the deferral of the event by the source state.
+// Candidates are selected as they are, with exits listing the states exited when the transition is taken,
+// from the leaf state owning the table up to the domain.
+type candidate[E any] struct {
+	selection[E]
+	direct bool // whether the transition leads from the leaf state alone to another single leaf state, see transit
+}
+
+// dispatchTable maps event ids to the candidate transitions, in the order in which they must be tried.
+// Small non-negative event ids are looked up in a slice, while any other ids are looked up in a map.
+type dispatchTable[E any] struct {
+	dense  [][]candidate[E]
+	sparse map[int][]candidate[E]
+}
+
+// maxDenseEventId limits the event ids looked up in the slice of a dispatch table.
+const maxDenseEventId = 256
+
+func (dt *dispatchTable[E]) lookup(eventId int) []candidate[E] {
+	if uint(eventId) < uint(len(dt.dense)) {
+		return dt.dense[eventId]
+	}
+	return dt.sparse[eventId]
+}
+
+func (dt *dispatchTable[E]) add(eventId int, c candidate[E]) {
+	if eventId < 0 || eventId >= maxDenseEventId {
+		if dt.sparse == nil {
+			dt.sparse = make(map[int][]candidate[E])
+		}
+		dt.sparse[eventId] = append(dt.sparse[eventId], c)
+		return
+	}
+	for len(dt.dense) <= eventId {
+		dt.dense = append(dt.dense, nil)
+	}
+	dt.dense[eventId] = append(dt.dense[eventId], c)
+}
+
+// compile compiles the dispatch table of every state, flattening the candidate transitions up the hierarchy,
+// and the paths of states entered by the transitions.
+// The states exited by a transition depend on the active configuration, so they're precomputed for each
+// leaf state and its candidate transitions, for configurations made of that leaf state alone.
+func (sm *StateMachine[E]) compile() {
+	sm.Walk(func(s *State[E]) {
+		if s.pseudo != pseudoNone {
+			return
+		}
+		// exits are only used for leaf states outside of orthogonal regions, which can be active alone
+		alone := s.IsLeaf()
+		for s1 := s; s1 != nil; s1 = s1.parent {
+			alone = alone && !s1.region
+		}
+		s.table = dispatchTable[E]{}
+		decided := make(map[int]bool) // events for which no further candidates can be taken
+		for src := s; src != nil; src = src.parent {
+			for _, t := range src.transitions {
+				if t.trigger != triggerEvent || decided[t.eventId] {
+					continue
+				}
+				c := candidate[E]{selection: selection[E]{src: src, t: t, domain: t.domain}}
+				if alone && !t.internal {
+					for s1 := s; s1 != t.domain; s1 = s1.parent {
+						c.exits = append(c.exits, s1)
+					}
+					c.direct = t.target.pseudo == pseudoNone && t.target != &sm.terminal
+					for s1 := t.target; c.direct && s1 != t.domain; s1 = s1.parent {
+						c.direct = s1 == t.target || !s1.isOrthogonal()
+					}
+				}
+				s.table.add(t.eventId, c)
+				if t.guard == nil && t.target.pseudo != pseudoJunction {
+					decided[t.eventId] = true
+				}
+			}
+			for _, id := range src.deferred {
+				if !decided[id] {
+					s.table.add(id, candidate[E]{selection: selection[E]{src: src}})
+					decided[id] = true
+				}
+			}
+		}
+	})
+
+	var recurse func(s *State[E])
+	recurse = func(s *State[E]) {
+		for _, t := range s.transitions {
+			if t.internal || t.target == &sm.terminal || t.target.pseudo != pseudoNone {
+				continue
+			}
+			t.path = nil
+			for s1 := t.target; s1 != t.domain; s1 = s1.parent {
+				t.path = append(t.path, s1)
+			}
+			for i, j := 0, len(t.path)-1; i < j; i, j = i+1, j-1 {
+				t.path[i], t.path[j] = t.path[j], t.path[i]
+			}
+		}
+		for _, s1 := range s.children {
+			recurse(s1)
+		}
+	}
+	recurse(&sm.top)
+}
+
+// dispatchTable delivers event e to the single active leaf state, looking up the transition in its dispatch table.
+func (smi *StateMachineInstance[E]) dispatchTable(e Event, leaf *State[E]) (handled bool, src *State[E]) {
+	cs := leaf.table.lookup(e.Id)
+	for i := range cs {
+		c := &cs[i]
+		if c.t == nil {
+			smi.deferred = append(smi.deferred, e)
+			return true, c.src
+		}
+		if c.t.guard != nil && !smi.guard(e, c.src, c.t) {
+			continue
+		}
+		if c.direct && smi.tracer == nil {
+			smi.transit(e, c)
+		} else if sel := &c.selection; c.t.target.pseudo != pseudoJunction {
+			smi.fire(e, sel)
+		} else {
+			segs, ok := smi.followJunction(e, c.t.target, nil)
+			if !ok {
+				continue
+			}
+			compound := newSelection(c.src, c.t, segs)
+			smi.fire(e, &compound)
+		}
+		if len(smi.entered) > 0 {
+			smi.complete(e)
+		}
+		if smi.changed && len(smi.deferred) > 0 {
+			smi.recall()
+		}
+		return true, c.src
+	}
+	return
+}
+
+// transit takes the direct transition of candidate c from the single active leaf state, like fire does,
+// but following the current state up and down the precomputed paths, without keeping track of the regions.
+// It's the fast path for most transitions, so exit is written out in full, without tracing.
+func (smi *StateMachineInstance[E]) transit(e Event, c *candidate[E]) {
+	smi.changed = true
+	for _, s := range c.exits {
+		smi.user = true
+		if s.exitPlain != nil {
+			s.exitPlain(e, smi.Ext)
+		} else if s.exit != nil {
+			s.exit(smi.ctx(), e, smi.Ext)
+		}
+		smi.user = false
+		if len(s.timers) > 0 {
+			smi.disarm(s)
+		}
+		if p := s.parent; p.recordHistory {
+			smi.record(p, s)
+		}
+		smi.active[0] = s.parent
+	}
+	smi.action(e, c.src, c.t)
+	smi.enterDirect(e, c.domain, c.t.path, c.t.history)
+}
+
+// dispatchScan delivers event e to the single active leaf state, scanning the transitions of the leaf
+// and its super-states. It's only used to benchmark dispatch tables against.
+func (smi *StateMachineInstance[E]) dispatchScan(e Event, leaf *State[E]) (handled bool, src *State[E]) {
+	for src = leaf; src != nil; src = src.parent {
+		for _, t := range src.transitions {
+			if t.eventId == e.Id && t.trigger == triggerEvent && smi.guard(e, src, t) {
+				sel := selection[E]{src: src, t: t, domain: t.domain}
+				if t.target.pseudo == pseudoJunction {
+					segs, ok := smi.followJunction(e, t.target, nil)
+					if !ok {
+						continue
+					}
+					sel = newSelection(src, t, segs)
+				}
+				smi.fire(e, &sel)
+				smi.complete(e)
+				smi.recall()
+				return true, src
+			}
+		}
+		if src.defers(e.Id) {
+			smi.deferred = append(smi.deferred, e)
+			return true, src
+		}
+	}
+	return false, nil
+}
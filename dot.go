@@ -0,0 +1,236 @@
+package hsm
+
+import (
+	"fmt"
+	om "github.com/wk8/go-ordered-map/v2"
+	"strings"
+)
+
+// DotBuilder allows customizing the layout of a Graphviz (DOT) diagram before building the diagram.
+// To create a builder, use StateMachine.DotBuilder().
+type DotBuilder[E any] struct {
+	sm           *StateMachine[E]
+	evNameMapper func(int) string
+	direction    string
+	ranks        [][]*State[E]
+	attrs        map[edge[E]]string
+}
+
+// DotBuilder creates builder for customizing Graphviz (DOT) diagram before building it.
+// evNameMapper provides mapping of event ids to event names.
+func (sm *StateMachine[E]) DotBuilder(evNameMapper func(int) string) *DotBuilder[E] {
+	return &DotBuilder[E]{
+		sm:           sm,
+		evNameMapper: evNameMapper,
+		attrs:        make(map[edge[E]]string),
+	}
+}
+
+// DiagramDOT builds a Graphviz (DOT) diagram of a finalized state machine.
+// This method is a shorthand for sm.DotBuilder(evNameMapper).Build().
+func (sm *StateMachine[E]) DiagramDOT(evNameMapper func(int) string) string {
+	return sm.DotBuilder(evNameMapper).Build()
+}
+
+// Direction sets the direction in which the graph is laid out: "TB" (the default), "LR", "BT" or "RL".
+func (db *DotBuilder[E]) Direction(dir string) *DotBuilder[E] {
+	db.direction = dir
+	return db
+}
+
+// SameRank asks for the given states to be placed on the same rank, e.g. on the same row for "TB" direction.
+// Graphviz honors the hint only for states nested within the same composite state.
+func (db *DotBuilder[E]) SameRank(states ...*State[E]) *DotBuilder[E] {
+	db.ranks = append(db.ranks, states)
+	return db
+}
+
+// EdgeAttrs specifies additional Graphviz attributes for the edge drawn for transitions from src to dst state,
+// e.g. "constraint=false" or "weight=10, color=red".
+// Use nil dst for transitions terminating the state machine.
+func (db *DotBuilder[E]) EdgeAttrs(src, dst *State[E], attrs string) *DotBuilder[E] {
+	if dst == nil {
+		dst = &db.sm.terminal
+	}
+	db.attrs[edge[E]{src, dst}] = attrs
+	return db
+}
+
+// Build creates and returns Graphviz (DOT) diagram as a string.
+// Composite states and orthogonal regions are drawn as clusters.
+// Since Graphviz can only connect nodes, each composite state has an invisible node inside its cluster,
+// where the transitions into and out of the composite state are clipped at the cluster boundary.
+func (db *DotBuilder[E]) Build() string {
+	sm := db.sm
+	evNameMapper := db.evNameMapper
+	if !sm.finalized {
+		panic("state machine not finalized")
+	}
+
+	var bld, bldTrans strings.Builder
+
+	// node returns the id of the node representing the state
+	node := func(s *State[E]) string {
+		if s == &sm.terminal {
+			return dotQuote("[*]final")
+		}
+		return dotQuote(s.Path())
+	}
+	cluster := func(s *State[E]) string {
+		return fmt.Sprintf("cluster_%d", s.order)
+	}
+	// lhead clips the edge entering the composite state dst at the boundary of its cluster,
+	// unless the edge leads from src within dst
+	lhead := func(dst, src *State[E]) []string {
+		if dst.IsLeaf() || dst == &sm.terminal || src != nil && isAncestor(dst, src) {
+			return nil
+		}
+		return []string{"lhead=" + cluster(dst)}
+	}
+	label := func(t *transition[E]) string {
+		if t.trigger != triggerEvent {
+			return strings.TrimSpace(t.String())
+		}
+		return evNameMapper(t.eventId) + t.String()
+	}
+	// lines returns the lines of the state label: its name, followed by entry/exit actions,
+	// internal transitions and deferred events
+	lines := func(s *State[E]) string {
+		ll := []string{s.name}
+		if s.entry != nil {
+			ll = append(ll, "entry / "+s.entryName)
+		}
+		if s.exit != nil {
+			ll = append(ll, "exit / "+s.exitName)
+		}
+		for _, t := range s.transitions {
+			if t.internal {
+				ll = append(ll, label(t))
+			}
+		}
+		for _, id := range s.deferred {
+			ll = append(ll, evNameMapper(id)+" / defer")
+		}
+		return dotQuote(strings.Join(ll, "\n"))
+	}
+
+	type edgeH struct { // edge in statechart, with src, dst, and history type
+		src, dst *State[E]
+		hist     History
+	}
+	edges := om.New[edgeH, []string]()
+
+	var dump func(indent int, s *State[E])
+	dump = func(indent int, s *State[E]) {
+		prefix := strings.Repeat("  ", indent)
+		switch {
+		case s.pseudo == pseudoChoice:
+			fmt.Fprintf(&bld, "%s%s [shape=diamond, label=%s];\n", prefix, node(s), dotQuote(s.name))
+		case s.pseudo == pseudoJunction:
+			fmt.Fprintf(&bld, "%s%s [shape=circle, style=filled, fillcolor=black, width=0.15, label=\"\", xlabel=%s];\n",
+				prefix, node(s), dotQuote(s.name))
+		case s.IsLeaf() && !s.region:
+			fmt.Fprintf(&bld, "%s%s [label=%s];\n", prefix, node(s), lines(s))
+		default:
+			fmt.Fprintf(&bld, "%ssubgraph %s {\n", prefix, cluster(s))
+			fmt.Fprintf(&bld, "%s  label=%s;\n", prefix, lines(s))
+			if s.region {
+				fmt.Fprintf(&bld, "%s  style=dashed;\n", prefix)
+			}
+			fmt.Fprintf(&bld, "%s  %s [shape=point, style=invis];\n", prefix, node(s))
+			if s.history&HistoryShallow != 0 {
+				fmt.Fprintf(&bld, "%s  %s [shape=circle, label=\"H\"];\n", prefix, dotQuote(s.Path()+"/[H]"))
+			}
+			if s.history&HistoryDeep != 0 {
+				fmt.Fprintf(&bld, "%s  %s [shape=circle, label=\"H*\"];\n", prefix, dotQuote(s.Path()+"/[H*]"))
+			}
+			if s.initial != nil {
+				initial := dotQuote(s.Path() + "/[*]")
+				fmt.Fprintf(&bld, "%s  %s [shape=point];\n", prefix, initial)
+				fmt.Fprintf(&bld, "%s  %s -> %s%s;\n", prefix, initial, node(s.initial), attrList(lhead(s.initial, nil)))
+			}
+			for _, child := range s.children {
+				dump(indent+1, child)
+			}
+			fmt.Fprintf(&bld, "%s}\n", prefix)
+		}
+
+		// combine multiple edges connecting same src and dst into one, by putting together labels
+		for _, t := range s.transitions {
+			if t.internal {
+				continue
+			}
+			e := edgeH{src: s, dst: t.target, hist: t.history}
+			labels, _ := edges.Get(e)
+			edges.Set(e, append(labels, label(t)))
+		}
+	}
+
+	for _, s := range sm.top.children {
+		dump(1, s)
+	}
+
+	terminal := false
+	for pair := edges.Oldest(); pair != nil; pair = pair.Next() {
+		e, labels := pair.Key, pair.Value
+		terminal = terminal || e.dst == &sm.terminal
+		var attrs []string
+		dst := node(e.dst)
+		switch e.hist {
+		case HistoryShallow:
+			dst = dotQuote(e.dst.Path() + "/[H]")
+		case HistoryDeep:
+			dst = dotQuote(e.dst.Path() + "/[H*]")
+		default:
+			attrs = append(attrs, lhead(e.dst, e.src)...)
+		}
+		// clip the edge leaving the composite state at the boundary of its cluster, unless it leads within
+		if !e.src.IsLeaf() && !isAncestor(e.src, e.dst) {
+			attrs = append(attrs, "ltail="+cluster(e.src))
+		}
+		attrs = append(attrs, "label="+dotQuote(strings.Join(labels, "\n")))
+		if a, ok := db.attrs[edge[E]{e.src, e.dst}]; ok {
+			attrs = append(attrs, a)
+		}
+		fmt.Fprintf(&bldTrans, "  %s -> %s%s;\n", node(e.src), dst, attrList(attrs))
+	}
+
+	var out strings.Builder
+	out.WriteString("digraph {\n  compound=true;\n")
+	if db.direction != "" {
+		fmt.Fprintf(&out, "  rankdir=%s;\n", db.direction)
+	}
+	out.WriteString("  node [shape=box, style=rounded];\n")
+	out.WriteString("  \"[*]\" [shape=point];\n")
+	fmt.Fprintf(&out, "  \"[*]\" -> %s%s;\n", node(sm.top.initial), attrList(lhead(sm.top.initial, nil)))
+	out.WriteString(bld.String())
+	if terminal {
+		fmt.Fprintf(&out, "  %s [shape=doublecircle, label=\"\", width=0.2];\n", node(&sm.terminal))
+	}
+	out.WriteString(bldTrans.String())
+	for _, rank := range db.ranks {
+		out.WriteString("  {rank=same;")
+		for _, s := range rank {
+			fmt.Fprintf(&out, " %s;", node(s))
+		}
+		out.WriteString("}\n")
+	}
+	out.WriteString("}\n")
+	return out.String()
+}
+
+// attrList formats the list of DOT attributes.
+func attrList(attrs []string) string {
+	if len(attrs) == 0 {
+		return ""
+	}
+	return " [" + strings.Join(attrs, ", ") + "]"
+}
+
+// dotQuote returns s as a quoted DOT string.
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	return `"` + s + `"`
+}
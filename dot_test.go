@@ -0,0 +1,63 @@
+package hsm_test
+
+import (
+	"github.com/dragomit/hsm"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDiagramDOT(t *testing.T) {
+	sm := hsm.StateMachine[struct{}]{}
+	nop := func(hsm.Event, struct{}) {}
+
+	state1 := sm.State("State1").Initial().Build()
+	state2 := sm.State("State2").Entry("start", nop).Build()
+	state3 := sm.State("State3").Build()
+	accEnoughData := state3.State("Accumulate enough data").Initial().Build()
+	accEnoughData.Transition(evNewData, accEnoughData).Internal().Action("store", nop).Build()
+	processData := state3.State("Process data").Build()
+	accEnoughData.AddTransition(evEnoughData, processData)
+
+	state3.AddTransition(evPause, state2)
+	state2.AddTransition(evSucceeded, state3)
+	state2.Transition(evResume, state3).History(hsm.HistoryShallow).Build()
+	state1.AddTransition(evSucceeded, state2)
+	state3.Transition(evSucceeded, nil).Action("Save Result", nop).Build()
+	sm.Finalize()
+
+	names := []string{"New data", "Enough data", "Pause", "Succeeded", "Failed", "Resume", "Deep resume", "Aborted"}
+	diagram := sm.DotBuilder(func(ev int) string { return names[ev] }).
+		Direction("LR").
+		SameRank(state1, state2).
+		EdgeAttrs(state3, state2, "constraint=false").
+		Build()
+
+	wantsDiagram := `digraph {
+  compound=true;
+  rankdir=LR;
+  node [shape=box, style=rounded];
+  "[*]" [shape=point];
+  "[*]" -> "State1";
+  "State1" [label="State1"];
+  "State2" [label="State2\nentry / start"];
+  subgraph cluster_3 {
+    label="State3";
+    "State3" [shape=point, style=invis];
+    "State3/[H]" [shape=circle, label="H"];
+    "State3/[*]" [shape=point];
+    "State3/[*]" -> "State3/Accumulate enough data";
+    "State3/Accumulate enough data" [label="Accumulate enough data\nNew data / store"];
+    "State3/Process data" [label="Process data"];
+  }
+  "[*]final" [shape=doublecircle, label="", width=0.2];
+  "State1" -> "State2" [label="Succeeded"];
+  "State2" -> "State3" [lhead=cluster_3, label="Succeeded"];
+  "State2" -> "State3/[H]" [label="Resume"];
+  "State3/Accumulate enough data" -> "State3/Process data" [label="Enough data"];
+  "State3" -> "State2" [ltail=cluster_3, label="Pause", constraint=false];
+  "State3" -> "[*]final" [ltail=cluster_3, label="Succeeded / Save Result"];
+  {rank=same; "State1"; "State2";}
+}
+`
+	assert.Equal(t, wantsDiagram, diagram)
+}
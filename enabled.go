@@ -0,0 +1,102 @@
+package hsm
+
+// EnabledTransition describes a transition that would be taken if an event was delivered to the instance.
+// Target is nil for transitions terminating the state machine, and may be a choice or junction pseudostate.
+// Guarded is true for transitions whose guards were not evaluated, which may or may not be taken.
+type EnabledTransition[E any] struct {
+	EventId int
+	Source  *State[E]
+	Target  *State[E]
+	Guarded bool
+}
+
+// EnabledEvents returns the transitions that would be taken if an event was delivered to the instance,
+// searching from each active leaf state up, the same way as event delivery does.
+// Only events that trigger a transition are included, while deferred or ignored events are not.
+//
+// If evalGuards is true, guards are evaluated, and only the transitions that would be taken are returned,
+// at most one per event and active region. Since there's no actual event, guards receive events with no Data.
+// If evalGuards is false, guards are not evaluated, and all the transitions that might be taken are returned,
+// with the guarded ones (including transitions into junctions) marked as such.
+// Guards must be free of side effects for the result to be meaningful.
+// The transitions are listed in order of the search, and the instance is not affected in any way.
+// EnabledEvents must not be called while the instance is processing an event.
+func (smi *StateMachineInstance[E]) EnabledEvents(evalGuards bool) []EnabledTransition[E] {
+	var result []EnabledTransition[E]
+	var visited []*State[E]
+	smi.peeking = true
+	defer func() { smi.peeking = false }()
+	for _, leaf := range smi.active {
+		decided := make(map[int]bool) // events whose search from this leaf is over
+	search:
+		for src := leaf; src != nil; src = src.parent {
+			for _, v := range visited {
+				if v == src {
+					break search // this state and its ancestors have already been searched
+				}
+			}
+			visited = append(visited, src)
+			for _, t := range src.transitions {
+				if t.trigger != triggerEvent || decided[t.eventId] {
+					continue
+				}
+				guarded := t.guard != nil || t.target.pseudo == pseudoJunction
+				if evalGuards {
+					if !smi.peek(Event{Id: t.eventId}, t) {
+						continue
+					}
+					guarded = false
+				}
+				et := EnabledTransition[E]{EventId: t.eventId, Source: src, Target: t.target, Guarded: guarded}
+				if t.target == &smi.SM.terminal {
+					et.Target = nil
+				}
+				result = append(result, et)
+				decided[t.eventId] = !guarded
+			}
+			for _, id := range src.deferred {
+				decided[id] = true
+			}
+		}
+	}
+	return result
+}
+
+// CanHandle returns whether delivering event e to the instance would cause a transition to be taken,
+// evaluating the guards, but without affecting the instance in any way.
+// Deferred events are not considered handled, since they don't cause a transition until recalled.
+// Guards must be free of side effects for the result to be meaningful.
+// CanHandle must not be called while the instance is processing an event.
+func (smi *StateMachineInstance[E]) CanHandle(e Event) bool {
+	smi.peeking = true
+	defer func() { smi.peeking = false }()
+	for _, leaf := range smi.active {
+		for src := leaf; src != nil; src = src.parent {
+			for _, t := range src.transitions {
+				if t.trigger == triggerEvent && t.eventId == e.Id && smi.peek(e, t) {
+					return true
+				}
+			}
+			if src.defers(e.Id) {
+				break
+			}
+		}
+	}
+	return false
+}
+
+// peek returns whether transition t is enabled by event e, like enabled(), but without tracing the guards.
+func (smi *StateMachineInstance[E]) peek(e Event, t *transition[E]) bool {
+	if t.guard != nil && !t.guard(smi.ctx(), e, smi.Ext) {
+		return false
+	}
+	if t.target.pseudo != pseudoJunction {
+		return true
+	}
+	for _, b := range t.target.transitions {
+		if smi.peek(e, b) {
+			return true
+		}
+	}
+	return false
+}
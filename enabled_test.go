@@ -0,0 +1,80 @@
+package hsm_test
+
+import (
+	"github.com/dragomit/hsm"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestEnabledEvents(t *testing.T) {
+	const (
+		evPlay = iota
+		evPause
+		evStop
+		evEject
+		evSeek
+	)
+	type player struct{ hasDisc, seekable bool }
+	hasDisc := func(_ hsm.Event, p *player) bool { return p.hasDisc }
+	seekable := func(_ hsm.Event, p *player) bool { return p.seekable }
+
+	sm := hsm.StateMachine[*player]{}
+	stopped := sm.State("Stopped").Initial().Build()
+	active := sm.State("Active").Build()
+	playing := active.State("Playing").Initial().Defer(evEject).Build()
+	paused := active.State("Paused").Build()
+	j := active.Junction("j")
+
+	stopped.Transition(evPlay, active).Guard("has disc", hasDisc).Build()
+	stopped.AddTransition(evEject, nil)
+	playing.AddTransition(evPause, paused)
+	playing.AddTransition(evSeek, j)
+	j.Completion(playing).Guard("seekable", seekable).Build()
+	paused.AddTransition(evPlay, playing)
+	active.AddTransition(evStop, stopped)
+	active.AddTransition(evEject, stopped)
+	sm.Finalize()
+
+	p := &player{}
+	smi := hsm.StateMachineInstance[*player]{SM: &sm, Ext: p}
+	assert.Empty(t, smi.EnabledEvents(true))
+	smi.Initialize(hsm.Event{})
+
+	assert.Equal(t, []hsm.EnabledTransition[*player]{
+		{EventId: evEject, Source: stopped, Target: nil},
+	}, smi.EnabledEvents(true))
+	assert.Equal(t, []hsm.EnabledTransition[*player]{
+		{EventId: evPlay, Source: stopped, Target: active, Guarded: true},
+		{EventId: evEject, Source: stopped, Target: nil},
+	}, smi.EnabledEvents(false))
+	assert.False(t, smi.CanHandle(hsm.Event{Id: evPlay}))
+
+	p.hasDisc = true
+	assert.True(t, smi.CanHandle(hsm.Event{Id: evPlay}))
+	smi.Deliver(hsm.Event{Id: evPlay})
+
+	// eject is deferred in Playing, so Active's transition doesn't count;
+	// seek goes through the junction, and is only enabled if the disc is seekable
+	assert.Equal(t, []hsm.EnabledTransition[*player]{
+		{EventId: evPause, Source: playing, Target: paused},
+		{EventId: evStop, Source: active, Target: stopped},
+	}, smi.EnabledEvents(true))
+	assert.Equal(t, []hsm.EnabledTransition[*player]{
+		{EventId: evPause, Source: playing, Target: paused},
+		{EventId: evSeek, Source: playing, Target: j, Guarded: true},
+		{EventId: evStop, Source: active, Target: stopped},
+	}, smi.EnabledEvents(false))
+	assert.False(t, smi.CanHandle(hsm.Event{Id: evEject}))
+	assert.False(t, smi.CanHandle(hsm.Event{Id: evSeek}))
+	p.seekable = true
+	assert.True(t, smi.CanHandle(hsm.Event{Id: evSeek}))
+
+	smi.Deliver(hsm.Event{Id: evPause})
+	assert.True(t, smi.CanHandle(hsm.Event{Id: evEject}))
+	assert.Equal(t, []hsm.EnabledTransition[*player]{
+		{EventId: evPlay, Source: paused, Target: playing},
+		{EventId: evStop, Source: active, Target: stopped},
+		{EventId: evEject, Source: active, Target: stopped},
+	}, smi.EnabledEvents(true))
+	assert.Equal(t, paused, smi.Current())
+}
@@ -0,0 +1,101 @@
+package hsm
+
+import (
+	"strings"
+)
+
+// ErrorKind classifies the problems with the state machine structure.
+type ErrorKind int
+
+const (
+	KindMissingInitial     ErrorKind = iota // composite state or region has no initial sub-state
+	KindDuplicateInitial                    // more than one sub-state is marked initial
+	KindUnusedBuilder                       // state or transition builder was never built
+	KindReusedBuilder                       // state or transition builder was built more than once
+	KindInvalidLocal                        // local transition between states not contained in one another
+	KindInvalidInternal                     // internal transition that's not a self-transition
+	KindInvalidRegion                       // misuse of orthogonal regions
+	KindInvalidPseudostate                  // misuse of choice or junction pseudostates
+	KindJunctionCycle                       // junction branches forming a cycle
+	KindShadowed                            // transition shadowed by an earlier unguarded transition; see Lint
+	KindDuplicate                           // transition identical to an earlier one; see Lint
+	KindOverridden                          // transition of a composite state overridden by all its sub-states; see Lint
+	KindInvalidErrorState                   // error state that's a pseudostate, a region, or belongs to another state machine
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case KindMissingInitial:
+		return "missing initial"
+	case KindDuplicateInitial:
+		return "duplicate initial"
+	case KindUnusedBuilder:
+		return "unused builder"
+	case KindReusedBuilder:
+		return "reused builder"
+	case KindInvalidLocal:
+		return "invalid local transition"
+	case KindInvalidInternal:
+		return "invalid internal transition"
+	case KindInvalidRegion:
+		return "invalid region"
+	case KindInvalidPseudostate:
+		return "invalid pseudostate"
+	case KindJunctionCycle:
+		return "junction cycle"
+	case KindShadowed:
+		return "shadowed transition"
+	case KindDuplicate:
+		return "duplicate transition"
+	case KindOverridden:
+		return "overridden transition"
+	case KindInvalidErrorState:
+		return "invalid error state"
+	}
+	return "unknown"
+}
+
+// StructureError describes a single problem with the state machine structure.
+// State is the name of the state where the problem was found.
+// For problems with transitions, State is the source, and Target is the target state of the transition.
+// Msg is the same message that Finalize panics with.
+type StructureError struct {
+	Kind   ErrorKind
+	State  string
+	Target string
+	Msg    string
+}
+
+func (e *StructureError) Error() string {
+	return e.Msg
+}
+
+// StructureErrors lists all the problems found with the state machine structure.
+// It is returned by [StateMachine.FinalizeE], and can be examined using errors.As.
+type StructureErrors []*StructureError
+
+func (errs StructureErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Msg
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Unwrap returns the individual errors, for use by errors.Is and errors.As.
+func (errs StructureErrors) Unwrap() []error {
+	result := make([]error, len(errs))
+	for i, err := range errs {
+		result[i] = err
+	}
+	return result
+}
+
+// fail reports a problem found while building the state machine structure.
+// Unless the errors are being collected (see [StateMachine.CollectErrors]), fail panics right away.
+func (sm *StateMachine[E]) fail(err *StructureError) {
+	if !sm.CollectErrors {
+		panic(err.Msg)
+	}
+	sm.errs = append(sm.errs, err)
+}
@@ -0,0 +1,88 @@
+package hsm_test
+
+import (
+	"errors"
+	"github.com/dragomit/hsm"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestFinalizeE(t *testing.T) {
+	sm := hsm.StateMachine[struct{}]{CollectErrors: true}
+	foo := sm.State("foo").Initial().Build()
+	bar := sm.State("bar").Initial().Build()
+	baz := foo.State("baz").Build()
+	sm.State("forgotten")
+	foo.Transition(0, bar).Internal().Build()
+	bar.Transition(1, baz).Local(true).Build()
+	bar.Transition(2, foo)
+
+	err := sm.FinalizeE()
+	var errs hsm.StructureErrors
+	assert.True(t, errors.As(err, &errs))
+	assert.Equal(t, hsm.StructureErrors{
+		{Kind: hsm.KindDuplicateInitial, State: "bar", Msg: "sub-states bar and foo can not both be marked initial"},
+		{Kind: hsm.KindInvalidInternal, State: "foo", Target: "bar", Msg: "Transition foo -> bar can not be internal"},
+		{Kind: hsm.KindInvalidLocal, State: "bar", Target: "baz", Msg: "Transition bar -> baz can not be local"},
+		{Kind: hsm.KindUnusedBuilder, State: "forgotten",
+			Msg: "state forgotten builder left unused. Forgotten call to Build()?"},
+		{Kind: hsm.KindUnusedBuilder, State: "bar", Target: "foo",
+			Msg: "transition builder for event 2, bar --> foo left unused. Forgotten call to Build()?"},
+		{Kind: hsm.KindMissingInitial, State: "foo", Msg: "state foo must have initial sub-state"},
+	}, errs)
+
+	var se *hsm.StructureError
+	assert.True(t, errors.As(err, &se))
+	assert.Equal(t, hsm.KindDuplicateInitial, se.Kind)
+	assert.Len(t, sm.Validate(), len(errs))
+
+	// state machine was not finalized
+	smi := hsm.StateMachineInstance[struct{}]{SM: &sm}
+	assert.PanicsWithValue(t, "state machine not finalized", func() { smi.Initialize(hsm.Event{}) })
+}
+
+func TestFinalizeEWithoutCollecting(t *testing.T) {
+	sm := hsm.StateMachine[struct{}]{}
+	foo := sm.State("foo").Build()
+	foo.State("bar").Build()
+	r := sm.State("r").Build()
+	r.Region("r1").State("x").Build()
+	c := sm.Choice("c")
+
+	// structural errors are still found at finalization time
+	errs := sm.Validate()
+	assert.Equal(t, []string{
+		"state machine must have initial sub-state",
+		"choice c must have at least one outgoing branch",
+	}, messages(errs))
+
+	sm.State("baz").Initial().Build()
+	foo.AddTransition(0, r)
+	c.Completion(foo).Build()
+	assert.Equal(t, []string{
+		"region r1 of state r must have initial sub-state",
+		"state foo must have initial sub-state",
+	}, messages(sm.Validate()))
+	assert.Error(t, sm.FinalizeE())
+	assert.PanicsWithValue(t, "region r1 of state r must have initial sub-state", sm.Finalize)
+}
+
+func TestFinalizeEValid(t *testing.T) {
+	sm := hsm.StateMachine[struct{}]{CollectErrors: true}
+	foo := sm.State("foo").Initial().Build()
+	foo.AddTransition(0, nil)
+	assert.Empty(t, sm.Validate())
+	assert.NoError(t, sm.FinalizeE())
+
+	smi := hsm.StateMachineInstance[struct{}]{SM: &sm}
+	smi.Initialize(hsm.Event{})
+	assert.Equal(t, foo, smi.Current())
+}
+
+func messages(errs []error) []string {
+	var msgs []string
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return msgs
+}
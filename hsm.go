@@ -2,6 +2,7 @@ package hsm
 
 import (
 	"fmt"
+	"unsafe"
 )
 
 type History int
@@ -22,10 +23,18 @@ const (
 type StateMachine[E any] struct {
 	top                State[E]
 	terminal           State[E]
-	LocalDefault       bool    // default for whether transitions should be local
-	history            History // types of history transitions used
+	LocalDefault       bool      // default for whether transitions should be local
+	CollectErrors      bool      // collect problems found while building, rather than panicking; see FinalizeE
+	Strict             bool      // report the problems found by Lint as errors when finalizing
+	ErrorState         *State[E] // state entered after an action fails, rather than rolling back; see DeliverE
+	Tracer             Tracer[E] // default tracer for the instances
+	history            History   // types of history transitions used
+	completions        bool      // whether any completion transitions are used
 	stateBuilders      []*StateBuilder[E]
 	transitionBuilders []*TransitionBuilder[E]
+	errs               StructureErrors // problems found while building, when collecting errors
+	finalized          bool
+	scan               bool // dispatch events by scanning the transitions, rather than using the dispatch tables
 }
 
 // StateMachineInstance is an instance of a particular StateMachine.
@@ -37,13 +46,64 @@ type StateMachine[E any] struct {
 // Before using an instance,
 // you must set the SM field to assign the instance to a finalized StateMachine.
 // Prior to delivering any events to the instance, you must Initialize() it.
+// An initialized instance must not be copied.
 type StateMachineInstance[E any] struct {
-	SM             *StateMachine[E]
-	Ext            E
-	current        *State[E]
-	historyShallow map[*State[E]]*State[E]
-	historyDeep    map[*State[E]]*State[E]
-	initialized    bool
+	SM          *StateMachine[E]
+	Ext         E
+	Clock       Clock        // source of time for time events; SystemClock if nil
+	Tracer      Tracer[E]    // if nil, Tracer of the state machine is used
+	active      []*State[E]  // active configuration: one leaf per active region, in document order
+	activeBuf   [4]*State[E] // initial storage for active, avoiding an allocation per instance
+	history     map[*State[E]]*State[E]
+	visited     []*State[E]
+	selected    []selection[E]
+	entered     []*State[E] // states entered during the current step, candidates for completion transitions
+	queue       eventQueue  // events posted by actions
+	urgent      eventQueue  // priority lane for events posted by actions
+	deferred    []Event     // events deferred by active states
+	recalled    eventQueue  // deferred events to be re-delivered, after a change of state
+	deferring   *State[E]   // state which deferred the event being dispatched
+	changed     bool        // whether active configuration changed while dispatching the event
+	timers      []armedTimer[E]
+	timerSeq    uint64
+	initialized bool
+	dispatching bool
+	peeking     bool          // whether guards are evaluated by EnabledEvents or CanHandle, rather than by dispatching
+	user        bool          // whether an action or a guard is executing, so that DeliverE can recover from its panic
+	context     Context[E]    // passed into actions and guards
+	tracer      Tracer[E]     // tracer in use while dispatching
+	saved       checkpoint[E] // state of the instance before the event delivered by DeliverE
+}
+
+// maxCompletionSteps limits the number of completion transitions taken in a row,
+// protecting against infinite loops.
+const maxCompletionSteps = 100
+
+// selection is a transition selected to fire in response to an event, along with its source state.
+type selection[E any] struct {
+	src    *State[E]
+	t      *transition[E]
+	segs   []*transition[E] // junction branches following t, forming a compound transition
+	domain *State[E]        // domain of the compound transition
+	exits  []*State[E]      // states to exit, if precomputed for the single active leaf state, see compile
+}
+
+// newSelection creates selection for transition t defined in state src, followed by junction branches segs.
+func newSelection[E any](src *State[E], t *transition[E], segs []*transition[E]) selection[E] {
+	sel := selection[E]{src: src, t: t, segs: segs, domain: t.domain}
+	for _, b := range segs {
+		sel.domain = higher(sel.domain, b.domain)
+	}
+	return sel
+}
+
+// higher returns the one of the two states that is higher in the hierarchy.
+// The states must lie on the same path up the hierarchy (one must contain the other).
+func higher[E any](s1, s2 *State[E]) *State[E] {
+	if isAncestor(s2, s1) {
+		return s2
+	}
+	return s1
 }
 
 // State starts a builder for a top-level state in a state machine.
@@ -55,212 +115,841 @@ func (sm *StateMachine[E]) State(name string) *StateBuilder[E] {
 	return sm.top.State(name)
 }
 
+// Choice creates a top-level choice pseudostate. See [State.Choice] for details.
+func (sm *StateMachine[E]) Choice(name string) *State[E] {
+	sm.top.sm = sm
+	sm.top.name = "machine"
+	return sm.top.Choice(name)
+}
+
+// Junction creates a top-level junction pseudostate. See [State.Junction] for details.
+func (sm *StateMachine[E]) Junction(name string) *State[E] {
+	sm.top.sm = sm
+	sm.top.name = "machine"
+	return sm.top.Junction(name)
+}
+
 // Finalize validates and finalizes the state machine structure.
 // Finalize must be called before any state machine instances are initialized,
 // and state machine structure must not be modified after this method is called.
+// Finalize panics if there are any problems with the structure;
+// use [StateMachine.FinalizeE] to get the errors instead.
 func (sm *StateMachine[E]) Finalize() {
+	if errs := sm.check(); len(errs) > 0 {
+		panic(errs[0].Msg)
+	}
+	sm.finalize()
+}
+
+// FinalizeE is like Finalize, but instead of panicking, it returns all the problems found with the structure
+// as [StructureErrors]. The state machine is finalized only if no problems were found.
+// To also collect the problems found while building the structure,
+// rather than panicking as soon as they're found, set [StateMachine.CollectErrors] before building.
+func (sm *StateMachine[E]) FinalizeE() error {
+	if errs := sm.check(); len(errs) > 0 {
+		return errs
+	}
+	sm.finalize()
+	return nil
+}
+
+// Validate returns all the problems found with the state machine structure, without finalizing it.
+// Each of the returned errors is a [*StructureError].
+func (sm *StateMachine[E]) Validate() []error {
+	return sm.check().Unwrap()
+}
+
+// check collects all the problems with the state machine structure.
+func (sm *StateMachine[E]) check() StructureErrors {
+	sm.top.sm = sm
 	sm.top.name = "machine"
 	sm.terminal.name = "terminal state"
+	errs := append(StructureErrors(nil), sm.errs...)
+
 	// check for unused stateBuilders - likely a forgotten call to Build() method
 	for _, sb := range sm.stateBuilders {
-		panic(fmt.Sprintf("state %s builder left unused. Forgotten call to Build()?", sb.name))
+		errs = append(errs, &StructureError{Kind: KindUnusedBuilder, State: sb.name,
+			Msg: fmt.Sprintf("state %s builder left unused. Forgotten call to Build()?", sb.name)})
 	}
 
 	// check for unused transition builders - likely a forgotten call to Build() method
-	for _, sb := range sm.transitionBuilders {
-		panic(fmt.Sprintf(
-			"transition builder for event %d, %s --> %s left unused. Forgotten call to Build()?",
-			sb.t.eventId, sb.src.name, sb.t.target.name,
-		))
+	for _, tb := range sm.transitionBuilders {
+		err := &StructureError{Kind: KindUnusedBuilder, State: tb.src.name, Target: tb.t.target.name}
+		if tb.t.trigger == triggerCompletion {
+			err.Msg = fmt.Sprintf("completion transition builder for %s --> %s left unused. Forgotten call to Build()?",
+				tb.src.name, tb.t.target.name)
+		} else {
+			err.Msg = fmt.Sprintf("transition builder for event %d, %s --> %s left unused. Forgotten call to Build()?",
+				tb.t.eventId, tb.src.name, tb.t.target.name)
+		}
+		errs = append(errs, err)
+	}
+
+	if s := sm.ErrorState; s != nil && (s.sm != sm || s.pseudo != pseudoNone || s.region) {
+		errs = append(errs, &StructureError{Kind: KindInvalidErrorState, State: s.name,
+			Msg: fmt.Sprintf("error state %s must be a regular state of this state machine", s.name)})
 	}
 
 	// must be able to enter root state
-	sm.top.validate()
+	checked := make(map[*State[E]]bool)
+	errs = sm.top.validate(checked, errs)
+
+	var recurse func(*State[E])
+	recurse = func(s *State[E]) {
+		if s.pseudo != pseudoNone && len(s.transitions) == 0 {
+			errs = append(errs, &StructureError{Kind: KindInvalidPseudostate, State: s.name,
+				Msg: fmt.Sprintf("%s %s must have at least one outgoing branch", s.pseudo, s.name)})
+		}
+		for _, t := range s.transitions {
+			// must be able to enter any state that's target of a transition, except for internal transitions
+			if !t.internal {
+				errs = t.target.validateTarget(checked, errs)
+			}
+		}
+		for _, s1 := range s.children {
+			recurse(s1)
+		}
+	}
+	recurse(&sm.top)
+	errs = sm.checkJunctionCycles(errs)
+	if sm.Strict {
+		errs = append(errs, sm.lint()...)
+	}
+	return errs
+}
 
-	var recurseValidate func(*State[E])
-	recurseValidate = func(s *State[E]) {
+// finalize prepares the validated structure for use by the state machine instances.
+func (sm *StateMachine[E]) finalize() {
+	if sm.finalized {
+		return
+	}
+	var recurseTransitions func(*State[E])
+	recurseTransitions = func(s *State[E]) {
 		for _, t := range s.transitions {
 			sm.history |= t.history
+			sm.completions = sm.completions || t.trigger == triggerCompletion && s.pseudo == pseudoNone
+			if t.trigger == triggerAfter || t.trigger == triggerAt {
+				s.timers = append(s.timers, t)
+			}
 			t.target.history |= t.history
-			// must be able to enter any state that's target of a transition, except for internal transitions
 			if !t.internal {
-				t.target.validate()
+				t.domain = t.computeDomain(s)
+			}
+		}
+		for _, s1 := range s.children {
+			recurseTransitions(s1)
+		}
+	}
+	recurseTransitions(&sm.top)
+
+	// number the states in document order, and mark the states whose history needs to be recorded
+	order := 0
+	var recurseFinalize func(s *State[E], deep bool)
+	recurseFinalize = func(s *State[E], deep bool) {
+		s.order = order
+		order++
+		deep = deep || s.history&HistoryDeep != 0
+		if !s.IsLeaf() && !s.isOrthogonal() {
+			s.recordHistory = deep || s.history&HistoryShallow != 0 ||
+				s.region && s.parent.history&HistoryShallow != 0
+		}
+		for _, s1 := range s.children {
+			recurseFinalize(s1, deep)
+		}
+	}
+	recurseFinalize(&sm.top, false)
+	sm.compile()
+	sm.finalized = true
+}
+
+// checkJunctionCycles reports any cycles of junction branches, which would lead to infinite recursion.
+func (sm *StateMachine[E]) checkJunctionCycles(errs StructureErrors) StructureErrors {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	visits := make(map[*State[E]]int)
+	var visit func(j *State[E])
+	visit = func(j *State[E]) {
+		switch visits[j] {
+		case visiting:
+			errs = append(errs, &StructureError{Kind: KindJunctionCycle, State: j.name,
+				Msg: fmt.Sprintf("junction %s is part of a cycle of junction branches", j.name)})
+			return
+		case done:
+			return
+		}
+		visits[j] = visiting
+		for _, t := range j.transitions {
+			if t.target.pseudo == pseudoJunction {
+				visit(t.target)
 			}
 		}
+		visits[j] = done
+	}
+	var recurse func(s *State[E])
+	recurse = func(s *State[E]) {
+		if s.pseudo == pseudoJunction {
+			visit(s)
+		}
 		for _, s1 := range s.children {
-			recurseValidate(s1)
+			recurse(s1)
 		}
 	}
-	recurseValidate(&sm.top)
+	recurse(&sm.top)
+	return errs
 }
 
 // Initialize initializes this instance.
 // Before this method returns, state machine will enter its initial leaf state,
+// (or leaf states, in case of orthogonal regions),
 // invoking any relevant entry actions.
 // The event e is passed into the entry actions as the initial event,
 // but is otherwise not delivered to state machine.
 func (smi *StateMachineInstance[E]) Initialize(e Event) {
 
-	if !smi.SM.top.validated {
+	if !smi.SM.finalized {
 		panic("state machine not finalized")
 	}
 
-	if smi.SM.history&HistoryDeep != 0 {
-		smi.historyDeep = make(map[*State[E]]*State[E])
-	}
-	if smi.SM.history&HistoryShallow != 0 {
-		smi.historyShallow = make(map[*State[E]]*State[E])
+	if smi.SM.history != HistoryNone {
+		smi.history = make(map[*State[E]]*State[E])
 	}
 
-	// drill down to the initial leaf state, running entry actions along the way
-	for s := &smi.SM.top; s != nil; s = s.initial {
-		if s.entry != nil {
-			s.entry(e, smi.Ext)
-		}
-		smi.current = s
+	smi.begin()
+	defer smi.end()
+
+	// drill down to the initial leaf state(s), running entry actions along the way
+	if cap(smi.active) == 0 {
+		// like the context, the buffer is hidden from escape analysis, see ctx
+		smi.active = (*[len(smi.activeBuf)]*State[E])(noescape(unsafe.Pointer(&smi.activeBuf)))[:0]
+	}
+	smi.active = smi.active[:0]
+	smi.entered = smi.entered[:0]
+	smi.queue.clear()
+	smi.urgent.clear()
+	smi.recalled.clear()
+	smi.deferred = smi.deferred[:0]
+	smi.timers = smi.timers[:0]
+	smi.enter(e, &smi.SM.top)
+	if smi.tracer == nil {
+		smi.enterDirect(e, &smi.SM.top, nil, HistoryNone)
+	} else {
+		smi.enterDefault(e, &smi.SM.top, HistoryNone)
 	}
 	smi.initialized = true
+	smi.complete(e)
+	if smi.recalled.len() > 0 || smi.urgent.len() > 0 || smi.queue.len() > 0 {
+		smi.drain()
+	}
+}
+
+// begin marks the start of event processing, guarding against reentrant calls.
+func (smi *StateMachineInstance[E]) begin() {
+	if smi.dispatching {
+		panic("state machine instance is not reentrant; use Context.Post to deliver events from within actions")
+	}
+	smi.dispatching = true
+	smi.tracer = smi.Tracer
+	if smi.tracer == nil {
+		smi.tracer = smi.SM.Tracer
+	}
 }
 
-func (smi *StateMachineInstance[E]) getTransition(e Event) (*State[E], *transition[E]) {
-	for src := smi.current; src != nil; src = src.parent {
-		for _, t := range src.transitions {
-			if t.eventId == e.Id && (t.guard == nil || t.guard(e, smi.Ext)) {
-				return src, t
+// end marks the end of event processing.
+func (smi *StateMachineInstance[E]) end() {
+	smi.dispatching = false
+}
+
+// selectTransitions finds transitions enabled by event e, searching from each active leaf state up.
+// If completion is true, selectTransitions instead finds enabled completion transitions,
+// searching only the states entered during the current step.
+// A state is searched at most once, even when it is an ancestor of multiple active leaves.
+// Of any two conflicting transitions (those exiting a common state),
+// the one whose source is nested deeper wins, or else the one found first.
+// The search from a leaf state also stops at a state which defers the event,
+// in which case the state is recorded in smi.deferring.
+func (smi *StateMachineInstance[E]) selectTransitions(e Event, completion bool) []selection[E] {
+	smi.visited = smi.visited[:0]
+	smi.selected = smi.selected[:0]
+	smi.deferring = nil
+	for _, leaf := range smi.active {
+	search:
+		for src := leaf; src != nil; src = src.parent {
+			for _, v := range smi.visited {
+				if v == src {
+					break search // this state and its ancestors have already been searched
+				}
+			}
+			smi.visited = append(smi.visited, src)
+			if completion && !smi.wasEntered(src) {
+				continue
 			}
+			for _, t := range src.transitions {
+				if completion && t.trigger == triggerCompletion || !completion && t.trigger == triggerEvent && t.eventId == e.Id {
+					if segs, ok := smi.enabled(e, src, t); ok {
+						smi.addSelection(newSelection(src, t, segs))
+						break search
+					}
+				}
+			}
+			if !completion && src.defers(e.Id) {
+				if smi.deferring == nil {
+					smi.deferring = src
+				}
+				break search
+			}
+		}
+	}
+	return smi.selected
+}
+
+// enabled returns whether transition t is enabled by event e: its guard must be true,
+// and if t targets a junction, there must be a path of enabled junction branches.
+// In the latter case, enabled also returns the path.
+func (smi *StateMachineInstance[E]) enabled(e Event, src *State[E], t *transition[E]) (segs []*transition[E], ok bool) {
+	if !smi.guard(e, src, t) {
+		return nil, false
+	}
+	if t.target.pseudo != pseudoJunction {
+		return nil, true
+	}
+	return smi.followJunction(e, t.target, nil)
+}
+
+// followJunction searches for a path of enabled branches leading from the junction j to a state
+// that is not a junction, backtracking as necessary. The path is appended to segs.
+func (smi *StateMachineInstance[E]) followJunction(e Event, j *State[E], segs []*transition[E]) ([]*transition[E], bool) {
+	for _, b := range j.transitions {
+		if !smi.guard(e, j, b) {
+			continue
+		}
+		if b.target.pseudo != pseudoJunction {
+			return append(segs, b), true
+		}
+		if path, ok := smi.followJunction(e, b.target, append(segs, b)); ok {
+			return path, true
+		}
+	}
+	return segs, false
+}
+
+// followChoice selects the enabled branch of the choice c, along with any junction branches following it.
+func (smi *StateMachineInstance[E]) followChoice(e Event, c *State[E]) []*transition[E] {
+	for _, b := range c.transitions {
+		if !smi.guard(e, c, b) {
+			continue
+		}
+		if b.target.pseudo != pseudoJunction {
+			return []*transition[E]{b}
+		}
+		if path, ok := smi.followJunction(e, b.target, []*transition[E]{b}); ok {
+			return path
+		}
+	}
+	panic(fmt.Sprintf("no enabled branch from choice %s", c.name))
+}
+
+// addSelection adds transition to the list of selected transitions, resolving any conflicts.
+func (smi *StateMachineInstance[E]) addSelection(sel selection[E]) {
+	keep := smi.selected[:0]
+	for i, other := range smi.selected {
+		if !sel.conflicts(other) {
+			keep = append(keep, other)
+			continue
 		}
+		if !isAncestor(other.src, sel.src) {
+			// preempted by an earlier transition; drop the new one and keep everything else
+			smi.selected = append(keep, smi.selected[i:]...)
+			return
+		}
+	}
+	smi.selected = append(keep, sel)
+}
+
+// conflicts reports whether two transitions would exit a common state.
+func (sel selection[E]) conflicts(other selection[E]) bool {
+	if sel.t.internal || other.t.internal {
+		return false
 	}
-	return nil, nil
+	d1, d2 := sel.domain, other.domain
+	return d1 == d2 || isAncestor(d1, d2) || isAncestor(d2, d1)
 }
 
 // Deliver an event to the state machine, returning whether the event was handled, and in which state.
 // Any applicable transitions and actions will be completed before the method returns.
-// This method is not reentrant - do not invoke it from within transition actions,
+// If the state machine has orthogonal regions,
+// the event is dispatched to each of the active regions,
+// and src is the source state of the first transition taken.
+// If the event is deferred (see [StateBuilder.Defer]), Deliver returns true,
+// along with the state which deferred the event.
+// Any events posted by the actions (see [Context.Post]) are delivered, in turn,
+// before the method returns. The return values pertain only to the event e.
+// This method is not reentrant - it panics if invoked from within transition actions,
 // state entry/exit functions, or transition guard functions.
-// If transition action needs to generate a new event,
-// arrange for that event to be delivered to the instance only _after_ the current Deliver() method returns.
+// If transition action needs to generate a new event, it should post the event using [Context.Post].
+// Deliver lets any panics in actions and guards propagate; use [StateMachineInstance.DeliverE] to recover from them.
 func (smi *StateMachineInstance[E]) Deliver(e Event) (handled bool, src *State[E]) {
 	if !smi.initialized {
 		panic("State machine must be initialized before delivering the first event")
 	}
-	if smi.current == nil {
+	smi.begin()
+	defer smi.end()
+	handled, src = smi.dispatch(e)
+	if smi.recalled.len() > 0 || smi.urgent.len() > 0 || smi.queue.len() > 0 {
+		smi.drain()
+	}
+	return
+}
+
+// drain delivers all the events posted to the internal queue, until the queue is empty.
+// Recalled deferred events are delivered first, followed by the priority lane, followed by the regular queue.
+func (smi *StateMachineInstance[E]) drain() {
+	for {
+		e, ok := smi.recalled.pop()
+		if !ok {
+			if e, ok = smi.urgent.pop(); !ok {
+				if e, ok = smi.queue.pop(); !ok {
+					return
+				}
+			}
+		}
+		if len(smi.active) == 0 {
+			// state machine has terminated, drop any remaining events
+			smi.recalled.clear()
+			smi.urgent.clear()
+			smi.queue.clear()
+			smi.deferred = smi.deferred[:0]
+			return
+		}
+		smi.dispatch(e)
+	}
+}
+
+// dispatch delivers a single event to the state machine, running the resulting transitions to completion.
+func (smi *StateMachineInstance[E]) dispatch(e Event) (handled bool, src *State[E]) {
+	if smi.tracer != nil {
+		return smi.dispatchTraced(e)
+	}
+	return smi.step(e)
+}
+
+// dispatchTraced is like dispatch, but also traces the event being received, and left unhandled.
+func (smi *StateMachineInstance[E]) dispatchTraced(e Event) (handled bool, src *State[E]) {
+	smi.tracer.EventReceived(e)
+	if handled, src = smi.step(e); !handled {
+		smi.tracer.EventUnhandled(e)
+	}
+	return
+}
+
+// step runs a single run-to-completion step, taking the transitions enabled by event e.
+func (smi *StateMachineInstance[E]) step(e Event) (handled bool, src *State[E]) {
+	if len(smi.active) == 0 {
 		return // all events are ignored in the terminal state
 	}
-	src, t := smi.getTransition(e)
-	if t == nil {
-		return
+	smi.entered = smi.entered[:0]
+	smi.changed = false
+	if len(smi.active) == 1 {
+		// fast path, without orthogonal regions there's at most one transition to take
+		if smi.SM.scan {
+			return smi.dispatchScan(e, smi.active[0])
+		}
+		return smi.dispatchTable(e, smi.active[0])
 	}
-	handled = true
-	if t.internal {
-		if t.action != nil {
-			t.action(e, smi.Ext)
+	selected := smi.selectTransitions(e, false)
+	if len(selected) == 0 {
+		if src = smi.deferring; src != nil {
+			smi.deferred = append(smi.deferred, e)
+			return true, src
 		}
 		return
 	}
+	handled, src = true, selected[0].src
+	smi.fireAll(e, selected)
+	smi.complete(e)
+	smi.recall()
+	return
+}
 
-	// we've got ourselves a non-internal transition
-	dst := t.target
-	var storage1, storage2 [5]*State[E] // avoid slice allocations for HSMs less than 6 levels deep
-	// path up the tree, starting at src/dst and ending at top state
-	srcPath, dstPath := storage1[:0], storage2[:0]
-	for s := src; s != nil; s = s.parent {
-		srcPath = append(srcPath, s)
+// recall arranges for the deferred events to be re-delivered, if the active configuration has changed.
+// Recalled events are delivered before any other queued events, in the order in which they were originally delivered.
+// Events that are still deferred will be deferred again.
+func (smi *StateMachineInstance[E]) recall() {
+	if !smi.changed || len(smi.deferred) == 0 {
+		return
 	}
-	for s := dst; s != nil; s = s.parent {
-		dstPath = append(dstPath, s)
+	// events deferred again while processing recalled events still go first
+	for e, ok := smi.recalled.pop(); ok; e, ok = smi.recalled.pop() {
+		smi.deferred = append(smi.deferred, e)
 	}
+	smi.recalled.events, smi.deferred = smi.deferred, smi.recalled.events
+}
 
-	// find LCA - the lowest common ancestor, by walking srcPath/dstPath backwards
-	// The highest LCA can be is top state, since we don't allow using this as either src or dst for transitions
-	var i, j int
-	for i, j = len(srcPath)-2, len(dstPath)-2; i > 0 && j > 0 && srcPath[i] == dstPath[j]; i, j = i-1, j-1 {
+// fireAll fires all the selected transitions, stopping early if state machine terminates.
+func (smi *StateMachineInstance[E]) fireAll(e Event, selected []selection[E]) {
+	for _, sel := range selected {
+		smi.fire(e, &sel)
+		if len(smi.active) == 0 {
+			break // state machine has terminated
+		}
 	}
-	// i and j now point to one state below LCA on srcPath and dstPath
-	lca := srcPath[i+1]
+}
 
-	if t.local {
-		// Transition is marked as local, which means that src is contained in dst or vice-versa.
-		// For local transitions we don't want to leave and re-enter the super-state, and so we lower
-		// our positions on srcPath and dstPath one step further.
-		lca = srcPath[i]
-		i--
-		j--
+// complete takes any enabled completion transitions of the states entered during the current step,
+// and keeps doing so until no more completion transitions are enabled.
+// Completion transitions receive the event e, which caused the states to be entered.
+func (smi *StateMachineInstance[E]) complete(e Event) {
+	for steps := 0; len(smi.entered) > 0 && len(smi.active) > 0; steps++ {
+		if steps == maxCompletionSteps {
+			panic(fmt.Sprintf("completion transitions did not settle after %d steps, in state %s",
+				maxCompletionSteps, smi.active[0].name))
+		}
+		selected := smi.selectTransitions(e, true)
+		// completion events of the states entered so far have been consumed
+		smi.entered = smi.entered[:0]
+		smi.fireAll(e, selected)
 	}
+}
 
-	// move up from current state to LCA, and exit every state along the way (excluding LCA)
-	for s := smi.current; s != lca; s = s.parent {
-		if s.exit != nil {
-			s.exit(e, smi.Ext)
+// wasEntered returns whether the state s was entered during the current step.
+func (smi *StateMachineInstance[E]) wasEntered(s *State[E]) bool {
+	for _, s1 := range smi.entered {
+		if s1 == s {
+			return true
 		}
-		if s.parent.history&HistoryShallow != 0 {
-			smi.historyShallow[s.parent] = s
+	}
+	return false
+}
+
+// fire executes the selected transition: exits states, runs transition action and enters states.
+// Compound transitions through junctions and choices are executed as a single transition,
+// leaving and entering each state at most once.
+func (smi *StateMachineInstance[E]) fire(e Event, sel *selection[E]) {
+	t := sel.t
+	if smi.tracer != nil {
+		smi.tracer.TransitionSelected(sel.src, t.target)
+	}
+	if t.internal {
+		smi.action(e, sel.src, t)
+		return
+	}
+
+	smi.changed = true
+
+	// exit every active state below the transition domain
+	domain := sel.domain
+	if sel.exits != nil {
+		smi.exitPath(e, sel.exits)
+	} else {
+		smi.exitBelow(e, domain)
+	}
+
+	// execute the transition action, followed by actions of any junction branches
+	smi.action(e, sel.src, t)
+	for _, b := range sel.segs {
+		smi.action(e, t.target, b)
+		t = b
+	}
+
+	// with exits and actions done, guards of the choice branches can be evaluated
+	for t.target.pseudo == pseudoChoice {
+		segs := smi.followChoice(e, t.target)
+		for _, b := range segs {
+			if isAncestor(b.domain, domain) {
+				// branch leads outside of the domain, so we must exit some more states
+				domain = b.domain
+				smi.exitBelow(e, domain)
+			}
 		}
-		if s.parent.history&HistoryDeep != 0 {
-			smi.historyDeep[s.parent] = smi.current
+		for _, b := range segs {
+			smi.action(e, t.target, b)
+			t = b
 		}
 	}
 
-	// execute the transition action
-	if t.action != nil {
-		t.action(e, smi.Ext)
+	dst := t.target
+	if dst == &smi.SM.terminal {
+		smi.active = smi.active[:0] // state machine has terminated
+		if smi.tracer != nil {
+			smi.tracer.Terminated()
+		}
+		return
 	}
 
-	if dst == &smi.SM.terminal {
-		smi.current = nil // state machine has terminated
+	if t == sel.t && domain == t.domain && !smi.SM.scan {
+		// the path has been computed when finalizing
+		smi.enterPath(e, domain, t.path, t.history)
 		return
 	}
+	smi.enterDown(e, domain, dst, t.history)
+}
 
-	// move down from just below LCS to dst, entering states
-	for j := j; j >= 0; j-- {
-		if dstPath[j].entry != nil {
-			dstPath[j].entry(e, smi.Ext)
-		}
+// enterDown enters states on the path from just below active state domain down to dst,
+// then enters dst using the given history type.
+func (smi *StateMachineInstance[E]) enterDown(e Event, domain, dst *State[E], h History) {
+	var storage [5]*State[E] // avoid slice allocations for HSMs less than 6 levels deep
+	path := storage[:0]
+	for s := dst; s != domain; s = s.parent {
+		path = append(path, s)
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
 	}
+	smi.enterPath(e, domain, path, h)
+}
 
-	// we have entered dst; proceed with initial or history transitions if dst is composite state
-	smi.current = dst
-	var s *State[E] = dst.initial
+// exitPath exits the states on the path from the single active leaf state up, as precomputed when finalizing.
+func (smi *StateMachineInstance[E]) exitPath(e Event, path []*State[E]) {
+	for _, s := range path {
+		smi.exit(e, s)
+		smi.active[0] = s.parent
+	}
+}
 
-	if t.history == HistoryDeep {
-		if s = smi.historyDeep[dst]; s != nil {
-			// compute path from deep history up to dst
-			dstPath = dstPath[:0]
-			for ; s != dst; s = s.parent {
-				dstPath = append(dstPath, s)
+// exit runs the exit action of active state s, disarms its timers, and records it in its parent's history.
+func (smi *StateMachineInstance[E]) exit(e Event, s *State[E]) {
+	smi.user = true
+	if s.exitPlain != nil {
+		s.exitPlain(e, smi.Ext)
+	} else if s.exit != nil {
+		s.exit(smi.ctx(), e, smi.Ext)
+	}
+	smi.user = false
+	if len(s.timers) > 0 {
+		smi.disarm(s)
+	}
+	if smi.tracer != nil {
+		smi.tracer.StateExited(s)
+	}
+	if p := s.parent; p.recordHistory {
+		smi.record(p, s)
+	}
+}
+
+// exitBelow exits all active states nested (directly or transitively) within the given state.
+// States are exited in reverse document order, which guarantees that sub-states are exited before their parents.
+func (smi *StateMachineInstance[E]) exitBelow(e Event, domain *State[E]) {
+	if len(smi.active) == 1 {
+		// fast path, without orthogonal regions just walk up from the leaf state
+		if s := smi.active[0]; isAncestor(domain, s) {
+			for ; s != domain; s = s.parent {
+				smi.exit(e, s)
+				smi.active[0] = s.parent
 			}
-			// now walk backwards, entering states
-			for i := len(dstPath) - 1; i >= 0; i-- {
-				if dstPath[i].entry != nil {
-					dstPath[i].entry(e, smi.Ext)
+		}
+		return
+	}
+	for {
+		i := len(smi.active) - 1
+		for ; i >= 0 && !isAncestor(domain, smi.active[i]); i-- {
+		}
+		if i < 0 {
+			return
+		}
+		s := smi.active[i]
+		smi.exit(e, s)
+		p := s.parent
+		if i > 0 && isAncestor(p, smi.active[i-1]) {
+			// parent still has other active regions
+			smi.active = append(smi.active[:i], smi.active[i+1:]...)
+		} else {
+			smi.active[i] = p
+		}
+	}
+}
+
+// enter enters state s, whose parent must already be active.
+func (smi *StateMachineInstance[E]) enter(e Event, s *State[E]) {
+	// s replaces its parent in the active configuration, or else is inserted in document order
+	if len(smi.active) == 1 && smi.active[0] == s.parent {
+		smi.active[0] = s // fast path, for the single active leaf state
+	} else {
+		smi.activate(s)
+	}
+	if smi.SM.completions {
+		smi.entered = append(smi.entered, s)
+	}
+	if len(s.timers) > 0 {
+		smi.arm(s)
+	}
+	smi.user = true
+	if s.entryPlain != nil {
+		s.entryPlain(e, smi.Ext)
+	} else if s.entry != nil {
+		s.entry(smi.ctx(), e, smi.Ext)
+	}
+	smi.user = false
+	if smi.tracer != nil && s.parent != nil {
+		smi.tracer.StateEntered(s)
+	}
+}
+
+// activate replaces the parent of state s with s in the active configuration,
+// or else inserts s in document order.
+func (smi *StateMachineInstance[E]) activate(s *State[E]) {
+	i := len(smi.active)
+	for i > 0 && smi.active[i-1].order > s.order {
+		i--
+	}
+	if i > 0 && smi.active[i-1] == s.parent {
+		smi.active[i-1] = s
+	} else if i == len(smi.active) {
+		smi.active = append(smi.active, s)
+	} else {
+		smi.active = append(smi.active, nil)
+		copy(smi.active[i+1:], smi.active[i:])
+		smi.active[i] = s
+	}
+}
+
+// enterPath enters states along the path leading down from active state s, then enters the
+// last state in the path using the given history type.
+// Any orthogonal regions not on the path are entered through their initial transitions.
+func (smi *StateMachineInstance[E]) enterPath(e Event, s *State[E], path []*State[E], h History) {
+	for ; len(path) > 0; path = path[1:] {
+		if s.isOrthogonal() {
+			for _, r := range s.children {
+				smi.enter(e, r)
+				if r == path[0] {
+					smi.enterPath(e, r, path[1:], h)
+				} else {
+					smi.enterDefault(e, r, HistoryNone)
 				}
 			}
-			smi.current = dstPath[0]
 			return
 		}
-		// first transition into this state, no history, use initial transition
-		s = dst.initial
-	} else if t.history == HistoryShallow {
-		s = smi.historyShallow[dst]
-		if s == nil {
-			// first transition into this state, no history, use initial transition
-			s = dst.initial
+		s = path[0]
+		smi.enter(e, s)
+	}
+	if !s.IsLeaf() {
+		smi.enterDefault(e, s, h)
+	}
+}
+
+// enterDirect is like enterPath, for the single active leaf state s and the path which doesn't lead into
+// orthogonal regions, see transit. It's the fast path for entering states, so enter and enterDefault
+// are written out in full, without tracing.
+func (smi *StateMachineInstance[E]) enterDirect(e Event, s *State[E], path []*State[E], h History) {
+	for i := 0; ; i++ {
+		if i < len(path) {
+			s = path[i]
+		} else if s.IsLeaf() {
+			return
+		} else if s.isOrthogonal() || h != HistoryNone {
+			smi.enterDefault(e, s, h)
+			return
+		} else {
+			s = s.initial
+		}
+		smi.active[0] = s
+		if smi.SM.completions {
+			smi.entered = append(smi.entered, s)
+		}
+		if len(s.timers) > 0 {
+			smi.arm(s)
+		}
+		smi.user = true
+		if s.entryPlain != nil {
+			s.entryPlain(e, smi.Ext)
+		} else if s.entry != nil {
+			s.entry(smi.ctx(), e, smi.Ext)
 		}
+		smi.user = false
 	}
-	for ; s != nil; s = s.initial {
-		smi.current = s
-		if s.entry != nil {
-			s.entry(e, smi.Ext)
+}
+
+// enterDefault proceeds from an entered state s down to leaf state(s),
+// following initial or history transitions.
+func (smi *StateMachineInstance[E]) enterDefault(e Event, s *State[E], h History) {
+	for !s.IsLeaf() {
+		if s.isOrthogonal() {
+			for _, r := range s.children {
+				smi.enter(e, r)
+				smi.enterDefault(e, r, h)
+			}
+			return
+		}
+		child := s.initial
+		if h != HistoryNone {
+			if last := smi.history[s]; last != nil {
+				child = last
+				if smi.tracer != nil {
+					smi.tracer.HistoryRestored(s, child)
+				}
+			} else {
+				h = HistoryNone // first transition into this state, no history, use initial transition
+			}
 		}
+		if h == HistoryShallow {
+			h = HistoryNone
+		}
+		smi.enter(e, child)
+		s = child
 	}
-	return
 }
 
 // Current returns current (leaf) state, or nil if state machine has terminated.
-// This method should not be invoked while state machine is processing an event.
-// In other words, the result is not well-defined if invoked from within state entry/exit actions,
-// transition actions, or transition guards.
+// If the current state contains orthogonal regions,
+// Current returns the active leaf state of the first region;
+// use [StateMachineInstance.Configuration] to obtain all the active leaf states.
+// While the state machine is processing an event, Current returns the innermost active state,
+// which need not be a leaf state while a transition is being taken; see [StateMachineInstance.IsIn].
 func (smi *StateMachineInstance[E]) Current() *State[E] {
-	return smi.current
+	if len(smi.active) == 0 {
+		return nil
+	}
+	return smi.active[0]
+}
+
+// Configuration returns all the active leaf states, one for each active orthogonal region,
+// in the order in which the states were defined.
+// The result is empty if state machine has terminated.
+// Like Current(), while the state machine is processing an event,
+// Configuration returns the innermost active states.
+func (smi *StateMachineInstance[E]) Configuration() []*State[E] {
+	return append([]*State[E](nil), smi.active...)
+}
+
+// IsIn returns whether state s is active: whether it is one of the active leaf states, or contains one.
+// IsIn is well-defined while the state machine is processing an event,
+// and can be used by guards and actions through [Context.IsIn].
+// A state becomes active just before its entry action runs, and remains active until its exit action has run.
+// Therefore, guards of a transition see the states as they were before the transition,
+// transition actions see the states exited by the transition as no longer active,
+// and the states entered by the transition as not yet active,
+// and the guards of the branches of a choice pseudostate, evaluated after the exits and actions,
+// see the states the same way as the actions.
+// After the state machine has terminated, no state is active.
+func (smi *StateMachineInstance[E]) IsIn(s *State[E]) bool {
+	for _, a := range smi.active {
+		if a == s || isAncestor(s, a) {
+			return true
+		}
+	}
+	return false
+}
+
+// ActivePath returns the current state (see [StateMachineInstance.Current]) followed by its super-states,
+// up to and including the top-level state, or nil if state machine has terminated.
+// Like IsIn, ActivePath is well-defined while the state machine is processing an event.
+func (smi *StateMachineInstance[E]) ActivePath() []*State[E] {
+	var path []*State[E]
+	for s := smi.Current(); s != nil && s.parent != nil; s = s.parent {
+		path = append(path, s)
+	}
+	return path
+}
+
+// isAncestor reports whether a is a (direct or transitive) superstate of s.
+func isAncestor[E any](a, s *State[E]) bool {
+	for s = s.parent; s != nil; s = s.parent {
+		if s == a {
+			return true
+		}
+	}
+	return false
 }
 
 // getParent returns the one of the two states that's (direct or transitive) superstate of the other,
@@ -147,11 +147,20 @@ event H
 
 type falseBuf struct{}
 
-func (f falseBuf) WriteString(s string) {}
-func (f falseBuf) WriteByte(b byte)     {}
-func (f falseBuf) Reset()               {}
+func (f falseBuf) WriteString(s string)   {}
+func (f falseBuf) WriteByte(b byte) error { return nil }
+func (f falseBuf) Reset()                 {}
 
 func BenchmarkHsm(b *testing.B) {
+	benchmarkHsm(b, false)
+}
+
+// BenchmarkHsmScan runs the same benchmark without the dispatch tables, for comparison.
+func BenchmarkHsmScan(b *testing.B) {
+	benchmarkHsm(b, true)
+}
+
+func benchmarkHsm(b *testing.B, scan bool) {
 
 	//var buf bytes.Buffer
 	var buf falseBuf
@@ -195,6 +204,7 @@ func BenchmarkHsm(b *testing.B) {
 		Build()
 
 	sm.Finalize()
+	sm.scan = scan
 
 	for i := 0; i < b.N; i++ {
 
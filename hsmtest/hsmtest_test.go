@@ -0,0 +1,163 @@
+package hsmtest_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dragomit/hsm"
+	"github.com/dragomit/hsm/hsmtest"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	evB = iota
+	evAshallow
+	evA11
+	evStop
+)
+
+var evNames = []string{"evB", "evAshallow", "evA11", "evStop"}
+
+func evName(id int) string {
+	return evNames[id]
+}
+
+type machine struct {
+	sm                     *hsm.StateMachine[struct{}]
+	a, a1, a2, a11, a12, b *hsm.State[struct{}]
+}
+
+func newMachine() machine {
+	nop := func(hsm.Event, struct{}) {}
+	sm := &hsm.StateMachine[struct{}]{}
+	m := machine{sm: sm}
+	m.a = sm.State("A").Build()
+	m.a1 = m.a.State("A1").Build()
+	m.a2 = m.a.State("A2").Initial().Build()
+	m.a11 = m.a1.State("A11").Build()
+	m.a12 = m.a1.State("A12").Initial().Build()
+	m.b = sm.State("B").Initial().Build()
+	m.a.Transition(evB, m.b).Action("leave", nop).Build()
+	m.b.Transition(evAshallow, m.a).History(hsm.HistoryShallow).Build()
+	m.b.AddTransition(evA11, m.a11)
+	m.b.After(time.Minute, m.a2).Build()
+	m.a.AddTransition(evStop, nil)
+	sm.Finalize()
+	return m
+}
+
+func TestRunAll(t *testing.T) {
+	m := newMachine()
+	r := hsmtest.Runner[struct{}]{SM: m.sm, EventName: evName}
+	r.RunAll(t,
+		hsmtest.Scenario[struct{}]{
+			Name:  "initial transition to shallow history",
+			Steps: hsmtest.Events[struct{}](evAshallow),
+			Want:  m.a2,
+		},
+		hsmtest.Scenario[struct{}]{
+			Name:  "shallow history",
+			Steps: hsmtest.Events[struct{}](evA11, evB, evAshallow),
+			Want:  m.a12,
+		},
+	)
+}
+
+func TestRun(t *testing.T) {
+	m := newMachine()
+	r := hsmtest.Runner[struct{}]{SM: m.sm, EventName: evName}
+	smi := r.Run(t, hsmtest.Scenario[struct{}]{Steps: []hsmtest.Step[struct{}]{
+		{
+			Event:      hsm.Event{Id: evA11},
+			Want:       m.a11,
+			WantActive: []string{"A/A1/A11"},
+			WantTrace:  []string{"exited B", "entered A", "entered A1", "entered A11"},
+		},
+		{
+			Event:     hsm.Event{Id: evB},
+			Want:      m.b,
+			WantTrace: []string{"exited A11", "exited A1", "exited A", "action A --> B / leave", "entered B"},
+		},
+		{
+			Advance:   time.Minute,
+			Want:      m.a2,
+			WantTrace: []string{"exited B", "entered A", "entered A2"},
+		},
+		{
+			Event:      hsm.Event{Id: evStop},
+			Terminated: true,
+			WantActive: []string{},
+			WantTrace:  []string{"exited A2", "exited A", "terminated"},
+		},
+	}})
+	assert.Nil(t, smi.Current())
+	assert.Equal(t, hsmtest.Start.Add(time.Minute), smi.Clock.Now())
+}
+
+// fakeT records the failures reported by the runner
+type fakeT struct {
+	testing.TB
+	errors []string
+}
+
+func (t *fakeT) Helper() {}
+
+func (t *fakeT) Errorf(format string, args ...any) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func TestRunFailure(t *testing.T) {
+	m := newMachine()
+	r := hsmtest.Runner[struct{}]{SM: m.sm, EventName: evName}
+	ft := &fakeT{}
+	r.Run(ft, hsmtest.Scenario[struct{}]{
+		Name: "failing",
+		Steps: []hsmtest.Step[struct{}]{
+			{
+				Event:     hsm.Event{Id: evA11},
+				Want:      m.a12,
+				WantTrace: []string{"exited B", "entered A", "entered A12"},
+			},
+		},
+		Want: m.b,
+	})
+	assert.Equal(t, []string{
+		strings.Join([]string{
+			"failing: step 0 (event evA11):",
+			"current state: want A12, got A11",
+			"sequence (- want, + got):",
+			"  exited B",
+			"  entered A",
+			"- entered A12",
+			"+ entered A1",
+			"+ entered A11",
+			"trace:",
+			"  received evA11",
+			"  selected B --> A11",
+			"  exited B",
+			"  entered A",
+			"  entered A1",
+			"  entered A11",
+		}, "\n"),
+		"failing: final state: want B, got A11",
+	}, ft.errors)
+}
+
+func TestRecorderNext(t *testing.T) {
+	m := newMachine()
+	next := &hsmtest.Recorder[struct{}]{}
+	rec := &hsmtest.Recorder[struct{}]{Next: next}
+	smi := hsm.StateMachineInstance[struct{}]{SM: m.sm, Tracer: rec}
+	smi.Initialize(hsm.Event{})
+	smi.Deliver(hsm.Event{Id: evB})
+	assert.Equal(t, []string{"entered B", "received 0", "unhandled 0"}, rec.Lines())
+	assert.Equal(t, rec.Records, next.Records)
+	assert.Equal(t, []string{"entered B"}, rec.Lines(hsmtest.Sequence...))
+}
+
+func TestDiff(t *testing.T) {
+	assert.Equal(t, "  a\n- b\n+ c\n  d\n+ e", hsmtest.Diff([]string{"a", "b", "d"}, []string{"a", "c", "d", "e"}))
+	assert.Equal(t, "", hsmtest.Diff(nil, nil))
+}
@@ -0,0 +1,160 @@
+// Package hsmtest helps testing state machines built using the hsm package.
+// It provides a scripted scenario runner, which delivers events and advances a fake clock,
+// checking the active states and the steps taken after each event,
+// and a Recorder, which records the steps taken by a state machine instance.
+package hsmtest
+
+import (
+	"fmt"
+
+	"github.com/dragomit/hsm"
+)
+
+// RecordKind classifies the steps recorded by a Recorder.
+type RecordKind int
+
+const (
+	RecordReceived   RecordKind = iota // event dispatched to the instance
+	RecordGuard                        // guard evaluated
+	RecordSelected                     // transition selected
+	RecordExited                       // state exited
+	RecordAction                       // transition action run
+	RecordEntered                      // state entered
+	RecordHistory                      // history restored
+	RecordUnhandled                    // event not handled
+	RecordTerminated                   // instance terminated
+)
+
+// Record is a single step recorded by a Recorder.
+// Line describes the step, in one of the following formats:
+//
+//	received <event>
+//	guard <src> --> <target> [<guard>] <result>
+//	selected <src> --> <target>
+//	exited <state>
+//	action <src> --> <target> / <action>
+//	entered <state>
+//	history <state>: <child>
+//	unhandled <event>
+//	terminated
+//
+// States are named by their names, and events by the Recorder's EventName.
+type Record struct {
+	Kind RecordKind
+	Line string
+}
+
+// Recorder is a [hsm.Tracer] which records every step taken by a state machine instance.
+// Each callback is forwarded to the Next tracer, if any.
+type Recorder[E any] struct {
+	Records   []Record
+	EventName func(int) string // names the events, other than time and error events; the event ids are used if nil
+	Next      hsm.Tracer[E]
+}
+
+// Sequence lists the kinds of records making up the sequence of exits, actions and entries.
+var Sequence = []RecordKind{RecordExited, RecordAction, RecordEntered, RecordTerminated}
+
+// Lines returns the lines of the records of the given kinds, or of all the records if no kinds are given.
+func (r *Recorder[E]) Lines(kinds ...RecordKind) []string {
+	lines := []string{}
+	for _, rec := range r.Records {
+		if len(kinds) == 0 || contains(kinds, rec.Kind) {
+			lines = append(lines, rec.Line)
+		}
+	}
+	return lines
+}
+
+// Reset discards the records.
+func (r *Recorder[E]) Reset() {
+	r.Records = r.Records[:0]
+}
+
+func contains(kinds []RecordKind, kind RecordKind) bool {
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Recorder[E]) add(kind RecordKind, format string, args ...any) {
+	r.Records = append(r.Records, Record{Kind: kind, Line: fmt.Sprintf(format, args...)})
+}
+
+func (r *Recorder[E]) eventName(id int) string {
+	switch {
+	case id == hsm.TimeEvent:
+		return "time event"
+	case id == hsm.ErrorEvent:
+		return "error event"
+	case r.EventName == nil:
+		return fmt.Sprint(id)
+	}
+	return r.EventName(id)
+}
+
+func (r *Recorder[E]) EventReceived(e hsm.Event) {
+	r.add(RecordReceived, "received %s", r.eventName(e.Id))
+	if r.Next != nil {
+		r.Next.EventReceived(e)
+	}
+}
+
+func (r *Recorder[E]) GuardEvaluated(src, target *hsm.State[E], guard string, result bool) {
+	r.add(RecordGuard, "guard %s --> %s [%s] %t", src, target, guard, result)
+	if r.Next != nil {
+		r.Next.GuardEvaluated(src, target, guard, result)
+	}
+}
+
+func (r *Recorder[E]) TransitionSelected(src, target *hsm.State[E]) {
+	r.add(RecordSelected, "selected %s --> %s", src, target)
+	if r.Next != nil {
+		r.Next.TransitionSelected(src, target)
+	}
+}
+
+func (r *Recorder[E]) StateExited(s *hsm.State[E]) {
+	r.add(RecordExited, "exited %s", s)
+	if r.Next != nil {
+		r.Next.StateExited(s)
+	}
+}
+
+func (r *Recorder[E]) ActionRun(src, target *hsm.State[E], action string) {
+	r.add(RecordAction, "action %s --> %s / %s", src, target, action)
+	if r.Next != nil {
+		r.Next.ActionRun(src, target, action)
+	}
+}
+
+func (r *Recorder[E]) StateEntered(s *hsm.State[E]) {
+	r.add(RecordEntered, "entered %s", s)
+	if r.Next != nil {
+		r.Next.StateEntered(s)
+	}
+}
+
+func (r *Recorder[E]) HistoryRestored(s, child *hsm.State[E]) {
+	r.add(RecordHistory, "history %s: %s", s, child)
+	if r.Next != nil {
+		r.Next.HistoryRestored(s, child)
+	}
+}
+
+func (r *Recorder[E]) EventUnhandled(e hsm.Event) {
+	r.add(RecordUnhandled, "unhandled %s", r.eventName(e.Id))
+	if r.Next != nil {
+		r.Next.EventUnhandled(e)
+	}
+}
+
+func (r *Recorder[E]) Terminated() {
+	r.add(RecordTerminated, "terminated")
+	if r.Next != nil {
+		r.Next.Terminated()
+	}
+}
@@ -0,0 +1,194 @@
+package hsmtest
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dragomit/hsm"
+)
+
+// Start is the time the fake clock of each scenario starts at, unless Runner.Start is set.
+var Start = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Step is a single step of a Scenario: delivering an event, or advancing the fake clock,
+// followed by checking the instance. Expectations left at their zero values are not checked.
+type Step[E any] struct {
+	Event   hsm.Event     // event to deliver
+	Advance time.Duration // if positive, the clock is advanced and the due timers processed, instead of delivering Event
+
+	Want       *hsm.State[E] // expected current state
+	Terminated bool          // expect the instance to have terminated
+	WantActive []string      // expected paths of the active leaf states, see hsm.State.Path
+	WantTrace  []string      // expected sequence of exits, actions and entries, see Recorder and Sequence
+}
+
+// Scenario is a scripted test of a state machine: a new instance is initialized,
+// and goes through the steps, each checked in turn. Want, if set, is checked after the last step.
+type Scenario[E any] struct {
+	Name  string
+	Ext   E         // extended state of the instance
+	Init  hsm.Event // event passed to Initialize
+	Steps []Step[E]
+	Want  *hsm.State[E] // expected current state after the last step
+}
+
+// Events returns steps delivering events with the given ids, without checking anything.
+func Events[E any](ids ...int) []Step[E] {
+	steps := make([]Step[E], len(ids))
+	for i, id := range ids {
+		steps[i].Event = hsm.Event{Id: id}
+	}
+	return steps
+}
+
+// Runner runs scenarios against a finalized state machine.
+// Each scenario gets its own instance, whose Clock is a [hsm.FakeClock] set to the Start time,
+// and whose Tracer is a [Recorder] forwarding to the state machine's Tracer.
+type Runner[E any] struct {
+	SM        *hsm.StateMachine[E]
+	EventName func(int) string // names the events in traces and failure messages; the event ids are used if nil
+	Start     time.Time        // start time of the fake clock; package-level Start is used if zero
+}
+
+// Run runs the scenario, reporting any failed expectations to t, and returns the instance it ran.
+// A failed step is reported along with the difference between the expected and the actual sequence of
+// exits, actions and entries, if it was checked, and the complete trace of the step.
+// Running continues after a failed step.
+func (r *Runner[E]) Run(t testing.TB, sc Scenario[E]) *hsm.StateMachineInstance[E] {
+	t.Helper()
+	start := r.Start
+	if start.IsZero() {
+		start = Start
+	}
+	rec := &Recorder[E]{EventName: r.EventName, Next: r.SM.Tracer}
+	smi := &hsm.StateMachineInstance[E]{SM: r.SM, Ext: sc.Ext, Clock: hsm.NewFakeClock(start), Tracer: rec}
+	smi.Initialize(sc.Init)
+	for i, step := range sc.Steps {
+		rec.Reset()
+		var what string
+		if step.Advance > 0 {
+			smi.Clock.(*hsm.FakeClock).Advance(step.Advance)
+			smi.ProcessTimers()
+			what = fmt.Sprintf("advance %s", step.Advance)
+		} else {
+			smi.Deliver(step.Event)
+			what = "event " + rec.eventName(step.Event.Id)
+		}
+		if msgs := r.check(smi, rec, step); len(msgs) > 0 {
+			t.Errorf("%sstep %d (%s):\n%s\ntrace:\n%s", prefix(sc.Name), i, what,
+				strings.Join(msgs, "\n"), indent(rec.Lines()))
+		}
+	}
+	if sc.Want != nil && smi.Current() != sc.Want {
+		t.Errorf("%sfinal state: want %s, got %s", prefix(sc.Name), sc.Want, name(smi.Current()))
+	}
+	return smi
+}
+
+// RunAll runs each of the scenarios as a subtest of t, named after the scenario.
+func (r *Runner[E]) RunAll(t *testing.T, scenarios ...Scenario[E]) {
+	t.Helper()
+	for _, sc := range scenarios {
+		sc := sc
+		t.Run(sc.Name, func(t *testing.T) {
+			t.Helper()
+			sc.Name = ""
+			r.Run(t, sc)
+		})
+	}
+}
+
+// check checks the expectations of a step, returning the messages describing the failed ones.
+func (r *Runner[E]) check(smi *hsm.StateMachineInstance[E], rec *Recorder[E], step Step[E]) (msgs []string) {
+	if step.Want != nil && smi.Current() != step.Want {
+		msgs = append(msgs, fmt.Sprintf("current state: want %s, got %s", step.Want, name(smi.Current())))
+	}
+	if step.Terminated && smi.Current() != nil {
+		msgs = append(msgs, fmt.Sprintf("want terminated, got %s", smi.Current()))
+	}
+	if step.WantActive != nil {
+		var active []string
+		for _, s := range smi.Configuration() {
+			active = append(active, s.Path())
+		}
+		if !equal(step.WantActive, active) {
+			msgs = append(msgs, fmt.Sprintf("active states: want %v, got %v", step.WantActive, active))
+		}
+	}
+	if step.WantTrace != nil {
+		if got := rec.Lines(Sequence...); !equal(step.WantTrace, got) {
+			msgs = append(msgs, "sequence (- want, + got):\n"+Diff(step.WantTrace, got))
+		}
+	}
+	return msgs
+}
+
+// Diff returns a line-by-line difference between the lists of lines want and got,
+// with lines only in want prefixed by "- ", lines only in got prefixed by "+ ", and common lines by "  ".
+func Diff(want, got []string) string {
+	// lcs[i][j] is the length of the longest common subsequence of want[i:] and got[j:]
+	lcs := make([][]int, len(want)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(got)+1)
+	}
+	for i := len(want) - 1; i >= 0; i-- {
+		for j := len(got) - 1; j >= 0; j-- {
+			if want[i] == got[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var bld strings.Builder
+	i, j := 0, 0
+	for i < len(want) || j < len(got) {
+		switch {
+		case i < len(want) && j < len(got) && want[i] == got[j]:
+			bld.WriteString("  " + want[i] + "\n")
+			i++
+			j++
+		case j == len(got) || i < len(want) && lcs[i+1][j] >= lcs[i][j+1]:
+			bld.WriteString("- " + want[i] + "\n")
+			i++
+		default:
+			bld.WriteString("+ " + got[j] + "\n")
+			j++
+		}
+	}
+	return strings.TrimSuffix(bld.String(), "\n")
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func indent(lines []string) string {
+	return "  " + strings.Join(lines, "\n  ")
+}
+
+func prefix(name string) string {
+	if name == "" {
+		return ""
+	}
+	return name + ": "
+}
+
+func name[E any](s *hsm.State[E]) string {
+	if s == nil {
+		return "none (terminated)"
+	}
+	return s.Name()
+}
@@ -0,0 +1,149 @@
+package hsm
+
+import (
+	"time"
+)
+
+// TriggerKind specifies what triggers a transition.
+type TriggerKind int
+
+const (
+	TriggerEvent      TriggerKind = iota // event with the matching id
+	TriggerCompletion                    // completion of the source state, or a branch of a pseudostate
+	TriggerAfter                         // time event, relative to entering the source state
+	TriggerAt                            // time event, at an absolute time
+)
+
+func (k TriggerKind) String() string {
+	switch k {
+	case TriggerEvent:
+		return "event"
+	case TriggerCompletion:
+		return "completion"
+	case TriggerAfter:
+		return "after"
+	case TriggerAt:
+		return "at"
+	}
+	return "unknown"
+}
+
+// TransitionInfo describes a transition, as returned by [State.Transitions].
+// Target is nil for transitions terminating the state machine.
+// Guard and Action are the (combined) names given to the guards and actions of the transition;
+// since names are optional, use Guarded to find whether the transition has a guard.
+type TransitionInfo[E any] struct {
+	Trigger  TriggerKind
+	EventId  int           // for TriggerEvent
+	After    time.Duration // for TriggerAfter
+	At       time.Time     // for TriggerAt
+	Target   *State[E]
+	Guarded  bool
+	Guard    string
+	Action   string
+	Internal bool
+	Local    bool
+	History  History
+}
+
+// Top returns the implicit top state of the state machine, the parent of all the top-level states.
+// Top state can not be the source or target of transitions.
+func (sm *StateMachine[E]) Top() *State[E] {
+	sm.top.sm = sm
+	sm.top.name = "machine"
+	return &sm.top
+}
+
+// Walk calls f for every state of the state machine, including pseudostates and regions,
+// in document order: depth first, with states visited before their sub-states,
+// and sub-states visited in the order in which they were created.
+// The top state is not included.
+func (sm *StateMachine[E]) Walk(f func(s *State[E])) {
+	var walk func(s *State[E])
+	walk = func(s *State[E]) {
+		for _, s1 := range s.children {
+			f(s1)
+			walk(s1)
+		}
+	}
+	walk(&sm.top)
+}
+
+// Parent returns the parent state of the state, which is the top state for the top-level states,
+// and nil for the top state itself.
+func (s *State[E]) Parent() *State[E] {
+	return s.parent
+}
+
+// Children returns the sub-states of the state, or its regions for a state with orthogonal regions.
+func (s *State[E]) Children() []*State[E] {
+	return append([]*State[E](nil), s.children...)
+}
+
+// InitialChild returns the initial sub-state of the state, or nil if there's none,
+// as is the case with leaf states and states with orthogonal regions.
+func (s *State[E]) InitialChild() *State[E] {
+	return s.initial
+}
+
+// IsOrthogonal returns whether the state is composed of orthogonal regions.
+func (s *State[E]) IsOrthogonal() bool {
+	return s.isOrthogonal()
+}
+
+// IsChoice returns whether the state is a choice pseudostate.
+func (s *State[E]) IsChoice() bool {
+	return s.pseudo == pseudoChoice
+}
+
+// IsJunction returns whether the state is a junction pseudostate.
+func (s *State[E]) IsJunction() bool {
+	return s.pseudo == pseudoJunction
+}
+
+// EntryName returns the (combined) name of the entry actions of the state.
+func (s *State[E]) EntryName() string {
+	return s.entryName
+}
+
+// ExitName returns the (combined) name of the exit actions of the state.
+func (s *State[E]) ExitName() string {
+	return s.exitName
+}
+
+// Deferred returns the ids of the events deferred in the state.
+func (s *State[E]) Deferred() []int {
+	return append([]int(nil), s.deferred...)
+}
+
+// History returns the types of history transitions into the state.
+// It is only known once the state machine is finalized.
+func (s *State[E]) History() History {
+	return s.history
+}
+
+// Transitions returns the outgoing transitions of the state, in the order in which they were defined.
+func (s *State[E]) Transitions() []TransitionInfo[E] {
+	infos := make([]TransitionInfo[E], len(s.transitions))
+	for i, t := range s.transitions {
+		infos[i] = TransitionInfo[E]{
+			Trigger:  TriggerKind(t.trigger), // trigger values match TriggerKind
+			After:    t.after,
+			At:       t.at,
+			Target:   t.target,
+			Guarded:  t.guard != nil,
+			Guard:    t.guardName,
+			Action:   t.actionName,
+			Internal: t.internal,
+			Local:    t.local,
+			History:  t.history,
+		}
+		if t.trigger == triggerEvent {
+			infos[i].EventId = t.eventId
+		}
+		if t.target == &s.sm.terminal {
+			infos[i].Target = nil
+		}
+	}
+	return infos
+}
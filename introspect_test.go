@@ -0,0 +1,70 @@
+package hsm_test
+
+import (
+	"github.com/dragomit/hsm"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestIntrospection(t *testing.T) {
+	sm := hsm.StateMachine[struct{}]{}
+	nop := func(hsm.Event, struct{}) {}
+	yes := func(hsm.Event, struct{}) bool { return true }
+
+	idle := sm.State("Idle").Initial().Build()
+	busy := sm.State("Busy").Entry("start", nop).Exit("stop", nop).Defer(evPause).Build()
+	working := busy.State("Working").Initial().Build()
+	waiting := busy.State("Waiting").Build()
+	on := sm.State("On").Build()
+	r1 := on.Region("r1")
+	r1.State("x").Initial().Build()
+	c := sm.Choice("c")
+
+	idle.Transition(evNewData, busy).Guard("valid", yes).Action("store", nop).Action("log", nop).Build()
+	idle.AddTransition(evAborted, nil)
+	working.Transition(evNewData, working).Internal().Build()
+	working.Transition(evSucceeded, busy).Local(true).Guard("", yes).Build()
+	waiting.After(time.Second, working).Build()
+	idle.Transition(evResume, busy).History(hsm.HistoryDeep).Build()
+	idle.AddTransition(evFailed, c)
+	c.Completion(idle).Build()
+	sm.Finalize()
+
+	top := sm.Top()
+	assert.Nil(t, top.Parent())
+	assert.Equal(t, []*hsm.State[struct{}]{idle, busy, on, c}, top.Children())
+	assert.Equal(t, idle, top.InitialChild())
+	assert.Equal(t, top, idle.Parent())
+	assert.Equal(t, busy, working.Parent())
+	assert.Equal(t, working, busy.InitialChild())
+	assert.Nil(t, on.InitialChild())
+	assert.True(t, on.IsOrthogonal())
+	assert.True(t, r1.IsRegion())
+	assert.True(t, c.IsChoice())
+	assert.False(t, c.IsJunction())
+	assert.Equal(t, "start", busy.EntryName())
+	assert.Equal(t, "stop", busy.ExitName())
+	assert.Equal(t, []int{evPause}, busy.Deferred())
+	assert.Equal(t, hsm.HistoryDeep, busy.History())
+	assert.Equal(t, hsm.HistoryNone, idle.History())
+
+	assert.Equal(t, []hsm.TransitionInfo[struct{}]{
+		{Trigger: hsm.TriggerEvent, EventId: evNewData, Target: busy, Guarded: true, Guard: "valid", Action: "store;log"},
+		{Trigger: hsm.TriggerEvent, EventId: evAborted},
+		{Trigger: hsm.TriggerEvent, EventId: evResume, Target: busy, History: hsm.HistoryDeep},
+		{Trigger: hsm.TriggerEvent, EventId: evFailed, Target: c},
+	}, idle.Transitions())
+	assert.Equal(t, []hsm.TransitionInfo[struct{}]{
+		{Trigger: hsm.TriggerEvent, EventId: evNewData, Target: working, Internal: true},
+		{Trigger: hsm.TriggerEvent, EventId: evSucceeded, Target: busy, Guarded: true, Local: true},
+	}, working.Transitions())
+	assert.Equal(t, []hsm.TransitionInfo[struct{}]{
+		{Trigger: hsm.TriggerAfter, After: time.Second, Target: working},
+	}, waiting.Transitions())
+	assert.Equal(t, hsm.TriggerCompletion, c.Transitions()[0].Trigger)
+
+	var names []string
+	sm.Walk(func(s *hsm.State[struct{}]) { names = append(names, s.Name()) })
+	assert.Equal(t, []string{"Idle", "Busy", "Working", "Waiting", "On", "r1", "x", "c"}, names)
+}
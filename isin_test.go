@@ -0,0 +1,81 @@
+package hsm_test
+
+import (
+	"fmt"
+	"github.com/dragomit/hsm"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestIsIn(t *testing.T) {
+	const (
+		evGo = iota
+		evStop
+	)
+	sm := hsm.StateMachine[struct{}]{}
+	var a, a1, b, b1 *hsm.State[struct{}]
+	var trace []string
+	// probe records which of the states are active, as seen by an action or guard
+	probe := func(label string) func(*hsm.Context[struct{}], hsm.Event, struct{}) {
+		return func(ctx *hsm.Context[struct{}], _ hsm.Event, _ struct{}) {
+			trace = append(trace, fmt.Sprintf("%s: a=%t a1=%t b=%t b1=%t %v",
+				label, ctx.IsIn(a), ctx.IsIn(a1), ctx.IsIn(b), ctx.IsIn(b1), ctx.ActivePath()))
+		}
+	}
+	a = sm.State("a").Initial().EntryCtx("enter a", probe("enter a")).ExitCtx("exit a", probe("exit a")).Build()
+	a1 = a.State("a1").Initial().ExitCtx("exit a1", probe("exit a1")).Build()
+	b = sm.State("b").EntryCtx("enter b", probe("enter b")).Build()
+	b1 = b.State("b1").Initial().EntryCtx("enter b1", probe("enter b1")).Build()
+	a1.Transition(evGo, b).
+		GuardCtx("guard", func(ctx *hsm.Context[struct{}], e hsm.Event, ext struct{}) bool {
+			probe("guard")(ctx, e, ext)
+			return true
+		}).
+		ActionCtx("action", probe("action")).Build()
+	b.AddTransition(evStop, nil)
+	sm.Finalize()
+
+	smi := hsm.StateMachineInstance[struct{}]{SM: &sm}
+	assert.False(t, smi.IsIn(a))
+	smi.Initialize(hsm.Event{})
+	assert.True(t, smi.IsIn(a))
+	assert.True(t, smi.IsIn(a1))
+	assert.False(t, smi.IsIn(b))
+	assert.Equal(t, []*hsm.State[struct{}]{a1, a}, smi.ActivePath())
+
+	smi.Deliver(hsm.Event{Id: evGo})
+	assert.Equal(t, []string{
+		"enter a: a=true a1=false b=false b1=false [a]",
+		"guard: a=true a1=true b=false b1=false [a1 a]",
+		"exit a1: a=true a1=true b=false b1=false [a1 a]",
+		"exit a: a=true a1=false b=false b1=false [a]",
+		"action: a=false a1=false b=false b1=false []",
+		"enter b: a=false a1=false b=true b1=false [b]",
+		"enter b1: a=false a1=false b=true b1=true [b1 b]",
+	}, trace)
+	assert.Equal(t, []*hsm.State[struct{}]{b1, b}, smi.ActivePath())
+
+	smi.Deliver(hsm.Event{Id: evStop})
+	assert.False(t, smi.IsIn(b))
+	assert.False(t, smi.IsIn(sm.Top()))
+	assert.Nil(t, smi.ActivePath())
+}
+
+func TestIsInRegions(t *testing.T) {
+	sm := hsm.StateMachine[struct{}]{}
+	on := sm.State("on").Initial().Build()
+	r1 := on.Region("r1")
+	x := r1.State("x").Initial().Build()
+	r2 := on.Region("r2")
+	y := r2.State("y").Initial().Build()
+	z := r2.State("z").Build()
+	sm.Finalize()
+
+	smi := hsm.StateMachineInstance[struct{}]{SM: &sm}
+	smi.Initialize(hsm.Event{})
+	assert.True(t, smi.IsIn(x))
+	assert.True(t, smi.IsIn(y))
+	assert.True(t, smi.IsIn(r2))
+	assert.False(t, smi.IsIn(z))
+	assert.Equal(t, []*hsm.State[struct{}]{x, r1, on}, smi.ActivePath())
+}
@@ -0,0 +1,106 @@
+package hsm
+
+import (
+	"fmt"
+)
+
+// Lint looks for transitions that can never fire, which are likely to be mistakes,
+// although the structure of the state machine is valid. Each of the returned errors is a [*StructureError]:
+//
+//   - KindDuplicate: transition identical to an earlier transition of the same state,
+//     triggered the same way, with the same target, the same guard and action names, and of the same type.
+//   - KindShadowed: transition shadowed by an earlier unguarded transition of the same state,
+//     triggered by the same event (or both being completion transitions).
+//   - KindOverridden: transition of a composite state, triggered by an event which every one of its
+//     leaf sub-states handles itself, either by an unguarded transition or by deferring it,
+//     since transitions of sub-states take precedence over those of their super-states.
+//
+// Lint can be used before or after finalizing the state machine.
+// To have Finalize and FinalizeE report these problems as well, set [StateMachine.Strict] before finalizing.
+func (sm *StateMachine[E]) Lint() []error {
+	return sm.lint().Unwrap()
+}
+
+// lint collects the problems reported by Lint.
+func (sm *StateMachine[E]) lint() StructureErrors {
+	sm.terminal.name = "terminal state"
+	var errs StructureErrors
+	sm.Walk(func(s *State[E]) {
+		shadowedBy := make(map[int]int)
+		for _, st := range s.shadowed() {
+			shadowedBy[st.Index] = st.By
+		}
+		for i, t := range s.transitions {
+			dup := -1
+			for j, t1 := range s.transitions[:i] {
+				if t.identical(t1) {
+					dup = j
+					break
+				}
+			}
+			if dup >= 0 {
+				errs = append(errs, &StructureError{Kind: KindDuplicate, State: s.name, Target: t.target.name,
+					Msg: fmt.Sprintf("%s (transition %d of %s) is identical to transition %d", t.describe(s), i, s.name, dup)})
+			} else if j, ok := shadowedBy[i]; ok {
+				errs = append(errs, &StructureError{Kind: KindShadowed, State: s.name, Target: t.target.name,
+					Msg: fmt.Sprintf("%s (transition %d of %s) is shadowed by transition %d", t.describe(s), i, s.name, j)})
+			}
+			if t.trigger == triggerEvent && s.overriddenBelow(t.eventId) {
+				errs = append(errs, &StructureError{Kind: KindOverridden, State: s.name, Target: t.target.name,
+					Msg: fmt.Sprintf("%s (transition %d of %s) is overridden by all the sub-states of %s",
+						t.describe(s), i, s.name, s.name)})
+			}
+		}
+	})
+	return errs
+}
+
+// describe describes the transition from state src, for use in messages.
+func (t *transition[E]) describe(src *State[E]) string {
+	switch t.trigger {
+	case triggerCompletion:
+		return fmt.Sprintf("completion transition %s --> %s", src.name, t.target.name)
+	case triggerEvent:
+		return fmt.Sprintf("transition for event %d, %s --> %s", t.eventId, src.name, t.target.name)
+	}
+	return fmt.Sprintf("time transition %s, %s --> %s", t.String(), src.name, t.target.name)
+}
+
+// identical returns whether the two transitions are indistinguishable.
+// Guards are only known to be the same if they have the same non-empty name, and no implicit guards.
+func (t *transition[E]) identical(t1 *transition[E]) bool {
+	return t.trigger == t1.trigger && t.eventId == t1.eventId && t.after == t1.after && t.at.Equal(t1.at) &&
+		t.target == t1.target && t.internal == t1.internal && t.local == t1.local && t.history == t1.history &&
+		(t.guard == nil) == (t1.guard == nil) && (t.guard == nil || t.guardName != "" && t.guardName == t1.guardName && !t.guardHidden && !t1.guardHidden) &&
+		(t.action == nil) == (t1.action == nil) && t.actionName == t1.actionName
+}
+
+// overriddenBelow returns whether the event is handled by every leaf state nested within composite state s,
+// before reaching s.
+func (s *State[E]) overriddenBelow(eventId int) bool {
+	if s.IsLeaf() {
+		return false
+	}
+	found := false
+	for _, c := range s.children {
+		if c.pseudo != pseudoNone {
+			continue // pseudostates are never active
+		}
+		if !c.handles(eventId) {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+// handles returns whether the event is handled by state s, or else by every leaf state nested within s, before reaching s.
+// The event is handled by an unguarded transition, or by deferring it.
+func (s *State[E]) handles(eventId int) bool {
+	for _, t := range s.transitions {
+		if t.trigger == triggerEvent && t.eventId == eventId && t.guard == nil && t.target.pseudo != pseudoJunction {
+			return true
+		}
+	}
+	return s.defers(eventId) || s.overriddenBelow(eventId)
+}
@@ -0,0 +1,69 @@
+package hsm_test
+
+import (
+	"errors"
+	"github.com/dragomit/hsm"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// lintMachine builds a valid state machine with transitions that can never fire
+func lintMachine(strict bool) *hsm.StateMachine[struct{}] {
+	sm := &hsm.StateMachine[struct{}]{Strict: strict}
+	nop := func(hsm.Event, struct{}) {}
+	yes := func(hsm.Event, struct{}) bool { return true }
+
+	idle := sm.State("Idle").Initial().Build()
+	busy := sm.State("Busy").Build()
+	working := busy.State("Working").Initial().Build()
+	waiting := busy.State("Waiting").Defer(evPause).Build()
+	j := busy.Junction("j")
+
+	idle.AddTransition(evNewData, busy)
+	idle.Transition(evNewData, busy).Guard("valid", yes).Build() // shadowed
+	idle.Transition(evFailed, busy).Guard("valid", yes).Action("log", nop).Build()
+	idle.Transition(evFailed, busy).Guard("valid", yes).Action("log", nop).Build() // duplicate
+	idle.Transition(evFailed, busy).Guard("", yes).Build()
+	idle.Transition(evFailed, busy).Guard("", yes).Build() // guards with no names may differ
+	idle.After(time.Second, busy).Build()
+	idle.After(time.Second, busy).Build() // duplicate
+	working.AddTransition(evPause, idle)
+	busy.AddTransition(evPause, idle) // overridden, since Working handles it and Waiting defers it
+	working.AddTransition(evSucceeded, idle)
+	waiting.Transition(evSucceeded, idle).Guard("valid", yes).Build()
+	busy.AddTransition(evSucceeded, idle) // not overridden, since Waiting's transition is guarded
+	working.AddTransition(evAborted, j)
+	j.Completion(idle).Build()
+	j.Completion(busy).Build() // shadowed
+	return sm
+}
+
+func TestLint(t *testing.T) {
+	sm := lintMachine(false)
+	wants := []string{
+		"transition for event 0, Idle --> Busy (transition 1 of Idle) is shadowed by transition 0",
+		"transition for event 4, Idle --> Busy (transition 3 of Idle) is identical to transition 2",
+		"time transition after(1s), Idle --> Busy (transition 7 of Idle) is identical to transition 6",
+		"transition for event 2, Busy --> Idle (transition 0 of Busy) is overridden by all the sub-states of Busy",
+		"completion transition j --> Busy (transition 1 of j) is shadowed by transition 0",
+	}
+	var msgs []string
+	for _, err := range sm.Lint() {
+		msgs = append(msgs, err.Error())
+	}
+	assert.Equal(t, wants, msgs)
+
+	var se *hsm.StructureError
+	assert.True(t, errors.As(sm.Lint()[3], &se))
+	assert.Equal(t, hsm.KindOverridden, se.Kind)
+	assert.Equal(t, "Busy", se.State)
+	assert.Equal(t, "Idle", se.Target)
+
+	// lint problems are not errors unless the state machine is strict
+	assert.NoError(t, sm.FinalizeE())
+	sm = lintMachine(true)
+	err := sm.FinalizeE()
+	assert.EqualError(t, err, wants[0]+"\n"+wants[1]+"\n"+wants[2]+"\n"+wants[3]+"\n"+wants[4])
+	assert.PanicsWithValue(t, wants[0], func() { lintMachine(true).Finalize() })
+}
@@ -0,0 +1,69 @@
+package hsm_test
+
+import (
+	"github.com/dragomit/hsm"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMermaid(t *testing.T) {
+	sm := hsm.StateMachine[struct{}]{}
+	nop := func(hsm.Event, struct{}) {}
+
+	state1 := sm.State("State1").Initial().Build()
+	state2 := sm.State("State2").Entry("start", nop).Exit("stop", nop).Build()
+	state3 := sm.State("State3").Build()
+
+	accEnoughData := state3.State("Accumulate enough data").Initial().Build()
+	accEnoughData.Transition(evNewData, accEnoughData).Internal().Action("store", nop).Build()
+	processData := state3.State("Process data").Build()
+	accEnoughData.AddTransition(evEnoughData, processData)
+	processData.Transition(evNewData, state3).Local(true).Build()
+
+	state3.AddTransition(evPause, state2)
+	state2.AddTransition(evSucceeded, state3)
+	state2.Transition(evResume, state3).History(hsm.HistoryShallow).Build()
+	state2.Transition(evDeepResume, state3).History(hsm.HistoryDeep).Build()
+	state1.AddTransition(evSucceeded, state2)
+	state1.AddTransition(evAborted, nil)
+	state3.AddTransition(evAborted, nil)
+	state3.Transition(evSucceeded, nil).Action("Save Result", nop).Build()
+
+	sm.Finalize()
+
+	names := []string{"New data", "Enough data", "Pause", "Succeeded", "Failed", "Resume", "Deep resume", "Aborted"}
+	evNameMapper := func(ev int) string { return names[ev] }
+
+	wantsDiagram := `stateDiagram-v2
+state State1
+[*] --> State1
+state State2
+State2 : entry / start
+State2 : exit / stop
+state State3 {
+   state "H" as State3_H
+   state "H*" as State3_Hx
+   state "Accumulate enough data" as Accumulate_enough_data
+   [*] --> Accumulate_enough_data
+   Accumulate_enough_data : New data / store
+   state "Process data" as Process_data
+   Process_data --> State3 : New data
+}
+State1 --> State2 : Succeeded
+State1 --> [*] : Aborted
+State2 --> State3 : Succeeded
+State2 --> State3_H : Resume
+State2 --> State3_Hx : Deep resume
+Accumulate_enough_data --> Process_data : Enough data
+State3 --> State2 : Pause
+State3 --> [*] : Aborted<br>Succeeded / Save Result
+`
+	assert.Equal(t, wantsDiagram, sm.DiagramMermaid(evNameMapper))
+
+	// arrow styles are ignored, while labels can be customized for both PlantUML and Mermaid
+	db := sm.DiagramBuilder(evNameMapper).DefaultArrow("->").Label(state3, nil, "Done")
+	assert.Contains(t, db.BuildMermaid(), "State1 --> State2 : Succeeded\n")
+	assert.Contains(t, db.BuildMermaid(), "State3 --> [*] : Done\n")
+	assert.Contains(t, db.Build(), "State1 -> State2 : Succeeded\n")
+	assert.Contains(t, db.Build(), "State3 -> [*] : Done\n")
+}
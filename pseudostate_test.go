@@ -0,0 +1,241 @@
+package hsm_test
+
+import (
+	"bytes"
+	"github.com/dragomit/hsm"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestChoice(t *testing.T) {
+	const (
+		evMeasure = iota
+		evBack
+	)
+
+	type sensor struct {
+		value int
+	}
+
+	var buf bytes.Buffer
+	makeA := func(txt string) func(hsm.Event, *sensor) {
+		return func(hsm.Event, *sensor) {
+			buf.WriteString(txt)
+			buf.WriteByte('|')
+		}
+	}
+
+	sm := hsm.StateMachine[*sensor]{}
+	idle := sm.State("Idle").Exit("exit Idle", makeA("exit Idle")).Initial().Build()
+	ranges := sm.State("Ranges").Entry("enter Ranges", makeA("enter Ranges")).Exit("exit Ranges", makeA("exit Ranges")).Build()
+	low := ranges.State("Low").Entry("enter Low", makeA("enter Low")).Build()
+	high := ranges.State("High").Entry("enter High", makeA("enter High")).Initial().Build()
+	alarm := sm.State("Alarm").Entry("enter Alarm", makeA("enter Alarm")).Build()
+
+	check := ranges.Choice("check")
+	// the guards are evaluated only after the transition action has updated the measured value
+	idle.Transition(evMeasure, check).Action("measure", func(e hsm.Event, s *sensor) {
+		s.value = e.Data.(int)
+		makeA("measure")(e, s)
+	}).Build()
+	check.Completion(alarm).Guard("value > 100", func(_ hsm.Event, s *sensor) bool { return s.value > 100 }).
+		Action("raise", makeA("raise")).Build()
+	check.Completion(low).Guard("value < 10", func(_ hsm.Event, s *sensor) bool { return s.value < 10 }).Build()
+	check.Completion(high).Build()
+	ranges.AddTransition(evBack, idle)
+	alarm.AddTransition(evBack, idle)
+
+	sm.Finalize()
+
+	tests := []struct {
+		name    string
+		value   int
+		actions string
+		state   *hsm.State[*sensor]
+	}{
+		{
+			name:    "low",
+			value:   5,
+			actions: "exit Idle|measure|enter Ranges|enter Low|",
+			state:   low,
+		},
+		{
+			name:    "high",
+			value:   50,
+			actions: "exit Idle|measure|enter Ranges|enter High|",
+			state:   high,
+		},
+		{
+			name:    "alarm",
+			value:   500,
+			actions: "exit Idle|measure|raise|enter Alarm|",
+			state:   alarm,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			smi := hsm.StateMachineInstance[*sensor]{SM: &sm, Ext: &sensor{}}
+			smi.Initialize(hsm.Event{})
+			buf.Reset()
+			handled, src := smi.Deliver(hsm.Event{Id: evMeasure, Data: test.value})
+			assert.True(t, handled)
+			assert.Equal(t, idle, src)
+			assert.Equal(t, test.state, smi.Current())
+			assert.Equal(t, test.actions, buf.String())
+		})
+	}
+
+	wantsDiagram := `@startuml
+
+state Idle
+Idle : exit / exit Idle
+[*] --> Idle
+state Ranges {
+   state Low
+   Low : entry / enter Low
+   state High
+   High : entry / enter High
+   [*] --> High
+   state check <<choice>>
+}
+Ranges : entry / enter Ranges
+Ranges : exit / exit Ranges
+state Alarm
+Alarm : entry / enter Alarm
+Idle --> check : measure / measure
+check --> Alarm : [value > 100] / raise
+check --> Low : [value < 10]
+check --> High
+Ranges --> Idle : back
+Alarm --> Idle : back
+
+@enduml
+`
+	assert.Equal(t, wantsDiagram, sm.DiagramPUML(func(ev int) string { return []string{"measure", "back"}[ev] }))
+}
+
+func TestChoiceLeavingContainer(t *testing.T) {
+	const evGo = 0
+	var buf bytes.Buffer
+	makeA := func(txt string) func(hsm.Event, struct{}) {
+		return func(hsm.Event, struct{}) {
+			buf.WriteString(txt)
+			buf.WriteByte('|')
+		}
+	}
+
+	sm := hsm.StateMachine[struct{}]{}
+	outer := sm.State("outer").Exit("exit outer", makeA("exit outer")).Initial().Build()
+	inner := outer.State("inner").Exit("exit inner", makeA("exit inner")).Initial().Build()
+	other := sm.State("other").Entry("enter other", makeA("enter other")).Build()
+	c := outer.Choice("c")
+	inner.Transition(evGo, c).Action("go", makeA("go")).Build()
+	c.Completion(other).Action("leave", makeA("leave")).Build()
+	sm.Finalize()
+
+	smi := hsm.StateMachineInstance[struct{}]{SM: &sm}
+	smi.Initialize(hsm.Event{})
+	smi.Deliver(hsm.Event{Id: evGo})
+	assert.Equal(t, other, smi.Current())
+	// outer is exited only after the choice selects the branch leading outside of it
+	assert.Equal(t, "exit inner|go|exit outer|leave|enter other|", buf.String())
+}
+
+func TestJunction(t *testing.T) {
+	const (
+		evGo = iota
+	)
+
+	type ext struct {
+		a, b bool
+	}
+
+	var buf bytes.Buffer
+	makeA := func(txt string) func(hsm.Event, *ext) {
+		return func(hsm.Event, *ext) {
+			buf.WriteString(txt)
+			buf.WriteByte('|')
+		}
+	}
+	isA := func(_ hsm.Event, x *ext) bool { return x.a }
+	isB := func(_ hsm.Event, x *ext) bool { return x.b }
+
+	sm := hsm.StateMachine[*ext]{}
+	parent := sm.State("parent").Exit("exit parent", makeA("exit parent")).Initial().Build()
+	start := parent.State("start").Exit("exit start", makeA("exit start")).Initial().Build()
+	target1 := sm.State("target1").Entry("enter target1", makeA("enter target1")).Build()
+	target2 := sm.State("target2").Entry("enter target2", makeA("enter target2")).Build()
+	fallback := sm.State("fallback").Entry("enter fallback", makeA("enter fallback")).Build()
+
+	j1 := sm.Junction("j1")
+	j2 := sm.Junction("j2")
+	start.Transition(evGo, j1).Action("t0", makeA("t0")).Build()
+	// first branch leads to a junction without enabled branches, so we backtrack
+	j1.Completion(j2).Guard("a", isA).Action("t1", makeA("t1")).Build()
+	j1.Completion(target2).Guard("b", isB).Action("t2", makeA("t2")).Build()
+	j2.Completion(target1).Guard("b", isB).Action("t3", makeA("t3")).Build()
+	// used only when the junction path is not enabled
+	parent.AddTransition(evGo, fallback)
+	sm.Finalize()
+
+	tests := []struct {
+		name    string
+		x       ext
+		actions string
+		state   *hsm.State[*ext]
+	}{
+		{
+			name:    "both",
+			x:       ext{a: true, b: true},
+			actions: "exit start|exit parent|t0|t1|t3|enter target1|",
+			state:   target1,
+		},
+		{
+			name:    "backtrack",
+			x:       ext{a: true},
+			actions: "exit start|exit parent|enter fallback|",
+			state:   fallback,
+		},
+		{
+			name:    "b only",
+			x:       ext{b: true},
+			actions: "exit start|exit parent|t0|t2|enter target2|",
+			state:   target2,
+		},
+		{
+			name:    "not enabled",
+			actions: "exit start|exit parent|enter fallback|",
+			state:   fallback,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			x := test.x
+			smi := hsm.StateMachineInstance[*ext]{SM: &sm, Ext: &x}
+			smi.Initialize(hsm.Event{})
+			buf.Reset()
+			smi.Deliver(hsm.Event{Id: evGo})
+			assert.Equal(t, test.state, smi.Current())
+			assert.Equal(t, test.actions, buf.String())
+		})
+	}
+}
+
+func TestPanicPseudostates(t *testing.T) {
+	sm := hsm.StateMachine[struct{}]{}
+	sm.State("a").Initial().Build()
+	c := sm.Choice("c")
+	assert.PanicsWithValue(t, "choice c can only have completion transitions", func() { c.Transition(0, c) })
+	assert.PanicsWithValue(t, "choice c must have at least one outgoing branch", sm.Finalize)
+
+	sm = hsm.StateMachine[struct{}]{}
+	a := sm.State("a").Initial().Build()
+	j1 := sm.Junction("j1")
+	j2 := sm.Junction("j2")
+	a.AddTransition(0, j1)
+	j1.Completion(j2).Build()
+	j2.Completion(j1).Build()
+	assert.PanicsWithValue(t, "junction j1 is part of a cycle of junction branches", sm.Finalize)
+}
@@ -0,0 +1,89 @@
+package hsm_test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/dragomit/hsm"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestPostedEvents(t *testing.T) {
+	const (
+		evStart = iota
+		evA
+		evB
+		evUrgent
+		evStop
+	)
+
+	var buf bytes.Buffer
+	log := func(e hsm.Event, _ struct{}) {
+		fmt.Fprintf(&buf, "ev%d|", e.Id)
+	}
+
+	sm := hsm.StateMachine[struct{}]{}
+	idle := sm.State("idle").Initial().Build()
+	busy := sm.State("busy").EntryCtx("post urgent", func(ctx *hsm.Context[struct{}], _ hsm.Event, _ struct{}) {
+		ctx.PostFront(hsm.Event{Id: evUrgent})
+	}).Build()
+
+	idle.Transition(evStart, busy).ActionCtx("post", func(ctx *hsm.Context[struct{}], _ hsm.Event, _ struct{}) {
+		ctx.Post(hsm.Event{Id: evA})
+		ctx.Post(hsm.Event{Id: evB})
+	}).Build()
+	busy.Transition(evA, busy).Internal().Action("log", log).Build()
+	busy.Transition(evB, busy).Internal().Action("log", log).Build()
+	busy.Transition(evUrgent, busy).Internal().Action("log", log).Build()
+	busy.Transition(evStop, nil).ActionCtx("post after stop", func(ctx *hsm.Context[struct{}], _ hsm.Event, _ struct{}) {
+		ctx.Post(hsm.Event{Id: evA})
+	}).Build()
+
+	sm.Finalize()
+
+	smi := hsm.StateMachineInstance[struct{}]{SM: &sm}
+	smi.Initialize(hsm.Event{})
+	handled, src := smi.Deliver(hsm.Event{Id: evStart})
+	assert.True(t, handled)
+	assert.Equal(t, idle, src)
+	assert.Equal(t, busy, smi.Current())
+	// events are processed before Deliver returns, and posted-to-front event goes first
+	assert.Equal(t, fmt.Sprintf("ev%d|ev%d|ev%d|", evUrgent, evA, evB), buf.String())
+
+	buf.Reset()
+	smi.Deliver(hsm.Event{Id: evStop})
+	assert.Nil(t, smi.Current())
+	assert.Equal(t, "", buf.String())
+}
+
+func TestPostOnInitialize(t *testing.T) {
+	const evGo = 0
+	sm := hsm.StateMachine[struct{}]{}
+	a := sm.State("a").Initial().EntryCtx("go", func(ctx *hsm.Context[struct{}], _ hsm.Event, _ struct{}) {
+		ctx.Post(hsm.Event{Id: evGo})
+	}).Build()
+	b := sm.State("b").Build()
+	a.AddTransition(evGo, b)
+	sm.Finalize()
+
+	smi := hsm.StateMachineInstance[struct{}]{SM: &sm}
+	smi.Initialize(hsm.Event{})
+	assert.Equal(t, b, smi.Current())
+}
+
+func TestPanicReentrantDeliver(t *testing.T) {
+	type ext struct {
+		smi *hsm.StateMachineInstance[*ext]
+	}
+	sm := hsm.StateMachine[*ext]{}
+	a := sm.State("a").Initial().Build()
+	a.Transition(0, a).Action("deliver", func(e hsm.Event, x *ext) { x.smi.Deliver(e) }).Build()
+	sm.Finalize()
+
+	x := &ext{}
+	x.smi = &hsm.StateMachineInstance[*ext]{SM: &sm, Ext: x}
+	x.smi.Initialize(hsm.Event{})
+	assert.PanicsWithValue(t,
+		"state machine instance is not reentrant; use Context.Post to deliver events from within actions",
+		func() { x.smi.Deliver(hsm.Event{}) })
+}
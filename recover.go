@@ -0,0 +1,214 @@
+package hsm
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ErrorEvent is the id of the event passed to the actions executed while entering the error state
+// (see [StateMachine.ErrorState]). The Data of the event is the *ActionError describing the failure.
+const ErrorEvent = math.MinInt + 2
+
+// ActionError describes a failed action, returned by [StateMachineInstance.DeliverE].
+// The action is an entry, exit or transition action which returned an error (see [TransitionBuilder.ActionE]),
+// or any action or guard which panicked.
+type ActionError struct {
+	Event Event // event delivered to the instance
+	Err   error // error returned by the action; for panics, the panic value if it's an error, or else describing it
+	Panic any   // value the action panicked with, or nil if the action returned an error
+}
+
+func (e *ActionError) Error() string {
+	if e.Panic != nil {
+		return fmt.Sprintf("event %d: action panicked: %v", e.Event.Id, e.Panic)
+	}
+	return fmt.Sprintf("event %d: action failed: %v", e.Event.Id, e.Err)
+}
+
+func (e *ActionError) Unwrap() error {
+	return e.Err
+}
+
+// actionFailure is the panic value of an action which returned an error.
+type actionFailure struct {
+	err error
+}
+
+func (f actionFailure) Error() string {
+	return f.err.Error()
+}
+
+func (f actionFailure) Unwrap() error {
+	return f.err
+}
+
+func newActionError(e Event, v any) *ActionError {
+	if f, ok := v.(actionFailure); ok {
+		return &ActionError{Event: e, Err: f.err}
+	}
+	err, ok := v.(error)
+	if !ok {
+		err = fmt.Errorf("%v", v)
+	}
+	return &ActionError{Event: e, Err: err, Panic: v}
+}
+
+// checkpoint is the state of an instance before delivering an event, which the instance can be rolled back to.
+// Rather than copying the history, the checkpoint logs the changes made to it while the event is processed.
+type checkpoint[E any] struct {
+	active   []*State[E]
+	history  []historyChange[E]
+	logging  bool // whether changes to the history are logged
+	deferred []Event
+	timers   []armedTimer[E]
+	timerSeq uint64
+}
+
+// historyChange records the history of state parent before it was changed; prev is nil if it had no history.
+type historyChange[E any] struct {
+	parent, prev *State[E]
+}
+
+// DeliverE delivers an event to the state machine, like Deliver,
+// but recovers from failed actions, rather than letting them panic.
+// An action fails by returning an error, if defined using [StateBuilder.EntryE], [StateBuilder.ExitE]
+// or [TransitionBuilder.ActionE], or by panicking. Guards fail by panicking.
+// Failures of any events posted by the actions are handled the same way.
+// Only panics raised by actions and guards are recovered; panics raised by the state machine itself,
+// such as a choice with no enabled branch, or completion transitions which don't settle, propagate.
+//
+// When an action fails, the rest of the transition is abandoned, and DeliverE returns an *ActionError,
+// along with false and nil for handled and src. Then, if the [StateMachine.ErrorState] is not set,
+// the instance is rolled back to its configuration before the event was delivered:
+// active states, history, armed time transitions, and deferred events.
+// Actions executed before the failure are not undone, and the extended state is not rolled back.
+//
+// If the ErrorState is set, the instance instead exits all of its active states, executing their exit actions,
+// and enters the error state, executing the entry actions, as if taking an external transition into it.
+// States whose entry action has started are active, and those whose exit action has failed remain active,
+// so they are exited again. The actions receive an event with id [ErrorEvent], whose Data is the *ActionError.
+// If taking the transition into the error state fails as well, the instance is rolled back,
+// and the returned error joins both failures.
+//
+// Any events posted by the actions of the failed event, and not yet delivered, are discarded.
+func (smi *StateMachineInstance[E]) DeliverE(e Event) (handled bool, src *State[E], err error) {
+	if !smi.initialized {
+		panic("State machine must be initialized before delivering the first event")
+	}
+	smi.begin()
+	defer smi.end()
+	smi.save()
+	defer func() {
+		v := recover()
+		c := &smi.saved
+		if v != nil && smi.user {
+			smi.user = false
+			handled, src, err = false, nil, smi.recoverFrom(e, v)
+		}
+		// don't hold on to the event data
+		for i := range c.deferred {
+			c.deferred[i] = Event{}
+		}
+		c.history = c.history[:0]
+		c.logging = false
+		if v != nil && err == nil {
+			panic(v)
+		}
+	}()
+	handled, src = smi.dispatch(e)
+	smi.drain()
+	return
+}
+
+// recoverFrom handles the failure of an action, while processing event e.
+func (smi *StateMachineInstance[E]) recoverFrom(e Event, v any) error {
+	ae := newActionError(e, v)
+	if smi.SM.ErrorState == nil {
+		smi.rollback()
+		return ae
+	}
+	if err := smi.enterErrorState(ae); err != nil {
+		smi.rollback()
+		return errors.Join(ae, err)
+	}
+	return ae
+}
+
+// enterErrorState exits all the active states and enters the error state, after the failure ae.
+func (smi *StateMachineInstance[E]) enterErrorState(ae *ActionError) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			if !smi.user {
+				panic(v)
+			}
+			smi.user = false
+			err = newActionError(ae.Event, v)
+		}
+	}()
+	smi.discard()
+	e := Event{Id: ErrorEvent, Data: ae}
+	smi.changed = true
+	smi.exitBelow(e, &smi.SM.top)
+	var path []*State[E]
+	for s := smi.SM.ErrorState; s != &smi.SM.top; s = s.parent {
+		path = append(path, s)
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	smi.enterPath(e, &smi.SM.top, path, HistoryNone)
+	smi.complete(e)
+	smi.recall()
+	smi.drain()
+	return nil
+}
+
+// save saves the state of the instance, before delivering an event.
+func (smi *StateMachineInstance[E]) save() {
+	c := &smi.saved
+	c.active = append(c.active[:0], smi.active...)
+	c.deferred = append(c.deferred[:0], smi.deferred...)
+	c.timers = append(c.timers[:0], smi.timers...)
+	c.timerSeq = smi.timerSeq
+	c.history = c.history[:0]
+	c.logging = true
+	smi.user = false
+}
+
+// record records child as the history of state parent, logging the change if it may have to be rolled back.
+func (smi *StateMachineInstance[E]) record(parent, child *State[E]) {
+	if smi.saved.logging {
+		smi.saved.history = append(smi.saved.history, historyChange[E]{parent, smi.history[parent]})
+	}
+	smi.history[parent] = child
+}
+
+// rollback restores the state of the instance saved before delivering the failed event.
+func (smi *StateMachineInstance[E]) rollback() {
+	smi.discard()
+	c := &smi.saved
+	smi.active = append(smi.active[:0], c.active...)
+	smi.deferred = append(smi.deferred[:0], c.deferred...)
+	smi.timers = append(smi.timers[:0], c.timers...)
+	smi.timerSeq = c.timerSeq
+	for i := len(c.history) - 1; i >= 0; i-- {
+		if h := c.history[i]; h.prev == nil {
+			delete(smi.history, h.parent)
+		} else {
+			smi.history[h.parent] = h.prev
+		}
+	}
+	c.history = c.history[:0]
+}
+
+// discard discards the events posted, and the transitions selected, while processing the failed event.
+func (smi *StateMachineInstance[E]) discard() {
+	smi.queue.clear()
+	smi.urgent.clear()
+	smi.recalled.clear()
+	smi.entered = smi.entered[:0]
+	smi.selected = smi.selected[:0]
+	smi.visited = smi.visited[:0]
+	smi.deferring = nil
+}
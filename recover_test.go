@@ -0,0 +1,201 @@
+package hsm_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/dragomit/hsm"
+	"github.com/stretchr/testify/assert"
+)
+
+var errJammed = errors.New("jammed")
+
+type printer struct {
+	log    []string
+	jammed bool
+}
+
+func (p *printer) logA(txt string) func(hsm.Event, *printer) {
+	return func(hsm.Event, *printer) { p.log = append(p.log, txt) }
+}
+
+const (
+	evPrint = iota
+	evCancel
+	evPanic
+)
+
+// printerMachine builds a state machine where printing fails when the printer is jammed
+func printerMachine(p *printer) (sm *hsm.StateMachine[*printer], idle, printing, failed *hsm.State[*printer]) {
+	sm = &hsm.StateMachine[*printer]{}
+	busy := sm.State("busy").Initial().Build()
+	idle = busy.State("idle").Initial().Exit("exit idle", p.logA("exit idle")).Build()
+	printing = busy.State("printing").
+		EntryE("feed", func(hsm.Event, *printer) error {
+			p.log = append(p.log, "feed")
+			if p.jammed {
+				return errJammed
+			}
+			return nil
+		}).Build()
+	failed = sm.State("failed").EntryCtx("report", func(ctx *hsm.Context[*printer], e hsm.Event, p *printer) {
+		p.log = append(p.log, fmt.Sprintf("report %d: %v", e.Id, e.Data))
+	}).Build()
+	idle.Transition(evPrint, printing).ActionCtx("post cancel", func(ctx *hsm.Context[*printer], _ hsm.Event, _ *printer) {
+		ctx.Post(hsm.Event{Id: evCancel})
+	}).Build()
+	idle.Transition(evPanic, idle).Action("panic", func(hsm.Event, *printer) { panic("boom") }).Build()
+	printing.AddTransition(evCancel, idle)
+	return
+}
+
+func TestDeliverERollback(t *testing.T) {
+	p := &printer{jammed: true}
+	sm, idle, _, _ := printerMachine(p)
+	sm.Finalize()
+	smi := hsm.StateMachineInstance[*printer]{SM: sm, Ext: p}
+	smi.Initialize(hsm.Event{})
+
+	handled, src, err := smi.DeliverE(hsm.Event{Id: evPrint})
+	assert.False(t, handled)
+	assert.Nil(t, src)
+	assert.ErrorIs(t, err, errJammed)
+	var ae *hsm.ActionError
+	assert.True(t, errors.As(err, &ae))
+	assert.Equal(t, evPrint, ae.Event.Id)
+	assert.Nil(t, ae.Panic)
+	assert.Equal(t, "event 0: action failed: jammed", err.Error())
+	assert.Equal(t, []string{"exit idle", "feed"}, p.log)
+	// rolled back to idle, and the posted event was discarded
+	assert.Equal(t, idle, smi.Current())
+
+	p.log, p.jammed = nil, false
+	handled, _, err = smi.DeliverE(hsm.Event{Id: evPrint})
+	assert.True(t, handled)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"exit idle", "feed"}, p.log)
+	assert.Equal(t, idle, smi.Current()) // cancelled by the posted event
+}
+
+func TestDeliverEPanic(t *testing.T) {
+	p := &printer{}
+	sm, idle, _, _ := printerMachine(p)
+	sm.Finalize()
+	smi := hsm.StateMachineInstance[*printer]{SM: sm, Ext: p}
+	smi.Initialize(hsm.Event{})
+
+	_, _, err := smi.DeliverE(hsm.Event{Id: evPanic})
+	var ae *hsm.ActionError
+	assert.True(t, errors.As(err, &ae))
+	assert.Equal(t, "boom", ae.Panic)
+	assert.Equal(t, "event 2: action panicked: boom", err.Error())
+	assert.Equal(t, idle, smi.Current())
+
+	// instance is usable after recovering
+	_, _, err = smi.DeliverE(hsm.Event{Id: evPrint})
+	assert.NoError(t, err)
+}
+
+func TestDeliverErrorState(t *testing.T) {
+	p := &printer{jammed: true}
+	sm, _, _, failed := printerMachine(p)
+	sm.ErrorState = failed
+	sm.Finalize()
+	smi := hsm.StateMachineInstance[*printer]{SM: sm, Ext: p}
+	smi.Initialize(hsm.Event{})
+
+	_, _, err := smi.DeliverE(hsm.Event{Id: evPrint})
+	assert.ErrorIs(t, err, errJammed)
+	assert.Equal(t, failed, smi.Current())
+	assert.Equal(t, []string{"exit idle", "feed", fmt.Sprintf("report %d: %v", hsm.ErrorEvent, err)}, p.log)
+}
+
+func TestDeliverErrorStateFails(t *testing.T) {
+	p := &printer{jammed: true}
+	sm, idle, _, _ := printerMachine(p)
+	broken := sm.State("broken").EntryE("fail", func(hsm.Event, *printer) error { return errors.New("broken") }).Build()
+	sm.ErrorState = broken
+	sm.Finalize()
+	smi := hsm.StateMachineInstance[*printer]{SM: sm, Ext: p}
+	smi.Initialize(hsm.Event{})
+
+	_, _, err := smi.DeliverE(hsm.Event{Id: evPrint})
+	assert.ErrorIs(t, err, errJammed)
+	assert.ErrorContains(t, err, "broken")
+	assert.Equal(t, idle, smi.Current())
+}
+
+func TestDeliverFailingAction(t *testing.T) {
+	p := &printer{jammed: true}
+	sm, _, _, _ := printerMachine(p)
+	sm.Finalize()
+	smi := hsm.StateMachineInstance[*printer]{SM: sm, Ext: p}
+	smi.Initialize(hsm.Event{})
+	// without recovery, failed action panics with its error
+	assert.PanicsWithError(t, "jammed", func() { smi.Deliver(hsm.Event{Id: evPrint}) })
+}
+
+func TestInvalidErrorState(t *testing.T) {
+	sm := hsm.StateMachine[struct{}]{CollectErrors: true}
+	sm.State("a").Initial().Build()
+	other := hsm.StateMachine[struct{}]{}
+	sm.ErrorState = other.State("other").Build()
+	err := sm.FinalizeE()
+	var errs hsm.StructureErrors
+	assert.True(t, errors.As(err, &errs))
+	assert.Len(t, errs, 1)
+	assert.Equal(t, hsm.KindInvalidErrorState, errs[0].Kind)
+	assert.Equal(t, "error state other must be a regular state of this state machine", errs[0].Msg)
+}
+
+func TestDeliverERollbackHistory(t *testing.T) {
+	jammed := true
+	sm := hsm.StateMachine[struct{}]{}
+	a := sm.State("A").Initial().Build()
+	a1 := a.State("A1").Initial().Build()
+	a2 := a.State("A2").Build()
+	b := sm.State("B").EntryE("fail", func(hsm.Event, struct{}) error {
+		if jammed {
+			return errJammed
+		}
+		return nil
+	}).Build()
+	a1.AddTransition(evPrint, a2)
+	a.AddTransition(evCancel, b)
+	b.Transition(evPanic, a).History(hsm.HistoryShallow).Build()
+	sm.Finalize()
+	smi := hsm.StateMachineInstance[struct{}]{SM: &sm}
+	smi.Initialize(hsm.Event{})
+
+	_, _, err := smi.DeliverE(hsm.Event{Id: evCancel})
+	assert.ErrorIs(t, err, errJammed)
+	snap, _ := smi.Snapshot()
+	assert.Nil(t, snap.History)
+
+	smi.Deliver(hsm.Event{Id: evPrint})
+	_, _, err = smi.DeliverE(hsm.Event{Id: evCancel})
+	assert.ErrorIs(t, err, errJammed)
+	snap, _ = smi.Snapshot()
+	assert.Equal(t, map[string]string{"A": "A/A1"}, snap.History)
+	assert.Equal(t, a2, smi.Current())
+
+	jammed = false
+	_, _, err = smi.DeliverE(hsm.Event{Id: evCancel})
+	assert.NoError(t, err)
+	smi.Deliver(hsm.Event{Id: evPanic})
+	assert.Equal(t, a2, smi.Current())
+}
+
+func TestDeliverEInvariantPanics(t *testing.T) {
+	sm := hsm.StateMachine[struct{}]{}
+	a := sm.State("a").Initial().Build()
+	c := sm.Choice("c")
+	a.AddTransition(0, c)
+	c.Completion(a).Guard("never", func(hsm.Event, struct{}) bool { return false }).Build()
+	sm.Finalize()
+	smi := hsm.StateMachineInstance[struct{}]{SM: &sm}
+	smi.Initialize(hsm.Event{})
+	// failures of the state machine itself are not recovered as failed actions
+	assert.PanicsWithValue(t, "no enabled branch from choice c", func() { smi.DeliverE(hsm.Event{}) })
+}
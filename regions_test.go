@@ -0,0 +1,198 @@
+package hsm_test
+
+import (
+	"bytes"
+	"github.com/dragomit/hsm"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestOrthogonalRegions(t *testing.T) {
+	const (
+		evConnect = iota
+		evDisconnect
+		evPlug
+		evUnplug
+		evReset
+		evOff
+		evOn
+		evResume
+	)
+
+	var buf bytes.Buffer
+
+	makeA := func(txt string) func(hsm.Event, struct{}) {
+		return func(hsm.Event, struct{}) {
+			buf.WriteString(txt)
+			buf.WriteByte('|')
+		}
+	}
+
+	sm := hsm.StateMachine[struct{}]{}
+	on := sm.State("On").Entry("enter On", makeA("enter On")).Exit("exit On", makeA("exit On")).Initial().Build()
+	off := sm.State("Off").Entry("enter Off", makeA("enter Off")).Exit("exit Off", makeA("exit Off")).Build()
+
+	link := on.Region("link")
+	disconnected := link.State("Disconnected").Entry("enter D", makeA("enter D")).Exit("exit D", makeA("exit D")).Initial().Build()
+	connected := link.State("Connected").Entry("enter C", makeA("enter C")).Exit("exit C", makeA("exit C")).Build()
+
+	power := on.Region("power")
+	idle := power.State("Idle").Entry("enter I", makeA("enter I")).Exit("exit I", makeA("exit I")).Initial().Build()
+	charging := power.State("Charging").Entry("enter Ch", makeA("enter Ch")).Exit("exit Ch", makeA("exit Ch")).Build()
+
+	disconnected.AddTransition(evConnect, connected)
+	connected.AddTransition(evDisconnect, disconnected)
+	idle.AddTransition(evPlug, charging)
+	charging.AddTransition(evUnplug, idle)
+	// handled in both regions at once
+	connected.Transition(evReset, disconnected).Action("reset link", makeA("reset link")).Build()
+	charging.Transition(evReset, idle).Action("reset power", makeA("reset power")).Build()
+	on.Transition(evOff, off).Action("off", makeA("off")).Build()
+	off.AddTransition(evOn, charging)
+	off.Transition(evResume, on).History(hsm.HistoryShallow).Build()
+
+	sm.Finalize()
+
+	tests := []struct {
+		name    string
+		events  []int
+		actions string
+		config  []*hsm.State[struct{}]
+	}{
+		{
+			name:    "initial",
+			actions: "enter On|enter D|enter I|",
+			config:  []*hsm.State[struct{}]{disconnected, idle},
+		},
+		{
+			name:    "independent regions",
+			events:  []int{evConnect, evPlug},
+			actions: "enter On|enter D|enter I|exit D|enter C|exit I|enter Ch|",
+			config:  []*hsm.State[struct{}]{connected, charging},
+		},
+		{
+			name:    "event handled in both regions",
+			events:  []int{evConnect, evPlug, evReset},
+			actions: "enter On|enter D|enter I|exit D|enter C|exit I|enter Ch|exit C|reset link|enter D|exit Ch|reset power|enter I|",
+			config:  []*hsm.State[struct{}]{disconnected, idle},
+		},
+		{
+			name:    "exit all regions",
+			events:  []int{evConnect, evPlug, evOff},
+			actions: "enter On|enter D|enter I|exit D|enter C|exit I|enter Ch|exit Ch|exit C|exit On|off|enter Off|",
+			config:  []*hsm.State[struct{}]{off},
+		},
+		{
+			name:    "enter state within region",
+			events:  []int{evOff, evOn},
+			actions: "enter On|enter D|enter I|exit I|exit D|exit On|off|enter Off|exit Off|enter On|enter D|enter Ch|",
+			config:  []*hsm.State[struct{}]{disconnected, charging},
+		},
+		{
+			name:    "history in regions",
+			events:  []int{evConnect, evOff, evResume},
+			actions: "enter On|enter D|enter I|exit D|enter C|exit I|exit C|exit On|off|enter Off|exit Off|enter On|enter C|enter I|",
+			config:  []*hsm.State[struct{}]{connected, idle},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			smi := hsm.StateMachineInstance[struct{}]{SM: &sm}
+			buf.Reset()
+			smi.Initialize(hsm.Event{Id: -1})
+			for _, ev := range test.events {
+				smi.Deliver(hsm.Event{Id: ev})
+			}
+			assert.Equal(t, test.actions, buf.String())
+			assert.Equal(t, test.config, smi.Configuration())
+			assert.Equal(t, test.config[0], smi.Current())
+		})
+	}
+
+	wantsDiagram := `@startuml
+
+state On {
+   state Disconnected
+   Disconnected : entry / enter D
+   Disconnected : exit / exit D
+   [*] --> Disconnected
+   state Connected
+   Connected : entry / enter C
+   Connected : exit / exit C
+   --
+   state Idle
+   Idle : entry / enter I
+   Idle : exit / exit I
+   [*] --> Idle
+   state Charging
+   Charging : entry / enter Ch
+   Charging : exit / exit Ch
+}
+On : entry / enter On
+On : exit / exit On
+[*] --> On
+state Off
+Off : entry / enter Off
+Off : exit / exit Off
+Disconnected --> Connected : connect
+Connected --> Disconnected : disconnect\nreset / reset link
+Idle --> Charging : plug
+Charging --> Idle : unplug\nreset / reset power
+On --> Off : off / off
+Off --> Charging : on
+Off --> On[H] : resume
+
+@enduml
+`
+	names := []string{"connect", "disconnect", "plug", "unplug", "reset", "off", "on", "resume"}
+	assert.Equal(t, wantsDiagram, sm.DiagramPUML(func(ev int) string { return names[ev] }))
+}
+
+func TestRegionTransitionToAncestor(t *testing.T) {
+	const (
+		evX = iota
+		evY
+	)
+	sm := hsm.StateMachine[struct{}]{}
+	top := sm.State("top").Initial().Build()
+	r1 := top.Region("r1")
+	a1 := r1.State("a1").Initial().Build()
+	a2 := r1.State("a2").Build()
+	r2 := top.Region("r2")
+	b1 := r2.State("b1").Initial().Build()
+	b2 := r2.State("b2").Build()
+
+	a1.AddTransition(evX, a2)
+	// conflicts with a1 --> a2, and loses since its source is not nested as deeply
+	top.AddTransition(evX, top)
+	b1.AddTransition(evY, b2)
+	// conflicts with b1 --> b2, and wins, since it is defined in a deeper state
+	a1.AddTransition(evY, top)
+	sm.Finalize()
+
+	smi := hsm.StateMachineInstance[struct{}]{SM: &sm}
+	smi.Initialize(hsm.Event{})
+	handled, src := smi.Deliver(hsm.Event{Id: evX})
+	assert.True(t, handled)
+	assert.Equal(t, a1, src)
+	assert.Equal(t, []*hsm.State[struct{}]{a2, b1}, smi.Configuration())
+
+	smi.Initialize(hsm.Event{})
+	handled, src = smi.Deliver(hsm.Event{Id: evY})
+	assert.True(t, handled)
+	assert.Equal(t, a1, src)
+	assert.Equal(t, []*hsm.State[struct{}]{a1, b1}, smi.Configuration())
+}
+
+func TestPanicRegions(t *testing.T) {
+	sm := hsm.StateMachine[struct{}]{}
+	foo := sm.State("foo").Initial().Build()
+	r := foo.Region("r")
+	r.State("bar").Build()
+	assert.PanicsWithValue(t, "state foo has orthogonal regions; sub-states must be created within a region",
+		func() { foo.State("baz") })
+	assert.PanicsWithValue(t, "Transition foo -> r can not involve orthogonal region",
+		func() { foo.Transition(0, r) })
+	assert.PanicsWithValue(t, "region r of state foo must have initial sub-state", sm.Finalize)
+}
@@ -0,0 +1,65 @@
+package hsm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// unnamed is the placeholder for the name of an action or guard with no name, when exporting the state machine.
+// Registry never resolves it, so that the state machine can't silently be loaded without the action or guard.
+const unnamed = "_unnamed"
+
+// Registry maps names to actions and guards,
+// for building state machines from documents, where actions and guards are referred to by their names.
+// Combined names of multiple actions or guards, separated by ';', are resolved one by one.
+type Registry[E any] struct {
+	Actions map[string]func(Event, E)
+	Guards  map[string]func(Event, E) bool
+}
+
+// action returns the named action, or an error if there's no action with the name.
+func (reg Registry[E]) action(name string) (func(Event, E), error) {
+	if name == unnamed {
+		return nil, fmt.Errorf("action with no name can not be resolved")
+	}
+	if f, ok := reg.Actions[name]; ok {
+		return f, nil
+	}
+	return nil, fmt.Errorf("unknown action %q", name)
+}
+
+// guard returns the named guard, or an error if there's no guard with the name.
+func (reg Registry[E]) guard(name string) (func(Event, E) bool, error) {
+	if name == unnamed {
+		return nil, fmt.Errorf("guard with no name can not be resolved")
+	}
+	if f, ok := reg.Guards[name]; ok {
+		return f, nil
+	}
+	return nil, fmt.Errorf("unknown guard %q", name)
+}
+
+// splitNames splits combined names separated by ';', skipping any that are empty.
+func splitNames(names string) []string {
+	var result []string
+	for _, name := range strings.Split(names, ";") {
+		if name = strings.TrimSpace(name); name != "" {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// definitionNames returns the names of actions or guards as exported, split like splitNames,
+// with unnamed ones exported as the unnamed placeholder.
+func definitionNames(names []string) []string {
+	var result []string
+	for _, name := range names {
+		if split := splitNames(name); len(split) > 0 {
+			result = append(result, split...)
+		} else {
+			result = append(result, unnamed)
+		}
+	}
+	return result
+}
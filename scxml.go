@@ -0,0 +1,308 @@
+package hsm
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	scxmlNamespace = "http://www.w3.org/2005/07/scxml"
+	hsmNamespace   = "https://github.com/dragomit/hsm"
+	scxmlFinalId   = "_final"     // id of the final state representing state machine termination
+	scxmlTimer     = "hsm.timer." // prefix of the events raised by time transitions, and of their send ids
+)
+
+// SCXML exports a finalized state machine as a W3C SCXML document.
+// evNameMapper provides mapping of event ids to event names.
+// Since SCXML event names can not contain spaces, any spaces are replaced by underscores.
+//
+// States are exported as SCXML states, with orthogonal states exported as parallel states,
+// and their regions as child states. States are identified by their names, turned into valid XML ids:
+// if the name of a state is not unique, the names of its super-states are used as well, separated by dots,
+// and if that's still not unique, such as for sibling states with the same name, a number is appended.
+// The original name is preserved in the hsm:name attribute, when it differs from the id.
+// Termination of the state machine is represented by a top-level final state.
+//
+// Since guards and actions are Go functions, they are exported as placeholders,
+// using the names given to them: guards as cond attributes, and actions as script elements.
+// Guards with no name are exported as _unnamed, so that the transitions remain conditional.
+// Implicit guards, such as the data check of OnData, are part of the Go code and aren't exported.
+// Internal transitions are exported as targetless transitions, while local transitions are exported
+// as transitions of type internal, which is their SCXML equivalent.
+// Transitions into history target SCXML history pseudostates.
+//
+// Time transitions are triggered by events named after their source state, such as hsm.timer.Waiting.0.
+// For transitions created by After, the event is sent with a delay on entry to the source state,
+// and the send is canceled on exit, so that SCXML interpreters fire them on time.
+// Transitions created by At have no such equivalent, as the delay depends on when the state is entered,
+// so their events are never sent.
+//
+// Features with no SCXML equivalent are exported using attributes in the hsm namespace:
+// deferred events, choice and junction pseudostates (exported as states with eventless transitions),
+// and the time of time transitions (hsm:after or hsm:at attribute, which LoadSCXML uses to rebuild them).
+func (sm *StateMachine[E]) SCXML(evNameMapper func(int) string) string {
+	if !sm.finalized {
+		panic("state machine not finalized")
+	}
+	ids := sm.scxmlIds()
+	evName := func(id int) string {
+		return strings.Join(strings.Fields(evNameMapper(id)), "_")
+	}
+	var bld strings.Builder
+	attr := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(&bld, " %s=\"%s\"", name, xmlEscape(value))
+		}
+	}
+	scripts := func(prefix, names string) {
+		for _, name := range splitNames(names) {
+			fmt.Fprintf(&bld, "%s<script>%s</script>\n", prefix, xmlEscape(name))
+		}
+	}
+	// timerEvent returns the name of the event triggering time transition t of state s
+	timerEvent := func(s *State[E], t *transition[E]) string {
+		for i, t1 := range s.timers {
+			if t1 == t {
+				return fmt.Sprintf("%s%s.%d", scxmlTimer, ids[s], i)
+			}
+		}
+		return ""
+	}
+	// initial returns the id(s) of the default sub-states of s
+	initial := func(s *State[E]) string {
+		if s.isOrthogonal() {
+			var regions []string
+			for _, r := range s.children {
+				regions = append(regions, ids[r.initial])
+			}
+			return strings.Join(regions, " ")
+		}
+		return ids[s.initial]
+	}
+
+	var dump func(indent int, s *State[E])
+	dump = func(indent int, s *State[E]) {
+		prefix := strings.Repeat("  ", indent)
+		tag := "state"
+		if s.isOrthogonal() {
+			tag = "parallel"
+		}
+		fmt.Fprintf(&bld, "%s<%s", prefix, tag)
+		attr("id", ids[s])
+		if ids[s] != s.name {
+			attr("hsm:name", s.name)
+		}
+		if !s.isOrthogonal() && s.initial != nil {
+			attr("initial", ids[s.initial])
+		}
+		if s.pseudo != pseudoNone {
+			attr("hsm:pseudo", s.pseudo.String())
+		}
+		if len(s.deferred) > 0 {
+			var names []string
+			for _, id := range s.deferred {
+				names = append(names, evName(id))
+			}
+			attr("hsm:defer", strings.Join(names, " "))
+		}
+		if s.IsLeaf() && s.entry == nil && s.exit == nil && len(s.transitions) == 0 && s.history == HistoryNone {
+			bld.WriteString("/>\n")
+			return
+		}
+		bld.WriteString(">\n")
+
+		var delayed []*transition[E] // time transitions whose events are sent on entry
+		for _, t := range s.timers {
+			if t.trigger == triggerAfter {
+				delayed = append(delayed, t)
+			}
+		}
+		if s.entry != nil || len(delayed) > 0 {
+			fmt.Fprintf(&bld, "%s  <onentry>\n", prefix)
+			for _, t := range delayed {
+				ev := xmlEscape(timerEvent(s, t))
+				fmt.Fprintf(&bld, "%s    <send event=\"%s\" id=\"%s\" delay=\"%s\"/>\n", prefix, ev, ev, scxmlDelay(t.after))
+			}
+			scripts(prefix+"    ", s.entryName)
+			fmt.Fprintf(&bld, "%s  </onentry>\n", prefix)
+		}
+		if s.exit != nil || len(delayed) > 0 {
+			fmt.Fprintf(&bld, "%s  <onexit>\n", prefix)
+			scripts(prefix+"    ", s.exitName)
+			for _, t := range delayed {
+				fmt.Fprintf(&bld, "%s    <cancel sendid=\"%s\"/>\n", prefix, xmlEscape(timerEvent(s, t)))
+			}
+			fmt.Fprintf(&bld, "%s  </onexit>\n", prefix)
+		}
+		for _, t := range s.transitions {
+			fmt.Fprintf(&bld, "%s  <transition", prefix)
+			switch t.trigger {
+			case triggerEvent:
+				attr("event", evName(t.eventId))
+			case triggerAfter:
+				attr("event", timerEvent(s, t))
+				attr("hsm:after", t.after.String())
+			case triggerAt:
+				attr("event", timerEvent(s, t))
+				attr("hsm:at", t.at.Format(time.RFC3339Nano))
+			}
+			attr("cond", strings.Join(definitionNames(t.guardNames), ";"))
+			if !t.internal {
+				switch t.history {
+				case HistoryShallow:
+					attr("target", ids[t.target]+"_H")
+				case HistoryDeep:
+					attr("target", ids[t.target]+"_Hdeep")
+				default:
+					attr("target", ids[t.target])
+				}
+				if t.local {
+					attr("type", "internal")
+				}
+			}
+			if t.action == nil {
+				bld.WriteString("/>\n")
+				continue
+			}
+			bld.WriteString(">\n")
+			scripts(prefix+"    ", t.actionName)
+			fmt.Fprintf(&bld, "%s  </transition>\n", prefix)
+		}
+		for _, h := range []History{HistoryShallow, HistoryDeep} {
+			if s.history&h == 0 {
+				continue
+			}
+			id, typ := ids[s]+"_H", "shallow"
+			if h == HistoryDeep {
+				id, typ = ids[s]+"_Hdeep", "deep"
+			}
+			fmt.Fprintf(&bld, "%s  <history id=\"%s\" type=\"%s\">\n", prefix, xmlEscape(id), typ)
+			fmt.Fprintf(&bld, "%s    <transition target=\"%s\"/>\n", prefix, xmlEscape(initial(s)))
+			fmt.Fprintf(&bld, "%s  </history>\n", prefix)
+		}
+		for _, child := range s.children {
+			dump(indent+1, child)
+		}
+		fmt.Fprintf(&bld, "%s</%s>\n", prefix, tag)
+	}
+
+	bld.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	bld.WriteString("<scxml")
+	attr("xmlns", scxmlNamespace)
+	attr("xmlns:hsm", hsmNamespace)
+	attr("version", "1.0")
+	attr("initial", ids[sm.top.initial])
+	bld.WriteString(">\n")
+	for _, s := range sm.top.children {
+		dump(1, s)
+	}
+	if sm.terminates() {
+		fmt.Fprintf(&bld, "  <final id=\"%s\"/>\n", scxmlFinalId)
+	}
+	bld.WriteString("</scxml>\n")
+	return bld.String()
+}
+
+// scxmlDelay formats the duration as an SCXML delay, in seconds or milliseconds.
+func scxmlDelay(d time.Duration) string {
+	if d%time.Second == 0 {
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', -1, 64) + "ms"
+}
+
+// scxmlIds assigns unique XML ids to all the states.
+func (sm *StateMachine[E]) scxmlIds() map[*State[E]]string {
+	ids := make(map[*State[E]]string)
+	count := make(map[string]int)
+	var recurse func(s *State[E], f func(s *State[E]))
+	recurse = func(s *State[E], f func(s *State[E])) {
+		for _, s1 := range s.children {
+			f(s1)
+			recurse(s1, f)
+		}
+	}
+	recurse(&sm.top, func(s *State[E]) {
+		count[xmlId(s.name)]++
+	})
+	// used holds the ids taken so far, including those of the history pseudostates
+	used := map[string]bool{scxmlFinalId: true}
+	claims := func(s *State[E], id string) []string {
+		result := []string{id}
+		if s.history&HistoryShallow != 0 {
+			result = append(result, id+"_H")
+		}
+		if s.history&HistoryDeep != 0 {
+			result = append(result, id+"_Hdeep")
+		}
+		return result
+	}
+	taken := func(ids []string) bool {
+		for _, id := range ids {
+			if used[id] {
+				return true
+			}
+		}
+		return false
+	}
+	recurse(&sm.top, func(s *State[E]) {
+		base := xmlId(s.name)
+		if count[base] > 1 && s.parent != &sm.top {
+			base = ids[s.parent] + "." + base
+		}
+		id := base
+		for n := 2; taken(claims(s, id)); n++ {
+			id = fmt.Sprintf("%s_%d", base, n)
+		}
+		for _, id1 := range claims(s, id) {
+			used[id1] = true
+		}
+		ids[s] = id
+	})
+	ids[&sm.terminal] = scxmlFinalId
+	return ids
+}
+
+// terminates returns whether any transition terminates the state machine.
+func (sm *StateMachine[E]) terminates() bool {
+	var recurse func(s *State[E]) bool
+	recurse = func(s *State[E]) bool {
+		for _, t := range s.transitions {
+			if t.target == &sm.terminal {
+				return true
+			}
+		}
+		for _, s1 := range s.children {
+			if recurse(s1) {
+				return true
+			}
+		}
+		return false
+	}
+	return recurse(&sm.top)
+}
+
+// xmlId turns the name into a valid XML id, replacing any invalid characters with underscores.
+func xmlId(name string) string {
+	var bld strings.Builder
+	for i, r := range name {
+		valid := r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r > 0x7f ||
+			i > 0 && (r == '-' || r == '.' || r >= '0' && r <= '9')
+		if valid {
+			bld.WriteRune(r)
+		} else {
+			bld.WriteByte('_')
+		}
+	}
+	return bld.String()
+}
+
+// xmlEscape escapes the text for use in XML attributes and character data.
+func xmlEscape(s string) string {
+	var bld strings.Builder
+	_ = xml.EscapeText(&bld, []byte(s))
+	return bld.String()
+}
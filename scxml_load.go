@@ -0,0 +1,389 @@
+package hsm
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// LoadSCXML builds a finalized state machine from an SCXML document, such as one exported by [StateMachine.SCXML].
+// Guards (cond attributes) and actions (script elements in onentry, onexit and transitions)
+// are resolved by name using the registry, while event names are mapped to event ids using the events table.
+//
+// Only the subset of SCXML describing the structure of the state machine is supported:
+// state, parallel, initial, transition, history, onentry, onexit and script elements,
+// and top-level final states, which represent termination of the state machine.
+// The default transition of a history pseudostate is ignored, as history always defaults to the initial sub-state.
+// Final states can not be initial, and transitions of initial elements can not have executable content.
+// Attributes in the hsm namespace written by [StateMachine.SCXML] are supported as well,
+// along with the send and cancel elements of the events triggering time transitions.
+//
+// Unsupported SCXML features, unresolved names and problems with the structure of the state machine
+// are all reported as errors, and no state machine is returned in that case.
+func LoadSCXML[E any](r io.Reader, reg Registry[E], events map[string]int) (*StateMachine[E], error) {
+	var root xmlElement
+	if err := xml.NewDecoder(r).Decode(&root); err != nil {
+		return nil, fmt.Errorf("scxml: %w", err)
+	}
+	if root.XMLName.Local != "scxml" || root.XMLName.Space != scxmlNamespace && root.XMLName.Space != "" {
+		return nil, fmt.Errorf("scxml: unexpected root element <%s>", root.XMLName.Local)
+	}
+
+	sm := &StateMachine[E]{CollectErrors: true}
+	sm.top.sm = sm
+	sm.top.name = "machine"
+	l := scxmlLoader[E]{
+		sm:      sm,
+		reg:     reg,
+		events:  events,
+		states:  make(map[string]*State[E]),
+		history: make(map[string]scxmlHistory[E]),
+		final:   make(map[string]bool),
+	}
+	l.buildStates(&sm.top, &root)
+	l.buildTransitions(&root)
+	if len(l.errs) > 0 {
+		return nil, errors.Join(l.errs...)
+	}
+	if err := sm.FinalizeE(); err != nil {
+		return nil, err
+	}
+	sm.CollectErrors = false
+	return sm, nil
+}
+
+// xmlElement is a generic XML element, as parsed from an SCXML document.
+type xmlElement struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr   `xml:",any,attr"`
+	Text     string       `xml:",chardata"`
+	Children []xmlElement `xml:",any"`
+}
+
+// attr returns the value of the attribute with the given namespace and name, or empty string if there's none.
+func (el *xmlElement) attr(space, name string) string {
+	for _, a := range el.Attrs {
+		if a.Name.Space == space && a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// scxmlHistory is the history pseudostate of a state
+type scxmlHistory[E any] struct {
+	state *State[E]
+	h     History
+}
+
+// scxmlLoader keeps track of the state machine being built from an SCXML document
+type scxmlLoader[E any] struct {
+	sm      *StateMachine[E]
+	reg     Registry[E]
+	events  map[string]int
+	states  map[string]*State[E]       // states by id
+	history map[string]scxmlHistory[E] // history pseudostates by id
+	final   map[string]bool            // ids of final states
+	errs    []error
+}
+
+func (l *scxmlLoader[E]) errorf(format string, args ...any) {
+	l.errs = append(l.errs, fmt.Errorf("scxml: "+format, args...))
+}
+
+// buildStates builds the sub-states of state s from the children of element el.
+func (l *scxmlLoader[E]) buildStates(s *State[E], el *xmlElement) {
+	parallel := el.XMLName.Local == "parallel"
+	initial := strings.Fields(el.attr("", "initial"))
+	for i := range el.Children {
+		if c := &el.Children[i]; c.XMLName.Local == "initial" {
+			for j := range c.Children {
+				initial = append(initial, strings.Fields(c.Children[j].attr("", "target"))...)
+				if len(c.Children[j].Children) > 0 {
+					l.errorf("state %s: executable content of the initial transition is not supported", s.name)
+				}
+			}
+		}
+	}
+	if parallel && len(initial) > 0 {
+		l.errorf("parallel state %s can not have initial sub-states", s.name)
+	}
+	if len(initial) > 1 {
+		l.errorf("state %s: multiple initial sub-states are not supported", s.name)
+	}
+
+	foundInitial := false
+	for i := range el.Children {
+		c := &el.Children[i]
+		switch c.XMLName.Local {
+		case "state", "parallel":
+			id := c.attr("", "id")
+			if id == "" {
+				l.errorf("<%s> within state %s has no id", c.XMLName.Local, s.name)
+				continue
+			}
+			if l.states[id] != nil || l.final[id] {
+				l.errorf("duplicate id %s", id)
+				continue
+			}
+			name := c.attr(hsmNamespace, "name")
+			if name == "" {
+				name = id
+			}
+			switch {
+			case parallel:
+				l.states[id] = l.buildRegion(s, name, c)
+			case c.attr(hsmNamespace, "pseudo") != "":
+				l.states[id] = l.buildPseudostate(s, name, c)
+			default:
+				isInitial := len(initial) == 0 && !foundInitial || len(initial) > 0 && initial[0] == id
+				foundInitial = foundInitial || isInitial
+				l.states[id] = l.buildState(s, name, c, isInitial)
+			}
+		case "final":
+			if s != &l.sm.top {
+				l.errorf("final state within state %s is not supported", s.name)
+				continue
+			}
+			if len(c.Children) > 0 {
+				l.errorf("content of final state %s is not supported", c.attr("", "id"))
+			}
+			// in document order, the first child is the default initial state, even if it's a final state
+			if len(initial) == 0 && !foundInitial || len(initial) > 0 && initial[0] == c.attr("", "id") {
+				l.errorf("final state %s as the initial state is not supported", c.attr("", "id"))
+				foundInitial = true
+			}
+			l.final[c.attr("", "id")] = true
+		case "history":
+			h := HistoryShallow
+			switch c.attr("", "type") {
+			case "", "shallow":
+			case "deep":
+				h = HistoryDeep
+			default:
+				l.errorf("state %s: unknown history type %s", s.name, c.attr("", "type"))
+			}
+			l.history[c.attr("", "id")] = scxmlHistory[E]{state: s, h: h}
+		case "transition", "onentry", "onexit", "initial":
+			// handled separately
+		default:
+			l.errorf("state %s: <%s> is not supported", s.name, c.XMLName.Local)
+		}
+	}
+	if len(initial) > 0 && !foundInitial {
+		l.errorf("state %s: initial sub-state %s not found", s.name, initial[0])
+	}
+}
+
+// buildState builds the sub-state of parent state p, from element el.
+func (l *scxmlLoader[E]) buildState(p *State[E], name string, el *xmlElement, initial bool) *State[E] {
+	sb := p.State(name)
+	if initial {
+		sb.Initial()
+	}
+	for _, action := range l.scripts(el, "onentry") {
+		if f, err := l.reg.action(action); err != nil {
+			l.errorf("state %s entry: %v", name, err)
+		} else {
+			sb.Entry(action, f)
+		}
+	}
+	for _, action := range l.scripts(el, "onexit") {
+		if f, err := l.reg.action(action); err != nil {
+			l.errorf("state %s exit: %v", name, err)
+		} else {
+			sb.Exit(action, f)
+		}
+	}
+	if deferred := el.attr(hsmNamespace, "defer"); deferred != "" {
+		for _, ev := range strings.Fields(deferred) {
+			if id, ok := l.events[ev]; ok {
+				sb.Defer(id)
+			} else {
+				l.errorf("state %s: unknown deferred event %s", name, ev)
+			}
+		}
+	}
+	s := sb.Build()
+	l.buildStates(s, el)
+	return s
+}
+
+// buildRegion builds the orthogonal region of parent state p, from element el.
+func (l *scxmlLoader[E]) buildRegion(p *State[E], name string, el *xmlElement) *State[E] {
+	if el.XMLName.Local != "state" {
+		l.errorf("<%s> within parallel state %s is not supported", el.XMLName.Local, p.name)
+	}
+	for i := range el.Children {
+		switch el.Children[i].XMLName.Local {
+		case "onentry", "onexit", "history":
+			l.errorf("<%s> in region %s is not supported", el.Children[i].XMLName.Local, name)
+		}
+	}
+	r := p.Region(name)
+	l.buildStates(r, el)
+	return r
+}
+
+// buildPseudostate builds the pseudostate within parent state p, from element el.
+func (l *scxmlLoader[E]) buildPseudostate(p *State[E], name string, el *xmlElement) *State[E] {
+	for i := range el.Children {
+		if el.Children[i].XMLName.Local != "transition" {
+			l.errorf("<%s> in pseudostate %s is not supported", el.Children[i].XMLName.Local, name)
+		}
+	}
+	switch kind := el.attr(hsmNamespace, "pseudo"); kind {
+	case "choice":
+		return p.Choice(name)
+	case "junction":
+		return p.Junction(name)
+	default:
+		l.errorf("state %s: unknown pseudostate kind %s", name, kind)
+		return p.Choice(name)
+	}
+}
+
+// scripts returns the names of the actions within the child elements of el with the given tag.
+func (l *scxmlLoader[E]) scripts(el *xmlElement, tag string) []string {
+	var names []string
+	for i := range el.Children {
+		if c := &el.Children[i]; c.XMLName.Local == tag {
+			names = append(names, l.content(c, true)...)
+		}
+	}
+	return names
+}
+
+// content returns the names of the actions within the executable content of el.
+// If timers is set, sending and canceling the events of time transitions (see [StateMachine.SCXML]) is skipped,
+// as the time transitions are built from their hsm:after attributes.
+func (l *scxmlLoader[E]) content(el *xmlElement, timers bool) []string {
+	var names []string
+	for i := range el.Children {
+		c := &el.Children[i]
+		if timers && (c.XMLName.Local == "send" && strings.HasPrefix(c.attr("", "event"), scxmlTimer) ||
+			c.XMLName.Local == "cancel" && strings.HasPrefix(c.attr("", "sendid"), scxmlTimer)) {
+			continue
+		}
+		if c.XMLName.Local != "script" {
+			l.errorf("executable content <%s> is not supported", c.XMLName.Local)
+			continue
+		}
+		names = append(names, splitNames(c.Text)...)
+	}
+	return names
+}
+
+// buildTransitions builds the transitions of the states within element el.
+func (l *scxmlLoader[E]) buildTransitions(el *xmlElement) {
+	for i := range el.Children {
+		c := &el.Children[i]
+		if c.XMLName.Local != "state" && c.XMLName.Local != "parallel" {
+			continue
+		}
+		if s := l.states[c.attr("", "id")]; s != nil {
+			for j := range c.Children {
+				if t := &c.Children[j]; t.XMLName.Local == "transition" {
+					l.buildTransition(s, t)
+				}
+			}
+		}
+		l.buildTransitions(c)
+	}
+}
+
+// buildTransition builds the transition from state s, described by element el.
+func (l *scxmlLoader[E]) buildTransition(s *State[E], el *xmlElement) {
+	nErrs := len(l.errs)
+
+	var target *State[E]
+	history := HistoryNone
+	targets := strings.Fields(el.attr("", "target"))
+	switch {
+	case len(targets) == 0:
+		target = s
+	case len(targets) > 1:
+		l.errorf("state %s: transition with multiple targets is not supported", s.name)
+	case l.states[targets[0]] != nil:
+		target = l.states[targets[0]]
+	case l.history[targets[0]].state != nil:
+		target, history = l.history[targets[0]].state, l.history[targets[0]].h
+	case l.final[targets[0]]:
+		target = nil
+	default:
+		l.errorf("state %s: unknown transition target %s", s.name, targets[0])
+	}
+
+	guards := make(map[string]func(Event, E) bool)
+	guardNames := splitNames(el.attr("", "cond"))
+	for _, name := range guardNames {
+		if f, err := l.reg.guard(name); err != nil {
+			l.errorf("state %s transition: %v", s.name, err)
+		} else {
+			guards[name] = f
+		}
+	}
+	actions := make(map[string]func(Event, E))
+	actionNames := l.content(el, false)
+	for _, name := range actionNames {
+		if f, err := l.reg.action(name); err != nil {
+			l.errorf("state %s transition: %v", s.name, err)
+		} else {
+			actions[name] = f
+		}
+	}
+
+	// time transitions are triggered by the events of their timers, which are not in the events table
+	var builders []*TransitionBuilder[E]
+	if after := el.attr(hsmNamespace, "after"); after != "" {
+		if d, err := time.ParseDuration(after); err != nil {
+			l.errorf("state %s: invalid hsm:after: %v", s.name, err)
+		} else {
+			builders = append(builders, s.After(d, target))
+		}
+	} else if at := el.attr(hsmNamespace, "at"); at != "" {
+		if t, err := time.Parse(time.RFC3339Nano, at); err != nil {
+			l.errorf("state %s: invalid hsm:at: %v", s.name, err)
+		} else {
+			builders = append(builders, s.At(t, target))
+		}
+	} else if event := el.attr("", "event"); event != "" {
+		for _, ev := range strings.Fields(event) {
+			if id, ok := l.events[ev]; ok {
+				builders = append(builders, s.Transition(id, target))
+			} else {
+				l.errorf("state %s: unknown event %s", s.name, ev)
+			}
+		}
+	} else if len(targets) == 0 {
+		l.errorf("state %s: targetless transition must have an event", s.name)
+	} else {
+		builders = append(builders, s.Completion(target))
+	}
+	if len(l.errs) > nErrs {
+		return // the state machine is discarded anyway
+	}
+
+	for _, tb := range builders {
+		if len(targets) == 0 {
+			tb.Internal()
+		}
+		if history != HistoryNone {
+			tb.History(history)
+		}
+		// transitions of type internal are local, provided that one of the states contains the other
+		if el.attr("", "type") == "internal" && target != nil && getParent(s, target) != nil {
+			tb.Local(true)
+		}
+		for _, name := range guardNames {
+			tb.Guard(name, guards[name])
+		}
+		for _, name := range actionNames {
+			tb.Action(name, actions[name])
+		}
+		tb.Build()
+	}
+}
@@ -0,0 +1,300 @@
+package hsm_test
+
+import (
+	"github.com/dragomit/hsm"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+var scxmlNames = []string{"New data", "Enough data", "Pause", "Succeeded", "Failed", "Resume", "Deep resume", "Aborted"}
+
+func scxmlEvName(ev int) string { return scxmlNames[ev] }
+
+// scxmlMachine builds the state machine used by SCXML tests
+func scxmlMachine(nop func(hsm.Event, struct{}), yes func(hsm.Event, struct{}) bool) *hsm.StateMachine[struct{}] {
+	sm := &hsm.StateMachine[struct{}]{}
+
+	state1 := sm.State("State1").Initial().Build()
+	state2 := sm.State("State2").Entry("start", nop).Exit("stop", nop).Defer(evNewData).Build()
+	state3 := sm.State("State3").Build()
+
+	accEnoughData := state3.State("Accumulate enough data").Initial().Build()
+	accEnoughData.Transition(evNewData, accEnoughData).Internal().Action("store", nop).Build()
+	processData := state3.State("Process data").Build()
+	accEnoughData.Transition(evEnoughData, processData).Guard("full", yes).Build()
+	processData.Transition(evNewData, state3).Local(true).Build()
+	processData.After(5*time.Second, accEnoughData).Build()
+
+	state3.AddTransition(evPause, state2)
+	state2.AddTransition(evSucceeded, state3)
+	state2.Transition(evResume, state3).History(hsm.HistoryShallow).Build()
+	state2.Transition(evDeepResume, state3).History(hsm.HistoryDeep).Build()
+	state1.AddTransition(evSucceeded, state2)
+	state1.AddTransition(evAborted, nil)
+	state3.AddTransition(evAborted, nil)
+	state3.Transition(evSucceeded, nil).Action("save", nop).Action("close", nop).Build()
+
+	// orthogonal regions and a choice, with the region's states named same as the top-level states
+	on := sm.State("On").Build()
+	r1 := on.Region("r1")
+	r1State1 := r1.State("State1").Initial().Build()
+	r2 := on.Region("r2")
+	r2.State("Idle").Initial().Build()
+	c := r1.Choice("c")
+	r1State1.AddTransition(evFailed, c)
+	c.Completion(r1State1).Guard("retry", yes).Build()
+	c.Completion(state1).Build()
+	state1.AddTransition(evFailed, on)
+
+	sm.Finalize()
+	return sm
+}
+
+func TestSCXML(t *testing.T) {
+	sm := scxmlMachine(func(hsm.Event, struct{}) {}, func(hsm.Event, struct{}) bool { return true })
+
+	wants := `<?xml version="1.0" encoding="UTF-8"?>
+<scxml xmlns="http://www.w3.org/2005/07/scxml" xmlns:hsm="https://github.com/dragomit/hsm" version="1.0" initial="State1">
+  <state id="State1">
+    <transition event="Succeeded" target="State2"/>
+    <transition event="Aborted" target="_final"/>
+    <transition event="Failed" target="On"/>
+  </state>
+  <state id="State2" hsm:defer="New_data">
+    <onentry>
+      <script>start</script>
+    </onentry>
+    <onexit>
+      <script>stop</script>
+    </onexit>
+    <transition event="Succeeded" target="State3"/>
+    <transition event="Resume" target="State3_H"/>
+    <transition event="Deep_resume" target="State3_Hdeep"/>
+  </state>
+  <state id="State3" initial="Accumulate_enough_data">
+    <transition event="Pause" target="State2"/>
+    <transition event="Aborted" target="_final"/>
+    <transition event="Succeeded" target="_final">
+      <script>save</script>
+      <script>close</script>
+    </transition>
+    <history id="State3_H" type="shallow">
+      <transition target="Accumulate_enough_data"/>
+    </history>
+    <history id="State3_Hdeep" type="deep">
+      <transition target="Accumulate_enough_data"/>
+    </history>
+    <state id="Accumulate_enough_data" hsm:name="Accumulate enough data">
+      <transition event="New_data">
+        <script>store</script>
+      </transition>
+      <transition event="Enough_data" cond="full" target="Process_data"/>
+    </state>
+    <state id="Process_data" hsm:name="Process data">
+      <onentry>
+        <send event="hsm.timer.Process_data.0" id="hsm.timer.Process_data.0" delay="5s"/>
+      </onentry>
+      <onexit>
+        <cancel sendid="hsm.timer.Process_data.0"/>
+      </onexit>
+      <transition event="New_data" target="State3" type="internal"/>
+      <transition event="hsm.timer.Process_data.0" hsm:after="5s" target="Accumulate_enough_data"/>
+    </state>
+  </state>
+  <parallel id="On">
+    <state id="r1" initial="r1.State1">
+      <state id="r1.State1" hsm:name="State1">
+        <transition event="Failed" target="c"/>
+      </state>
+      <state id="c" hsm:pseudo="choice">
+        <transition cond="retry" target="r1.State1"/>
+        <transition target="State1"/>
+      </state>
+    </state>
+    <state id="r2" initial="Idle">
+      <state id="Idle"/>
+    </state>
+  </parallel>
+  <final id="_final"/>
+</scxml>
+`
+	assert.Equal(t, wants, sm.SCXML(scxmlEvName))
+}
+
+func TestSCXMLUniqueIds(t *testing.T) {
+	sm := hsm.StateMachine[struct{}]{}
+	a := sm.State("a").Initial().Build()
+	a2 := sm.State("a").Build()
+	b := sm.State("a b").Build()
+	b2 := sm.State("a_b").Build()
+	a.AddTransition(evNewData, a2)
+	a2.Transition(evPause, b).Guard("", func(hsm.Event, struct{}) bool { return true }).Build()
+	a2.AddTransition(evPause, b2)
+	sm.Finalize()
+
+	scxml := sm.SCXML(scxmlEvName)
+	for _, want := range []string{
+		`<state id="a">`,
+		`<state id="a_2" hsm:name="a">`,
+		`<transition event="New_data" target="a_2"/>`,
+		`<transition event="Pause" cond="_unnamed" target="a_b"/>`,
+		`<state id="a_b" hsm:name="a b"/>`,
+		`<state id="a_b_2" hsm:name="a_b"/>`,
+	} {
+		assert.Contains(t, scxml, want)
+	}
+}
+
+func TestLoadSCXML(t *testing.T) {
+	var log []string
+	action := func(name string) func(hsm.Event, *bool) {
+		return func(hsm.Event, *bool) { log = append(log, name) }
+	}
+	reg := hsm.Registry[*bool]{
+		Actions: map[string]func(hsm.Event, *bool){
+			"light on": action("light on"), "light off": action("light off"), "ring": action("ring")},
+		Guards: map[string]func(hsm.Event, *bool) bool{
+			"closed": func(_ hsm.Event, closed *bool) bool { return *closed }},
+	}
+	const (
+		evOpen = iota
+		evClose
+		evStart
+		evDone
+	)
+	events := map[string]int{"open": evOpen, "close": evClose, "start": evStart, "done": evDone}
+
+	doc := `<scxml xmlns="http://www.w3.org/2005/07/scxml" version="1.0">
+  <state id="closed">
+    <initial><transition target="idle"/></initial>
+    <transition event="open" target="open"/>
+    <state id="cooking">
+      <onentry><script>light on</script></onentry>
+      <onexit><script>light off</script></onexit>
+      <transition event="done" target="idle"><script>ring</script></transition>
+    </state>
+    <state id="idle">
+      <transition event="start" cond="closed" target="cooking"/>
+    </state>
+  </state>
+  <state id="open">
+    <transition event="close" target="closed"/>
+  </state>
+</scxml>`
+	sm, err := hsm.LoadSCXML(strings.NewReader(doc), reg, events)
+	assert.NoError(t, err)
+
+	closed := true
+	smi := hsm.StateMachineInstance[*bool]{SM: sm, Ext: &closed}
+	smi.Initialize(hsm.Event{})
+	assert.Equal(t, "idle", smi.Current().Name())
+	smi.Deliver(hsm.Event{Id: evStart})
+	smi.Deliver(hsm.Event{Id: evDone})
+	assert.Equal(t, "idle", smi.Current().Name())
+	assert.Equal(t, []string{"light on", "light off", "ring"}, log)
+
+	closed = false
+	handled, _ := smi.Deliver(hsm.Event{Id: evStart})
+	assert.False(t, handled)
+	smi.Deliver(hsm.Event{Id: evOpen})
+	assert.Equal(t, "open", smi.Current().Name())
+}
+
+func TestLoadSCXMLRoundTrip(t *testing.T) {
+	nop := func(hsm.Event, struct{}) {}
+	yes := func(hsm.Event, struct{}) bool { return true }
+	sm := scxmlMachine(nop, yes)
+	reg := hsm.Registry[struct{}]{
+		Actions: map[string]func(hsm.Event, struct{}){"start": nop, "stop": nop, "store": nop, "save": nop, "close": nop},
+		Guards:  map[string]func(hsm.Event, struct{}) bool{"full": yes, "retry": yes},
+	}
+	events := make(map[string]int)
+	for id, name := range scxmlNames {
+		events[strings.ReplaceAll(name, " ", "_")] = id
+	}
+
+	doc := sm.SCXML(scxmlEvName)
+	loaded, err := hsm.LoadSCXML(strings.NewReader(doc), reg, events)
+	assert.NoError(t, err)
+	assert.Equal(t, doc, loaded.SCXML(scxmlEvName))
+}
+
+func TestSCXMLTimeEvents(t *testing.T) {
+	nop := func(hsm.Event, struct{}) {}
+	sm := hsm.StateMachine[struct{}]{}
+	waiting := sm.State("Waiting").Initial().Exit("stop", nop).Build()
+	done := sm.State("Done").Build()
+	waiting.After(1500*time.Millisecond, done).Build()
+	waiting.At(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC), done).Build()
+	waiting.After(time.Minute, done).Build()
+	sm.Finalize()
+
+	doc := sm.SCXML(scxmlEvName)
+	assert.Contains(t, doc, `  <state id="Waiting">
+    <onentry>
+      <send event="hsm.timer.Waiting.0" id="hsm.timer.Waiting.0" delay="1500ms"/>
+      <send event="hsm.timer.Waiting.2" id="hsm.timer.Waiting.2" delay="60s"/>
+    </onentry>
+    <onexit>
+      <script>stop</script>
+      <cancel sendid="hsm.timer.Waiting.0"/>
+      <cancel sendid="hsm.timer.Waiting.2"/>
+    </onexit>
+    <transition event="hsm.timer.Waiting.0" hsm:after="1.5s" target="Done"/>
+    <transition event="hsm.timer.Waiting.1" hsm:at="2030-01-01T00:00:00Z" target="Done"/>
+    <transition event="hsm.timer.Waiting.2" hsm:after="1m0s" target="Done"/>
+  </state>
+`)
+
+	// sending and canceling the timer events is implied by the time transitions
+	reg := hsm.Registry[struct{}]{Actions: map[string]func(hsm.Event, struct{}){"stop": nop}}
+	loaded, err := hsm.LoadSCXML(strings.NewReader(doc), reg, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, doc, loaded.SCXML(scxmlEvName))
+}
+
+func TestLoadSCXMLErrors(t *testing.T) {
+	doc := `<scxml xmlns="http://www.w3.org/2005/07/scxml" version="1.0">
+  <datamodel><data id="x"/></datamodel>
+  <state id="a">
+    <onentry><log expr="'hello'"/></onentry>
+    <transition event="go" cond="ready" target="b"><script>act</script></transition>
+    <transition event="stop" target="c"/>
+  </state>
+  <state id="b"/>
+</scxml>`
+	_, err := hsm.LoadSCXML(strings.NewReader(doc), hsm.Registry[struct{}]{}, map[string]int{"stop": 0})
+	assert.EqualError(t, err, `scxml: state machine: <datamodel> is not supported
+scxml: executable content <log> is not supported
+scxml: state a transition: unknown guard "ready"
+scxml: state a transition: unknown action "act"
+scxml: state a: unknown event go
+scxml: state a: unknown transition target c`)
+
+	// problems with the structure are reported as well
+	doc = `<scxml xmlns="http://www.w3.org/2005/07/scxml" xmlns:hsm="https://github.com/dragomit/hsm" version="1.0">
+  <state id="a"><transition event="go" target="c"/></state>
+  <state id="c" hsm:pseudo="choice"/>
+</scxml>`
+	_, err = hsm.LoadSCXML(strings.NewReader(doc), hsm.Registry[struct{}]{}, map[string]int{"go": 0})
+	var structureErrs hsm.StructureErrors
+	assert.ErrorAs(t, err, &structureErrs)
+	assert.EqualError(t, err, "choice c must have at least one outgoing branch")
+
+	// initial final state, and executable content of the initial transition
+	doc = `<scxml xmlns="http://www.w3.org/2005/07/scxml" version="1.0">
+  <final id="done"/>
+  <state id="a">
+    <initial><transition target="a1"><script>act</script></transition></initial>
+    <state id="a1"/>
+  </state>
+</scxml>`
+	_, err = hsm.LoadSCXML(strings.NewReader(doc), hsm.Registry[struct{}]{}, nil)
+	assert.EqualError(t, err, `scxml: final state done as the initial state is not supported
+scxml: state a: executable content of the initial transition is not supported`)
+
+	_, err = hsm.LoadSCXML(strings.NewReader("<html/>"), hsm.Registry[struct{}]{}, nil)
+	assert.EqualError(t, err, "scxml: unexpected root element <html>")
+}
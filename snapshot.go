@@ -0,0 +1,219 @@
+package hsm
+
+import (
+	"fmt"
+	"time"
+)
+
+// Snapshot is a serializable copy of the state of a [StateMachineInstance], taken between events.
+// States are identified by their paths: names of the state and all its super-states,
+// starting from the top-level state, separated by '/'.
+// Regions are part of the path, just like the other states.
+//
+// Snapshot covers the active states, history, armed time transitions, and deferred events.
+// Deferred events are recorded by their ids, so they must not carry any data.
+// Snapshot does not cover the extended state, which must be saved separately.
+type Snapshot struct {
+	Initialized bool              `json:"initialized"`
+	Terminated  bool              `json:"terminated,omitempty"`
+	Active      []string          `json:"active,omitempty"`   // active leaf states, one per active region
+	History     map[string]string `json:"history,omitempty"`  // last active sub-state of composite states and regions
+	Timers      []SnapshotTimer   `json:"timers,omitempty"`   // armed time transitions
+	Deferred    []int             `json:"deferred,omitempty"` // ids of the deferred events, in the order of delivery
+}
+
+// SnapshotTimer is an armed time transition, identified by its source state,
+// and its index among the time transitions of that state, in the order in which they were defined.
+type SnapshotTimer struct {
+	State    string    `json:"state"`
+	Index    int       `json:"index"`
+	Deadline time.Time `json:"deadline"`
+}
+
+// Path returns the path of the state, which identifies the state within a [Snapshot].
+func (s *State[E]) Path() string {
+	if s.parent == nil || s.parent.parent == nil {
+		return s.name
+	}
+	return s.parent.Path() + "/" + s.name
+}
+
+// Snapshot takes a snapshot of the instance state.
+// It must not be called while the instance is processing an event.
+// Snapshot returns an error if any of the deferred events carries data, which the snapshot can't record.
+func (smi *StateMachineInstance[E]) Snapshot() (Snapshot, error) {
+	snap := Snapshot{Initialized: smi.initialized, Terminated: smi.initialized && len(smi.active) == 0}
+	for _, s := range smi.active {
+		snap.Active = append(snap.Active, s.Path())
+	}
+	if len(smi.history) > 0 {
+		snap.History = make(map[string]string, len(smi.history))
+		for s, child := range smi.history {
+			snap.History[s.Path()] = child.Path()
+		}
+	}
+	for _, at := range smi.timers {
+		snap.Timers = append(snap.Timers, SnapshotTimer{State: at.src.Path(), Index: at.index(), Deadline: at.deadline})
+	}
+	for _, e := range smi.deferred {
+		if e.Data != nil {
+			return Snapshot{}, fmt.Errorf("deferred event %d carries data of type %T, which can't be recorded in a snapshot",
+				e.Id, e.Data)
+		}
+		snap.Deferred = append(snap.Deferred, e.Id)
+	}
+	return snap, nil
+}
+
+// index returns the index of the armed transition among the time transitions of its source state.
+func (at armedTimer[E]) index() int {
+	for i, t := range at.src.timers {
+		if t == at.t {
+			return i
+		}
+	}
+	return -1
+}
+
+// Restore brings the instance into the state recorded in the snapshot,
+// which may have been taken from a different instance of the same state machine.
+// No actions are executed: the instance continues as if it had delivered the same events as the original one.
+// Restore returns an error if the snapshot does not match the structure of the state machine,
+// in which case the instance is left unchanged.
+// The extended state, if any, must be restored separately.
+func (smi *StateMachineInstance[E]) Restore(snap Snapshot) error {
+	if !smi.SM.finalized {
+		panic("state machine not finalized")
+	}
+	smi.begin()
+	defer smi.end()
+
+	states := make(map[string]*State[E])
+	var recurse func(s *State[E])
+	recurse = func(s *State[E]) {
+		for _, s1 := range s.children {
+			p := s1.Path()
+			if _, ok := states[p]; ok {
+				states[p] = nil // ambiguous path
+			} else {
+				states[p] = s1
+			}
+			recurse(s1)
+		}
+	}
+	recurse(&smi.SM.top)
+	lookup := func(p string) (*State[E], error) {
+		s, ok := states[p]
+		if !ok {
+			return nil, fmt.Errorf("snapshot refers to unknown state %s", p)
+		}
+		if s == nil {
+			return nil, fmt.Errorf("snapshot refers to state %s, which is not uniquely named", p)
+		}
+		return s, nil
+	}
+
+	// active leaf states must form a valid configuration
+	var active []*State[E]
+	inConfig := make(map[*State[E]]bool)
+	for _, p := range snap.Active {
+		s, err := lookup(p)
+		if err != nil {
+			return err
+		}
+		if !s.IsLeaf() || s.pseudo != pseudoNone || s.region {
+			return fmt.Errorf("snapshot state %s is not a leaf state", p)
+		}
+		if inConfig[s] {
+			return fmt.Errorf("snapshot state %s is listed more than once", p)
+		}
+		active = append(active, s)
+		for ; s != nil; s = s.parent {
+			inConfig[s] = true
+		}
+	}
+	switch {
+	case !snap.Initialized || snap.Terminated:
+		if len(active) > 0 {
+			return fmt.Errorf("snapshot of an instance that's not running must have no active states")
+		}
+	case len(active) == 0:
+		return fmt.Errorf("snapshot has no active states")
+	}
+	for s := range inConfig {
+		if s.IsLeaf() {
+			continue
+		}
+		n := 0
+		for _, s1 := range s.children {
+			if inConfig[s1] {
+				n++
+			}
+		}
+		if s.isOrthogonal() && n != len(s.children) {
+			return fmt.Errorf("snapshot must have an active state in each region of %s", s.Path())
+		}
+		if !s.isOrthogonal() && n != 1 {
+			return fmt.Errorf("snapshot must have exactly one active sub-state of %s", s.Path())
+		}
+	}
+	// keep the configuration in document order
+	for i := 1; i < len(active); i++ {
+		for j := i; j > 0 && active[j-1].order > active[j].order; j-- {
+			active[j-1], active[j] = active[j], active[j-1]
+		}
+	}
+
+	history := make(map[*State[E]]*State[E], len(snap.History))
+	for p, c := range snap.History {
+		s, err := lookup(p)
+		if err != nil {
+			return err
+		}
+		child, err := lookup(c)
+		if err != nil {
+			return err
+		}
+		if !s.recordHistory || child.parent != s {
+			return fmt.Errorf("snapshot history %s of state %s does not match the state machine", c, p)
+		}
+		history[s] = child
+	}
+
+	var timers []armedTimer[E]
+	for _, st := range snap.Timers {
+		s, err := lookup(st.State)
+		if err != nil {
+			return err
+		}
+		if st.Index < 0 || st.Index >= len(s.timers) {
+			return fmt.Errorf("snapshot timer %d of state %s does not match the state machine", st.Index, st.State)
+		}
+		if !inConfig[s] {
+			return fmt.Errorf("snapshot timer %d of state %s is armed, but the state is not active", st.Index, st.State)
+		}
+		timers = append(timers, armedTimer[E]{src: s, t: s.timers[st.Index], deadline: st.Deadline})
+	}
+
+	smi.active = active
+	smi.history = nil
+	if smi.SM.history != HistoryNone {
+		smi.history = history
+	}
+	// sequence numbers are assigned only once the snapshot is known to be valid, leaving the instance intact otherwise
+	for i := range timers {
+		smi.timerSeq++
+		timers[i].seq = smi.timerSeq
+	}
+	smi.timers = timers
+	smi.initialized = snap.Initialized
+	smi.entered = smi.entered[:0]
+	smi.queue.clear()
+	smi.urgent.clear()
+	smi.recalled.clear()
+	smi.deferred = smi.deferred[:0]
+	for _, id := range snap.Deferred {
+		smi.deferred = append(smi.deferred, Event{Id: id})
+	}
+	return nil
+}
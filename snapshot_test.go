@@ -0,0 +1,195 @@
+package hsm_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/dragomit/hsm"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	const (
+		evNext = iota
+		evPause
+		evResume
+		evFlip
+	)
+
+	var buf bytes.Buffer
+	makeA := func(txt string) func(hsm.Event, struct{}) {
+		return func(hsm.Event, struct{}) {
+			buf.WriteString(txt)
+			buf.WriteByte('|')
+		}
+	}
+
+	sm := hsm.StateMachine[struct{}]{}
+	work := sm.State("work").Entry("enter work", makeA("enter work")).Initial().Build()
+	paused := sm.State("paused").Build()
+	steps := work.Region("steps")
+	s1 := steps.State("s1").Entry("enter s1", makeA("enter s1")).Initial().Build()
+	s2 := steps.State("s2").Entry("enter s2", makeA("enter s2")).Build()
+	mode := work.Region("mode")
+	fast := mode.State("fast").Initial().Build()
+	slow := mode.State("slow").Build()
+
+	s1.AddTransition(evNext, s2)
+	s2.After(time.Minute, s1).Build()
+	fast.AddTransition(evFlip, slow)
+	work.AddTransition(evPause, paused)
+	paused.Transition(evResume, work).History(hsm.HistoryDeep).Build()
+	sm.Finalize()
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := hsm.NewFakeClock(start)
+	smi := hsm.StateMachineInstance[struct{}]{SM: &sm, Clock: clock}
+	smi.Initialize(hsm.Event{})
+	smi.Deliver(hsm.Event{Id: evNext})
+	smi.Deliver(hsm.Event{Id: evFlip})
+
+	snap, err := smi.Snapshot()
+	assert.NoError(t, err)
+	assert.Equal(t, hsm.Snapshot{
+		Initialized: true,
+		Active:      []string{"work/steps/s2", "work/mode/slow"},
+		History:     map[string]string{"work/steps": "work/steps/s1", "work/mode": "work/mode/fast"},
+		Timers:      []hsm.SnapshotTimer{{State: "work/steps/s2", Index: 0, Deadline: start.Add(time.Minute)}},
+	}, snap)
+
+	smi.Deliver(hsm.Event{Id: evPause})
+	snap, err = smi.Snapshot()
+	assert.NoError(t, err)
+	assert.Equal(t, hsm.Snapshot{
+		Initialized: true,
+		Active:      []string{"paused"},
+		History:     map[string]string{"work/steps": "work/steps/s2", "work/mode": "work/mode/slow"},
+	}, snap)
+
+	// serialize, and restore into another instance, without running entry actions
+	data, err := json.Marshal(snap)
+	assert.NoError(t, err)
+	var snap2 hsm.Snapshot
+	assert.NoError(t, json.Unmarshal(data, &snap2))
+	restored := hsm.StateMachineInstance[struct{}]{SM: &sm, Clock: clock}
+	buf.Reset()
+	assert.NoError(t, restored.Restore(snap2))
+	assert.Equal(t, "", buf.String())
+	assert.Equal(t, paused, restored.Current())
+
+	// history was restored as well
+	restored.Deliver(hsm.Event{Id: evResume})
+	assert.Equal(t, []*hsm.State[struct{}]{s2, slow}, restored.Configuration())
+	assert.Equal(t, "enter work|enter s2|", buf.String())
+
+	// so was the timer
+	assert.NoError(t, restored.Restore(hsm.Snapshot{
+		Initialized: true,
+		Active:      []string{"work/steps/s2", "work/mode/fast"},
+		Timers:      []hsm.SnapshotTimer{{State: "work/steps/s2", Index: 0, Deadline: start.Add(time.Minute)}},
+	}))
+	clock.Advance(time.Minute)
+	assert.Equal(t, 1, restored.ProcessTimers())
+	assert.Equal(t, []*hsm.State[struct{}]{s1, fast}, restored.Configuration())
+
+	// terminated and uninitialized instances
+	assert.NoError(t, restored.Restore(hsm.Snapshot{Initialized: true, Terminated: true}))
+	assert.Nil(t, restored.Current())
+	assert.NoError(t, restored.Restore(hsm.Snapshot{}))
+	assert.Panics(t, func() { restored.Deliver(hsm.Event{Id: evNext}) })
+}
+
+func TestSnapshotDeferred(t *testing.T) {
+	const (
+		evDone = iota
+		evWork
+	)
+	sm := hsm.StateMachine[struct{}]{}
+	busy := sm.State("busy").Initial().Defer(evWork).Build()
+	idle := sm.State("idle").Build()
+	working := sm.State("working").Build()
+	busy.AddTransition(evDone, idle)
+	idle.AddTransition(evWork, working)
+	sm.Finalize()
+
+	smi := hsm.StateMachineInstance[struct{}]{SM: &sm}
+	smi.Initialize(hsm.Event{})
+	smi.Deliver(hsm.Event{Id: evWork})
+	snap, err := smi.Snapshot()
+	assert.NoError(t, err)
+	assert.Equal(t, []int{evWork}, snap.Deferred)
+
+	// the deferred event is recalled by the restored instance
+	restored := hsm.StateMachineInstance[struct{}]{SM: &sm}
+	assert.NoError(t, restored.Restore(snap))
+	restored.Deliver(hsm.Event{Id: evDone})
+	assert.Equal(t, working, restored.Current())
+
+	// event data can't be recorded
+	smi.Deliver(hsm.Event{Id: evWork, Data: "urgent"})
+	_, err = smi.Snapshot()
+	assert.EqualError(t, err, "deferred event 1 carries data of type string, which can't be recorded in a snapshot")
+}
+
+func TestRestoreErrors(t *testing.T) {
+	sm := hsm.StateMachine[struct{}]{}
+	a := sm.State("a").Initial().Build()
+	a1 := a.State("a1").Initial().Build()
+	a.State("a2").Build()
+	b := sm.State("b").Build()
+	b.Transition(0, a).History(hsm.HistoryShallow).Build()
+	sm.Finalize()
+
+	tests := []struct {
+		name string
+		snap hsm.Snapshot
+		err  string
+	}{
+		{
+			name: "unknown state",
+			snap: hsm.Snapshot{Initialized: true, Active: []string{"c"}},
+			err:  "snapshot refers to unknown state c",
+		},
+		{
+			name: "not a leaf",
+			snap: hsm.Snapshot{Initialized: true, Active: []string{"a"}},
+			err:  "snapshot state a is not a leaf state",
+		},
+		{
+			name: "conflicting states",
+			snap: hsm.Snapshot{Initialized: true, Active: []string{"a/a1", "a/a2"}},
+			err:  "snapshot must have exactly one active sub-state of a",
+		},
+		{
+			name: "no active states",
+			snap: hsm.Snapshot{Initialized: true},
+			err:  "snapshot has no active states",
+		},
+		{
+			name: "terminated",
+			snap: hsm.Snapshot{Initialized: true, Terminated: true, Active: []string{"b"}},
+			err:  "snapshot of an instance that's not running must have no active states",
+		},
+		{
+			name: "history",
+			snap: hsm.Snapshot{Initialized: true, Active: []string{"b"}, History: map[string]string{"a": "b"}},
+			err:  "snapshot history b of state a does not match the state machine",
+		},
+		{
+			name: "timer",
+			snap: hsm.Snapshot{Initialized: true, Active: []string{"b"}, Timers: []hsm.SnapshotTimer{{State: "b"}}},
+			err:  "snapshot timer 0 of state b does not match the state machine",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			smi := hsm.StateMachineInstance[struct{}]{SM: &sm}
+			smi.Initialize(hsm.Event{})
+			assert.EqualError(t, smi.Restore(test.snap), test.err)
+			// instance is left unchanged
+			assert.Equal(t, a1, smi.Current())
+		})
+	}
+}
@@ -3,6 +3,7 @@ package hsm
 import (
 	"fmt"
 	"strings"
+	"time"
 )
 
 // State is a leaf or composite state in a state machine.
@@ -20,22 +21,84 @@ type State[E any] struct {
 	parent              *State[E]
 	children            []*State[E]
 	initial             *State[E] // initial child state
-	validated           bool
-	entry, exit         func(Event, E)
+	entry, exit         actionFunc[E]
+	entryPlain          func(Event, E) // entry action, if it doesn't need the context, called directly
+	exitPlain           func(Event, E) // exit action, if it doesn't need the context, called directly
 	entryName, exitName string
+	entryNames          []string // names of the entry actions, as given, so empty for unnamed ones
+	exitNames           []string // names of the exit actions, as given, so empty for unnamed ones
 	transitions         []*transition[E]
+	deferred            []int            // ids of events deferred in this state
+	timers              []*transition[E] // time-triggered transitions, armed on entry
 	sm                  *StateMachine[E]
-	history             History // types of history transitions into this state
+	history             History          // types of history transitions into this state
+	region              bool             // state is an orthogonal region of its parent
+	pseudo              pseudoKind       // kind of pseudostate, if state is a pseudostate
+	recordHistory       bool             // last active sub-state must be recorded on exit
+	order               int              // position in document order (depth-first traversal)
+	table               dispatchTable[E] // candidate transitions by event id, flattened up the hierarchy
+}
+
+// pseudoKind distinguishes pseudostates from regular states
+type pseudoKind int
+
+const (
+	pseudoNone pseudoKind = iota
+	pseudoChoice
+	pseudoJunction
+)
+
+func (k pseudoKind) String() string {
+	switch k {
+	case pseudoChoice:
+		return "choice"
+	case pseudoJunction:
+		return "junction"
+	}
+	return "state"
+}
+
+// actionFunc is the internal representation of state entry/exit actions and transition actions
+type actionFunc[E any] func(ctx *Context[E], event Event, e E)
+
+// guardFunc is the internal representation of transition guards
+type guardFunc[E any] func(ctx *Context[E], event Event, e E) bool
+
+// plainAction adapts action which doesn't need the context
+func plainAction[E any](f func(Event, E)) actionFunc[E] {
+	return func(_ *Context[E], event Event, e E) {
+		f(event, e)
+	}
+}
+
+// failingAction adapts action which may fail, and doesn't need the context.
+// Failure is reported by panicking with the error, which DeliverE recovers from.
+func failingAction[E any](f func(Event, E) error) actionFunc[E] {
+	return func(_ *Context[E], event Event, e E) {
+		if err := f(event, e); err != nil {
+			panic(actionFailure{err})
+		}
+	}
+}
+
+// plainGuard adapts guard which doesn't need the context
+func plainGuard[E any](f func(Event, E) bool) guardFunc[E] {
+	return func(_ *Context[E], event Event, e E) bool {
+		return f(event, e)
+	}
 }
 
 type namedAction[E any] struct {
 	name   string
-	action func(Event, E)
+	action actionFunc[E]
+	plain  func(Event, E) // the action as given, if it doesn't need the context
 }
 
 type namedGuard[E any] struct {
-	name  string
-	guard func(Event, E) bool
+	name     string
+	guard    guardFunc[E]
+	plain    func(Event, E) bool // the guard as given, if it doesn't need the context
+	implicit bool                // guard added by the library, such as the data check of OnData, and not shown
 }
 
 func (na namedAction[E]) Name() string {
@@ -61,28 +124,74 @@ func combineNames[N named](items []N) string {
 	return strings.Join(nonEmptyNames, ";")
 }
 
-// returns combined name and combined action (one that executes all actions in sequence)
-func combineActions[E any](namedActions []namedAction[E]) (name string, action func(event Event, e E)) {
+// itemNames returns the names of the items, including the empty ones
+func itemNames[N named](items []N) []string {
+	names := make([]string, len(items))
+	for i, item := range items {
+		names[i] = item.Name()
+	}
+	return names
+}
+
+// guardNames returns the names of the guards other than implicit ones, and whether there are any implicit ones
+func guardNames[E any](guards []namedGuard[E]) (names []string, implicit bool) {
+	for _, ng := range guards {
+		if ng.implicit {
+			implicit = true
+		} else {
+			names = append(names, ng.name)
+		}
+	}
+	return names, implicit
+}
+
+// returns combined name and combined action (one that executes all actions in sequence),
+// along with the combined plain action, if none of the actions need the context
+func combineActions[E any](namedActions []namedAction[E]) (name string, action actionFunc[E], plain func(Event, E)) {
 	// avoid extra indirection in the case of a single action
 	if len(namedActions) == 1 {
-		return namedActions[0].name, namedActions[0].action
+		return namedActions[0].name, namedActions[0].action, namedActions[0].plain
 	}
-	return combineNames(namedActions), func(event Event, e E) {
+	action = func(ctx *Context[E], event Event, e E) {
 		for _, na := range namedActions {
-			na.action(event, e)
+			na.action(ctx, event, e)
+		}
+	}
+	for _, na := range namedActions {
+		if na.plain == nil {
+			return combineNames(namedActions), action, nil
+		}
+	}
+	return combineNames(namedActions), action, func(event Event, e E) {
+		for _, na := range namedActions {
+			na.plain(event, e)
 		}
 	}
 }
 
-// returns combined name and combined action (one that executes all actions in sequence)
-func combineGuards[E any](namedGuards []namedGuard[E]) (name string, guard func(event Event, e E) bool) {
+// returns combined name and combined guard (one that is true if all guards are true),
+// along with the combined plain guard, if none of the guards need the context
+func combineGuards[E any](namedGuards []namedGuard[E]) (name string, guard guardFunc[E], plain func(Event, E) bool) {
 	// avoid extra indirection in the case of a single guard
 	if len(namedGuards) == 1 {
-		return namedGuards[0].name, namedGuards[0].guard
+		return namedGuards[0].name, namedGuards[0].guard, namedGuards[0].plain
+	}
+	guard = func(ctx *Context[E], event Event, e E) bool {
+		for _, ng := range namedGuards {
+			if !ng.guard(ctx, event, e) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, ng := range namedGuards {
+		if ng.plain == nil {
+			return combineNames(namedGuards), guard, nil
+		}
 	}
-	return combineNames(namedGuards), func(event Event, e E) bool {
+	return combineNames(namedGuards), guard, func(event Event, e E) bool {
 		for _, ng := range namedGuards {
-			if !ng.guard(event, e) {
+			if !ng.plain(event, e) {
 				return false
 			}
 		}
@@ -101,27 +210,73 @@ type StateBuilder[E any] struct {
 // Entry sets func f as the entry action for the state being built.
 // May be called multiple times to assign multiple entry actions, to be executed in the order of assignment.
 func (sb *StateBuilder[E]) Entry(name string, f func(Event, E)) *StateBuilder[E] {
-	sb.entries = append(sb.entries, namedAction[E]{name: name, action: f})
+	return sb.addEntry(namedAction[E]{name: name, action: plainAction(f), plain: f})
+}
+
+// EntryCtx is like Entry, but the entry action also receives the [Context] of the state machine instance.
+func (sb *StateBuilder[E]) EntryCtx(name string, f func(*Context[E], Event, E)) *StateBuilder[E] {
+	return sb.addEntry(namedAction[E]{name: name, action: f})
+}
+
+func (sb *StateBuilder[E]) addEntry(na namedAction[E]) *StateBuilder[E] {
+	sb.entries = append(sb.entries, na)
 	if len(sb.entries) == 1 {
 		sb.options = append(sb.options, func(s *State[E]) {
-			s.entryName, s.entry = combineActions(sb.entries)
+			s.entryName, s.entry, s.entryPlain = combineActions(sb.entries)
+			s.entryNames = itemNames(sb.entries)
 		})
 	}
 	return sb
 }
 
+// EntryE is like Entry, but the entry action may fail by returning an error.
+// See [StateMachineInstance.DeliverE] for how failed actions are handled.
+func (sb *StateBuilder[E]) EntryE(name string, f func(Event, E) error) *StateBuilder[E] {
+	return sb.EntryCtx(name, failingAction(f))
+}
+
 // Exit sets func f as the exit action for the state being built.
 // May be called multiple times to assign multiple exit actions, to be executed in the order of assignment.
 func (sb *StateBuilder[E]) Exit(name string, f func(Event, E)) *StateBuilder[E] {
-	sb.exits = append(sb.exits, namedAction[E]{name: name, action: f})
+	return sb.addExit(namedAction[E]{name: name, action: plainAction(f), plain: f})
+}
+
+// ExitCtx is like Exit, but the exit action also receives the [Context] of the state machine instance.
+func (sb *StateBuilder[E]) ExitCtx(name string, f func(*Context[E], Event, E)) *StateBuilder[E] {
+	return sb.addExit(namedAction[E]{name: name, action: f})
+}
+
+func (sb *StateBuilder[E]) addExit(na namedAction[E]) *StateBuilder[E] {
+	sb.exits = append(sb.exits, na)
 	if len(sb.exits) == 1 {
 		sb.options = append(sb.options, func(s *State[E]) {
-			s.exitName, s.exit = combineActions(sb.exits)
+			s.exitName, s.exit, s.exitPlain = combineActions(sb.exits)
+			s.exitNames = itemNames(sb.exits)
 		})
 	}
 	return sb
 }
 
+// ExitE is like Exit, but the exit action may fail by returning an error.
+// See [StateMachineInstance.DeliverE] for how failed actions are handled.
+func (sb *StateBuilder[E]) ExitE(name string, f func(Event, E) error) *StateBuilder[E] {
+	return sb.ExitCtx(name, failingAction(f))
+}
+
+// Defer specifies events that are deferred in the state being built.
+// A deferred event that is not handled by any transition is not discarded,
+// but retained by the state machine instance, and re-delivered once the instance changes its state.
+// If the event is still deferred at that point, it is retained again.
+// Deferral applies to the sub-states as well, unless they handle the event with their own transitions.
+// Conversely, a state's deferral overrides any transitions for the same event defined in its super-states.
+// May be called multiple times, to defer more events.
+func (sb *StateBuilder[E]) Defer(eventIds ...int) *StateBuilder[E] {
+	sb.options = append(sb.options, func(s *State[E]) {
+		s.deferred = append(s.deferred, eventIds...)
+	})
+	return sb
+}
+
 // Initial marks the state being built as initial sub-state of the parent state.
 // In other words, Initial creates an automatic initial transition
 // from the parent state into the new state being built.
@@ -129,7 +284,9 @@ func (sb *StateBuilder[E]) Initial() *StateBuilder[E] {
 	opt := func(s *State[E]) {
 		p := s.parent
 		if p.initial != nil && p.initial != s {
-			panic(fmt.Sprintf("sub-states %s and %s can not both be marked initial", s.name, p.initial.name))
+			s.sm.fail(&StructureError{Kind: KindDuplicateInitial, State: s.name,
+				Msg: fmt.Sprintf("sub-states %s and %s can not both be marked initial", s.name, p.initial.name)})
+			return
 		}
 		p.initial = s
 	}
@@ -145,19 +302,26 @@ func (sb *StateBuilder[E]) Build() *State[E] {
 		alias:  strings.ReplaceAll(sb.name, " ", "_"),
 		sm:     sb.parent.sm,
 	}
-	for _, opt := range sb.options {
-		opt(&ss)
-	}
-	sb.parent.children = append(sb.parent.children, &ss)
 	// find and remove this builder in the list of unused stateBuilders
 	sm := sb.parent.sm
+	found := false
 	for i, sb1 := range sm.stateBuilders {
 		if sb == sb1 {
 			sm.stateBuilders = append(sm.stateBuilders[:i], sm.stateBuilders[i+1:]...)
+			found = true
+			break
 		}
+	}
+	if !found {
+		sm.fail(&StructureError{Kind: KindReusedBuilder, State: sb.name,
+			Msg: fmt.Sprintf("State %s builder: invalid attempt to use the same builder twice", sb.name)})
 		return &ss
 	}
-	panic(fmt.Sprintf("State %s builder: invalid attempt to use the same builder twice", sb.name))
+	for _, opt := range sb.options {
+		opt(&ss)
+	}
+	sb.parent.children = append(sb.parent.children, &ss)
+	return &ss
 }
 
 // Event instance are delivered to state machine,
@@ -169,21 +333,47 @@ type Event struct {
 	Data any
 }
 
+// trigger specifies what triggers a transition
+type trigger int
+
+const (
+	triggerEvent      trigger = iota // event with the matching id
+	triggerCompletion                // completion of the source state
+	triggerAfter                     // relative time event
+	triggerAt                        // absolute time event
+)
+
 type transition[E any] struct {
-	internal   bool
-	local      bool
-	eventId    int
-	target     *State[E]
-	guard      func(Event, E) bool
-	guardName  string
-	action     func(Event, E)
-	actionName string
-	history    History
+	internal    bool
+	local       bool
+	trigger     trigger
+	after       time.Duration // for triggerAfter, time elapsed since entering the source state
+	at          time.Time     // for triggerAt, absolute time
+	eventId     int
+	target      *State[E]
+	guard       guardFunc[E]
+	guardPlain  func(Event, E) bool // guard, if it doesn't need the context, called directly
+	guardName   string
+	guardNames  []string // names of the guards, as given, so empty for unnamed ones; implicit guards are left out
+	guardHidden bool     // whether any of the guards is implicit, see namedGuard
+	action      actionFunc[E]
+	actionPlain func(Event, E) // action, if it doesn't need the context, called directly
+	actionName  string
+	actionNames []string // names of the actions, as given, so empty for unnamed ones
+	history     History
+	domain      *State[E]   // states nested within domain are exited when transition is taken
+	path        []*State[E] // states entered when transition is taken, from just below domain down to target
 }
 
 func (t *transition[E]) String() string {
 	var bld strings.Builder
-	if t.guard != nil {
+	switch t.trigger {
+	case triggerAfter:
+		fmt.Fprintf(&bld, "after(%s)", t.after)
+	case triggerAt:
+		fmt.Fprintf(&bld, "at(%s)", t.at.Format(time.RFC3339))
+	}
+	if len(t.guardNames) > 0 {
 		bld.WriteByte('[')
 		bld.WriteString(t.guardName)
 		bld.WriteByte(']')
@@ -195,18 +385,86 @@ func (t *transition[E]) String() string {
 	return bld.String()
 }
 
+// computeDomain computes the transition domain, for the transition defined in state src.
+func (t *transition[E]) computeDomain(src *State[E]) *State[E] {
+	dst := t.target
+	if dst == &src.sm.terminal {
+		return &src.sm.top
+	}
+	if t.local {
+		// local transitions don't leave and re-enter the containing state
+		if isAncestor(src, dst) {
+			return src
+		}
+		return dst
+	}
+	// lowest common ancestor: the highest it can be is the top state,
+	// since we don't allow using it as either src or dst for transitions
+	lca := src.parent
+	for !isAncestor(lca, dst) {
+		lca = lca.parent
+	}
+	return lca
+}
+
 func (s *State[E]) IsLeaf() bool {
 	return len(s.children) == 0
 }
 
+// defers returns whether the state defers event with the given id.
+func (s *State[E]) defers(eventId int) bool {
+	for _, id := range s.deferred {
+		if id == eventId {
+			return true
+		}
+	}
+	return false
+}
+
+// IsRegion returns whether the state is an orthogonal region of its parent state.
+func (s *State[E]) IsRegion() bool {
+	return s.region
+}
+
+// isOrthogonal returns whether the state is composed of orthogonal regions.
+func (s *State[E]) isOrthogonal() bool {
+	return len(s.children) > 0 && s.children[0].region
+}
+
 // State creates and returns a builder for building a nested sub-state.
 func (s *State[E]) State(name string) *StateBuilder[E] {
+	if s.isOrthogonal() {
+		s.sm.fail(&StructureError{Kind: KindInvalidRegion, State: s.name,
+			Msg: fmt.Sprintf("state %s has orthogonal regions; sub-states must be created within a region", s.name)})
+	}
 	sb := &StateBuilder[E]{parent: s, name: name}
 	// add to the list of (yet) unused builders
 	s.sm.stateBuilders = append(s.sm.stateBuilders, sb)
 	return sb
 }
 
+// Region creates and returns a new orthogonal region of the state.
+// Sub-states of the region are then created by calling State() method on the returned region.
+// While the state is active, each of its regions is active, and each region has its own active sub-state.
+// Once a state has regions, all its sub-states must be created within one of the regions.
+// Each region must have exactly one sub-state marked as initial.
+// Regions have no entry/exit actions, and can be neither source nor target of transitions.
+func (s *State[E]) Region(name string) *State[E] {
+	if len(s.children) > 0 && !s.isOrthogonal() {
+		s.sm.fail(&StructureError{Kind: KindInvalidRegion, State: s.name,
+			Msg: fmt.Sprintf("state %s has sub-states and can not have orthogonal regions", s.name)})
+	}
+	r := &State[E]{
+		parent: s,
+		name:   name,
+		alias:  strings.ReplaceAll(name, " ", "_"),
+		sm:     s.sm,
+		region: true,
+	}
+	s.children = append(s.children, r)
+	return r
+}
+
 // Name returns state's name
 func (s *State[E]) Name() string {
 	if s == nil {
@@ -221,15 +479,42 @@ func (s *State[E]) String() string {
 }
 
 // validate checks that if state is entered, a unique path exists through initial transitions
-// to a leaf state
-func (s *State[E]) validate() {
-	for !s.IsLeaf() && !s.validated {
+// to a leaf state (in each of the orthogonal regions).
+// States already checked are recorded in the checked map, so each problem is reported only once.
+func (s *State[E]) validate(checked map[*State[E]]bool, errs StructureErrors) StructureErrors {
+	for !s.IsLeaf() && !checked[s] {
+		checked[s] = true
+		if s.isOrthogonal() {
+			for _, r := range s.children {
+				errs = r.validate(checked, errs)
+			}
+			return errs
+		}
 		if s.initial == nil {
-			panic("state " + s.name + " must have initial sub-state")
+			msg := "state " + s.name + " must have initial sub-state"
+			if s.region {
+				msg = fmt.Sprintf("region %s of state %s must have initial sub-state", s.name, s.parent.name)
+			}
+			return append(errs, &StructureError{Kind: KindMissingInitial, State: s.name, Msg: msg})
 		}
-		s.validated = true
 		s = s.initial
 	}
+	return errs
+}
+
+// validateTarget checks that state can be entered as a target of a transition.
+// Besides the state itself, this requires being able to enter any orthogonal regions
+// that will be entered along the way.
+func (s *State[E]) validateTarget(checked map[*State[E]]bool, errs StructureErrors) StructureErrors {
+	errs = s.validate(checked, errs)
+	for p := s.parent; p != nil; p = p.parent {
+		if p.isOrthogonal() {
+			for _, r := range p.children {
+				errs = r.validate(checked, errs)
+			}
+		}
+	}
+	return errs
 }
 
 // Transition creates and returns a builder for the transition from the current state into a target state.
@@ -238,10 +523,27 @@ func (s *State[E]) validate() {
 // such as providing action, guard condition, and transition type.
 // To indicate state machine termination, provide nil for target state.
 func (s *State[E]) Transition(eventId int, target *State[E]) *TransitionBuilder[E] {
+	s.checkNotPseudo()
+	return s.newTransition(eventId, target, triggerEvent)
+}
+
+// checkNotPseudo reports an attempt to create a transition other than completion transition from a pseudostate.
+func (s *State[E]) checkNotPseudo() {
+	if s.pseudo != pseudoNone {
+		s.sm.fail(&StructureError{Kind: KindInvalidPseudostate, State: s.name,
+			Msg: fmt.Sprintf("%s %s can only have completion transitions", s.pseudo, s.name)})
+	}
+}
+
+func (s *State[E]) newTransition(eventId int, target *State[E], trigger trigger) *TransitionBuilder[E] {
 	if target == nil {
 		target = &s.sm.terminal
 	}
-	t := transition[E]{target: target, eventId: eventId}
+	if s.region || target.region {
+		s.sm.fail(&StructureError{Kind: KindInvalidRegion, State: s.name, Target: target.name,
+			Msg: fmt.Sprintf("Transition %s -> %s can not involve orthogonal region", s.name, target.name)})
+	}
+	t := transition[E]{target: target, eventId: eventId, trigger: trigger}
 	tb := &TransitionBuilder[E]{src: s, t: &t}
 	// add to the list of (yet) unused builders
 	s.sm.transitionBuilders = append(s.sm.transitionBuilders, tb)
@@ -253,6 +555,85 @@ func (s *State[E]) AddTransition(eventId int, target *State[E]) {
 	s.Transition(eventId, target).Build()
 }
 
+// Completion creates and returns a builder for a completion transition from the current state into a target state.
+// Completion transitions are not triggered by events. Instead, they are taken automatically
+// once the state has been entered, and state machine has settled in the leaf state(s) -
+// either while delivering an event, or while initializing the instance.
+// Completion transitions of states nested deeper are considered first,
+// just like for transitions triggered by events.
+// A completion transition with a guard is taken only if the guard is true right after the state is entered;
+// the guard is not re-evaluated later.
+// Guards and actions of completion transitions receive the event which caused the state to be entered.
+// Completion transitions are also used to define the outgoing branches of choice and junction pseudostates.
+// To indicate state machine termination, provide nil for target state.
+func (s *State[E]) Completion(target *State[E]) *TransitionBuilder[E] {
+	return s.newTransition(0, target, triggerCompletion)
+}
+
+// After creates and returns a builder for a time-triggered transition from the current state into a target state.
+// The transition is armed when the state is entered, and disarmed when the state is exited.
+// If the state remains active for duration d,
+// the transition is triggered by a time event (see [StateMachineInstance.ProcessTimers]).
+// The time event is delivered only to this transition: if its guard is false, the time event is discarded.
+// Time is measured by the Clock of the state machine instance.
+// To indicate state machine termination, provide nil for target state.
+func (s *State[E]) After(d time.Duration, target *State[E]) *TransitionBuilder[E] {
+	s.checkNotPseudo()
+	tb := s.newTransition(0, target, triggerAfter)
+	tb.t.after = d
+	return tb
+}
+
+// At is like After, but the transition is triggered at the absolute time t, provided the state is still active.
+// If the state is entered after time t has already passed, the transition is triggered right away.
+func (s *State[E]) At(t time.Time, target *State[E]) *TransitionBuilder[E] {
+	s.checkNotPseudo()
+	tb := s.newTransition(0, target, triggerAt)
+	tb.t.at = t
+	return tb
+}
+
+// Choice creates and returns a choice pseudostate nested within the state.
+// Choice is used as the target of transitions, to dynamically select among the outgoing branches,
+// which are defined using the Completion() method of the choice.
+// When a transition into a choice is taken, any states are exited and the transition action is executed
+// before the guards of the branches are evaluated. Branches are evaluated in the order in which they were defined,
+// and the first branch whose guard is true (or which has no guard) is taken.
+// State machine panics if no branch is enabled,
+// so it's a good practice to define a final branch without a guard.
+func (s *State[E]) Choice(name string) *State[E] {
+	return s.pseudostate(name, pseudoChoice)
+}
+
+// Junction creates and returns a junction pseudostate nested within the state.
+// Junction is used as the target of transitions, to statically select among the outgoing branches,
+// which are defined using the Completion() method of the junction.
+// Unlike with choice, guards of the branches are evaluated before leaving the source state,
+// together with the guard of the incoming transition.
+// If no branch is enabled, the incoming transition is not enabled either.
+// Once a branch is selected, the whole path is executed as a single compound transition:
+// states are exited, actions of the incoming transition and of the branches are executed in order,
+// and states are entered.
+func (s *State[E]) Junction(name string) *State[E] {
+	return s.pseudostate(name, pseudoJunction)
+}
+
+func (s *State[E]) pseudostate(name string, kind pseudoKind) *State[E] {
+	if s.isOrthogonal() {
+		s.sm.fail(&StructureError{Kind: KindInvalidRegion, State: s.name,
+			Msg: fmt.Sprintf("state %s has orthogonal regions; %s must be created within a region", s.name, kind)})
+	}
+	ps := &State[E]{
+		parent: s,
+		name:   name,
+		alias:  strings.ReplaceAll(name, " ", "_"),
+		sm:     s.sm,
+		pseudo: kind,
+	}
+	s.children = append(s.children, ps)
+	return ps
+}
+
 type stateOption[E any] func(s *State[E])
 
 type transitionOption[E any] func(s *State[E], t *transition[E])
@@ -274,10 +655,21 @@ type TransitionBuilder[E any] struct {
 // for the transition to take place.
 // Guard name need not be unique, and is only used for state machine diagram generation.
 func (tb *TransitionBuilder[E]) Guard(name string, f func(Event, E) bool) *TransitionBuilder[E] {
-	tb.guards = append(tb.guards, namedGuard[E]{name: name, guard: f})
+	return tb.addGuard(namedGuard[E]{name: name, guard: plainGuard(f), plain: f})
+}
+
+// GuardCtx is like Guard, but the guard function also receives the [Context] of the state machine instance.
+// Guards should be free of side effects, and in particular they should not post events.
+func (tb *TransitionBuilder[E]) GuardCtx(name string, f func(*Context[E], Event, E) bool) *TransitionBuilder[E] {
+	return tb.addGuard(namedGuard[E]{name: name, guard: f})
+}
+
+func (tb *TransitionBuilder[E]) addGuard(ng namedGuard[E]) *TransitionBuilder[E] {
+	tb.guards = append(tb.guards, ng)
 	if len(tb.guards) == 1 {
 		tb.options = append(tb.options, func(s *State[E], t *transition[E]) {
-			t.guardName, t.guard = combineGuards(tb.guards)
+			t.guardName, t.guard, t.guardPlain = combineGuards(tb.guards)
+			t.guardNames, t.guardHidden = guardNames(tb.guards)
 		})
 	}
 
@@ -291,15 +683,32 @@ func (tb *TransitionBuilder[E]) Guard(name string, f func(Event, E) bool) *Trans
 // This method may be called multiple times to assign multiple actions to the same transition,
 // to be executed in the order in which they were defined.
 func (tb *TransitionBuilder[E]) Action(name string, f func(Event, E)) *TransitionBuilder[E] {
-	tb.actions = append(tb.actions, namedAction[E]{name: name, action: f})
+	return tb.addAction(namedAction[E]{name: name, action: plainAction(f), plain: f})
+}
+
+// ActionCtx is like Action, but the action function also receives the [Context] of the state machine instance.
+// This allows the action to post new events to the instance.
+func (tb *TransitionBuilder[E]) ActionCtx(name string, f func(*Context[E], Event, E)) *TransitionBuilder[E] {
+	return tb.addAction(namedAction[E]{name: name, action: f})
+}
+
+func (tb *TransitionBuilder[E]) addAction(na namedAction[E]) *TransitionBuilder[E] {
+	tb.actions = append(tb.actions, na)
 	if len(tb.actions) == 1 {
 		tb.options = append(tb.options, func(s *State[E], t *transition[E]) {
-			t.actionName, t.action = combineActions(tb.actions)
+			t.actionName, t.action, t.actionPlain = combineActions(tb.actions)
+			t.actionNames = itemNames(tb.actions)
 		})
 	}
 	return tb
 }
 
+// ActionE is like Action, but the action may fail by returning an error.
+// See [StateMachineInstance.DeliverE] for how failed actions are handled.
+func (tb *TransitionBuilder[E]) ActionE(name string, f func(Event, E) error) *TransitionBuilder[E] {
+	return tb.ActionCtx(name, failingAction(f))
+}
+
 // Internal specifies that transition should be treated as an internal transition,
 // as opposed to the default external transition.
 // This can only be specified for self-transitions - i.e. target state must be the same as the source state,
@@ -314,7 +723,9 @@ func (tb *TransitionBuilder[E]) Internal() *TransitionBuilder[E] {
 		if tb.t.target != nil {
 			targetName = tb.t.target.name
 		}
-		panic(fmt.Sprintf("Transition %s -> %s can not be internal", tb.src.name, targetName))
+		tb.src.sm.fail(&StructureError{Kind: KindInvalidInternal, State: tb.src.name, Target: targetName,
+			Msg: fmt.Sprintf("Transition %s -> %s can not be internal", tb.src.name, targetName)})
+		return tb
 	}
 	tb.options = append(tb.options, func(s *State[E], t *transition[E]) { t.internal = true })
 	return tb
@@ -330,7 +741,9 @@ func (tb *TransitionBuilder[E]) Internal() *TransitionBuilder[E] {
 func (tb *TransitionBuilder[E]) Local(b bool) *TransitionBuilder[E] {
 	opt := func(s *State[E], t *transition[E]) {
 		if parent := getParent(s, t.target); parent == nil {
-			panic("Transition " + s.name + " -> " + t.target.name + " can not be local")
+			s.sm.fail(&StructureError{Kind: KindInvalidLocal, State: s.name, Target: t.target.name,
+				Msg: "Transition " + s.name + " -> " + t.target.name + " can not be local"})
+			return
 		}
 		t.local = b
 	}
@@ -358,17 +771,18 @@ func (tb *TransitionBuilder[E]) Build() {
 			tb.t.local = true
 		}
 	}
-	tb.src.transitions = append(tb.src.transitions, tb.t)
-	for _, opt := range tb.options {
-		opt(tb.src, tb.t)
-	}
 	// remove from list of unused builders
 	sm := tb.src.sm
 	for i, tb1 := range sm.transitionBuilders {
 		if tb == tb1 {
 			sm.transitionBuilders = append(sm.transitionBuilders[:i], sm.transitionBuilders[i+1:]...)
+			tb.src.transitions = append(tb.src.transitions, tb.t)
+			for _, opt := range tb.options {
+				opt(tb.src, tb.t)
+			}
 			return
 		}
 	}
-	panic("Invalid attempt to use the same transition builder twice")
+	sm.fail(&StructureError{Kind: KindReusedBuilder, State: tb.src.name, Target: tb.t.target.name,
+		Msg: "Invalid attempt to use the same transition builder twice"})
 }
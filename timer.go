@@ -0,0 +1,115 @@
+package hsm
+
+import (
+	"math"
+	"time"
+)
+
+// TimeEvent is the id of the events which trigger time transitions (see [State.After] and [State.At]).
+// The Data of a time event holds the time.Time at which the timer was due.
+const TimeEvent = math.MinInt
+
+// armedTimer is a time transition armed upon entering its source state.
+type armedTimer[E any] struct {
+	src      *State[E]
+	t        *transition[E]
+	deadline time.Time
+	seq      uint64 // arming order, which breaks ties between timers with equal deadlines
+}
+
+// now returns the current time according to the instance's clock.
+func (smi *StateMachineInstance[E]) now() time.Time {
+	if smi.Clock == nil {
+		return SystemClock.Now()
+	}
+	return smi.Clock.Now()
+}
+
+// arm arms the time transitions of the state s, which is being entered.
+func (smi *StateMachineInstance[E]) arm(s *State[E]) {
+	now := smi.now()
+	for _, t := range s.timers {
+		deadline := t.at
+		if t.trigger == triggerAfter {
+			deadline = now.Add(t.after)
+		}
+		smi.timerSeq++
+		smi.timers = append(smi.timers, armedTimer[E]{src: s, t: t, deadline: deadline, seq: smi.timerSeq})
+	}
+}
+
+// disarm disarms the time transitions of the state s, which is being exited.
+func (smi *StateMachineInstance[E]) disarm(s *State[E]) {
+	keep := smi.timers[:0]
+	for _, at := range smi.timers {
+		if at.src != s {
+			keep = append(keep, at)
+		}
+	}
+	for i := len(keep); i < len(smi.timers); i++ {
+		smi.timers[i] = armedTimer[E]{}
+	}
+	smi.timers = keep
+}
+
+// NextDeadline returns the time at which the earliest armed time transition is due,
+// or false if no time transitions are armed.
+// Use NextDeadline to schedule the next call to [StateMachineInstance.ProcessTimers].
+func (smi *StateMachineInstance[E]) NextDeadline() (deadline time.Time, ok bool) {
+	for _, at := range smi.timers {
+		if !ok || at.deadline.Before(deadline) {
+			deadline, ok = at.deadline, true
+		}
+	}
+	return
+}
+
+// ProcessTimers takes the time transitions that are due according to the instance's clock,
+// returning the number of transitions taken.
+// The due timers are processed in order of their deadlines, each as if a separate event was delivered:
+// the resulting transitions, completion transitions and any posted events are processed
+// before moving on to the next timer.
+// If the guard of a due time transition is false, the time event is discarded.
+// Timers armed while ProcessTimers is running are not processed until the next call, even if they are due.
+// Like Deliver, this method is not reentrant.
+func (smi *StateMachineInstance[E]) ProcessTimers() (fired int) {
+	if !smi.initialized {
+		panic("State machine must be initialized before processing timers")
+	}
+	smi.begin()
+	defer smi.end()
+	now, last := smi.now(), smi.timerSeq
+	for len(smi.active) > 0 {
+		i := -1
+		for j, at := range smi.timers {
+			if at.seq > last || at.deadline.After(now) {
+				continue
+			}
+			if i < 0 || at.deadline.Before(smi.timers[i].deadline) {
+				i = j
+			}
+		}
+		if i < 0 {
+			break
+		}
+		at := smi.timers[i]
+		smi.timers = append(smi.timers[:i], smi.timers[i+1:]...)
+		e := Event{Id: TimeEvent, Data: at.deadline}
+		if smi.tracer != nil {
+			smi.tracer.EventReceived(e)
+		}
+		smi.entered = smi.entered[:0]
+		smi.changed = false
+		if segs, ok := smi.enabled(e, at.src, at.t); ok {
+			sel := newSelection(at.src, at.t, segs)
+			smi.fire(e, &sel)
+			smi.complete(e)
+			smi.recall()
+			fired++
+		} else if smi.tracer != nil {
+			smi.tracer.EventUnhandled(e)
+		}
+		smi.drain()
+	}
+	return
+}
@@ -0,0 +1,159 @@
+package hsm_test
+
+import (
+	"bytes"
+	"github.com/dragomit/hsm"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestTimeEvents(t *testing.T) {
+	const (
+		evConnect = iota
+		evAck
+		evData
+	)
+
+	var buf bytes.Buffer
+	makeA := func(txt string) func(hsm.Event, struct{}) {
+		return func(hsm.Event, struct{}) {
+			buf.WriteString(txt)
+			buf.WriteByte('|')
+		}
+	}
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	sm := hsm.StateMachine[struct{}]{}
+	idle := sm.State("Idle").Initial().Build()
+	session := sm.State("Session").Build()
+	waiting := session.State("Waiting").Initial().Build()
+	open := session.State("Open").Build()
+	expired := sm.State("Expired").Build()
+
+	idle.AddTransition(evConnect, session)
+	waiting.AddTransition(evAck, open)
+	waiting.After(5*time.Second, idle).Action("timeout", makeA("timeout")).Build()
+	// restarts the idle timer on every data event
+	open.AddTransition(evData, open)
+	open.After(time.Minute, idle).Action("idle", makeA("idle")).Build()
+	session.At(start.Add(time.Hour), expired).Action("expire", makeA("expire")).Build()
+
+	sm.Finalize()
+
+	clock := hsm.NewFakeClock(start)
+	smi := hsm.StateMachineInstance[struct{}]{SM: &sm, Clock: clock}
+	smi.Initialize(hsm.Event{})
+	_, ok := smi.NextDeadline()
+	assert.False(t, ok)
+
+	// handshake times out
+	smi.Deliver(hsm.Event{Id: evConnect})
+	deadline, ok := smi.NextDeadline()
+	assert.True(t, ok)
+	assert.Equal(t, start.Add(5*time.Second), deadline)
+	clock.Advance(4 * time.Second)
+	assert.Equal(t, 0, smi.ProcessTimers())
+	assert.Equal(t, waiting, smi.Current())
+	clock.Advance(time.Second)
+	assert.Equal(t, 1, smi.ProcessTimers())
+	assert.Equal(t, idle, smi.Current())
+	assert.Equal(t, "timeout|", buf.String())
+	_, ok = smi.NextDeadline()
+	assert.False(t, ok)
+
+	// handshake succeeds, so its timer is disarmed
+	buf.Reset()
+	smi.Deliver(hsm.Event{Id: evConnect})
+	smi.Deliver(hsm.Event{Id: evAck})
+	clock.Advance(30 * time.Second)
+	smi.Deliver(hsm.Event{Id: evData})
+	clock.Advance(30 * time.Second)
+	assert.Equal(t, 0, smi.ProcessTimers())
+	assert.Equal(t, open, smi.Current())
+
+	// both timers are due, but the earlier one exits Session, disarming the other
+	clock.Advance(time.Hour)
+	assert.Equal(t, 1, smi.ProcessTimers())
+	assert.Equal(t, idle, smi.Current())
+	assert.Equal(t, "idle|", buf.String())
+
+	// absolute time that has already passed is due right away
+	buf.Reset()
+	smi.Initialize(hsm.Event{})
+	smi.Deliver(hsm.Event{Id: evConnect})
+	assert.Equal(t, 1, smi.ProcessTimers())
+	assert.Equal(t, expired, smi.Current())
+	assert.Equal(t, "expire|", buf.String())
+
+	wantsDiagram := `@startuml
+
+state Idle
+[*] --> Idle
+state Session {
+   state Waiting
+   [*] --> Waiting
+   state Open
+}
+state Expired
+Idle --> Session : connect
+Waiting --> Open : ack
+Waiting --> Idle : after(5s) / timeout
+Open --> Open : data
+Open --> Idle : after(1m0s) / idle
+Session --> Expired : at(2024-01-01T01:00:00Z) / expire
+
+@enduml
+`
+	names := []string{"connect", "ack", "data"}
+	assert.Equal(t, wantsDiagram, sm.DiagramPUML(func(ev int) string { return names[ev] }))
+}
+
+func TestTimeEventGuard(t *testing.T) {
+	type ext struct {
+		ready bool
+	}
+	var got hsm.Event
+	sm := hsm.StateMachine[*ext]{}
+	a := sm.State("a").Initial().Build()
+	b := sm.State("b").Build()
+	a.After(time.Second, b).Guard("ready", func(_ hsm.Event, x *ext) bool { return x.ready }).
+		Action("record", func(e hsm.Event, _ *ext) { got = e }).Build()
+	sm.Finalize()
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := hsm.NewFakeClock(start)
+	smi := hsm.StateMachineInstance[*ext]{SM: &sm, Ext: &ext{}, Clock: clock}
+	smi.Initialize(hsm.Event{})
+
+	// time event is discarded when the guard is false, and the timer is not re-armed
+	clock.Advance(time.Second)
+	assert.Equal(t, 0, smi.ProcessTimers())
+	smi.Ext.ready = true
+	clock.Advance(time.Second)
+	assert.Equal(t, 0, smi.ProcessTimers())
+	assert.Equal(t, a, smi.Current())
+
+	smi.Initialize(hsm.Event{})
+	clock.Advance(2 * time.Second)
+	assert.Equal(t, 1, smi.ProcessTimers())
+	assert.Equal(t, b, smi.Current())
+	assert.Equal(t, hsm.Event{Id: hsm.TimeEvent, Data: start.Add(3 * time.Second)}, got)
+}
+
+func TestFakeClockTimer(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := hsm.NewFakeClock(start)
+	t1 := clock.NewTimer(time.Second)
+	t2 := clock.NewTimer(2 * time.Second)
+	clock.Advance(time.Second)
+	assert.Equal(t, start.Add(time.Second), <-t1.C())
+	assert.False(t, t1.Stop())
+	assert.True(t, t2.Stop())
+	clock.Advance(time.Second)
+	select {
+	case <-t2.C():
+		t.Error("stopped timer fired")
+	default:
+	}
+}
@@ -0,0 +1,86 @@
+package hsm
+
+// Tracer receives a callback for every step taken by a state machine instance,
+// which allows logging, collecting metrics, or visualizing what the instance is doing,
+// without instrumenting the actions.
+// The callbacks are invoked synchronously, from within Initialize, Deliver and ProcessTimers,
+// in the order in which the steps are taken.
+// To register a tracer, set the Tracer field of the instance,
+// or of the state machine, in which case it's used by all the instances without their own tracer.
+// Embed [NopTracer] to implement only some of the callbacks.
+type Tracer[E any] interface {
+	// EventReceived is called when an event is dispatched to the instance,
+	// including the posted, recalled and time events.
+	EventReceived(e Event)
+	// GuardEvaluated is called after evaluating the guard of a transition from src to target.
+	GuardEvaluated(src, target *State[E], guard string, result bool)
+	// TransitionSelected is called before taking a transition from src to target,
+	// where target may be a pseudostate.
+	TransitionSelected(src, target *State[E])
+	// StateExited is called after exiting the state.
+	StateExited(s *State[E])
+	// ActionRun is called before running the action of a transition from src to target.
+	ActionRun(src, target *State[E], action string)
+	// StateEntered is called after entering the state.
+	StateEntered(s *State[E])
+	// HistoryRestored is called when entering the state s through its history,
+	// before entering its previously active sub-state child.
+	HistoryRestored(s, child *State[E])
+	// EventUnhandled is called when no transition is enabled by the event, and the event is not deferred.
+	EventUnhandled(e Event)
+	// Terminated is called when the state machine instance terminates.
+	Terminated()
+}
+
+// NopTracer implements all the Tracer callbacks by doing nothing.
+type NopTracer[E any] struct{}
+
+func (NopTracer[E]) EventReceived(Event)                             {}
+func (NopTracer[E]) GuardEvaluated(_, _ *State[E], _ string, _ bool) {}
+func (NopTracer[E]) TransitionSelected(_, _ *State[E])               {}
+func (NopTracer[E]) StateExited(*State[E])                           {}
+func (NopTracer[E]) ActionRun(_, _ *State[E], _ string)              {}
+func (NopTracer[E]) StateEntered(*State[E])                          {}
+func (NopTracer[E]) HistoryRestored(_, _ *State[E])                  {}
+func (NopTracer[E]) EventUnhandled(Event)                            {}
+func (NopTracer[E]) Terminated()                                     {}
+
+// guard evaluates the guard of transition t from state src, tracing the result.
+func (smi *StateMachineInstance[E]) guard(e Event, src *State[E], t *transition[E]) bool {
+	if t.guard == nil {
+		return true
+	}
+	var result bool
+	smi.user = true
+	if t.guardPlain != nil {
+		result = t.guardPlain(e, smi.Ext)
+	} else {
+		result = t.guard(smi.ctx(), e, smi.Ext)
+	}
+	smi.user = false
+	if smi.tracer != nil {
+		smi.tracer.GuardEvaluated(src, t.target, t.guardName, result)
+	}
+	return result
+}
+
+// action runs the action of transition t from state src, if any, tracing it.
+func (smi *StateMachineInstance[E]) action(e Event, src *State[E], t *transition[E]) {
+	if t.action != nil { // small enough to be inlined, transitions often don't have an action
+		smi.runAction(e, src, t)
+	}
+}
+
+// runAction runs the action of transition t from state src, tracing it.
+func (smi *StateMachineInstance[E]) runAction(e Event, src *State[E], t *transition[E]) {
+	if smi.tracer != nil {
+		smi.tracer.ActionRun(src, t.target, t.actionName)
+	}
+	smi.user = true
+	if t.actionPlain != nil {
+		t.actionPlain(e, smi.Ext)
+	} else {
+		t.action(smi.ctx(), e, smi.Ext)
+	}
+	smi.user = false
+}
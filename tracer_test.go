@@ -0,0 +1,149 @@
+package hsm_test
+
+import (
+	"fmt"
+	"github.com/dragomit/hsm"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// recorder records the trace as a list of strings
+type recorder struct {
+	hsm.NopTracer[*bool]
+	trace []string
+}
+
+func (r *recorder) add(format string, args ...any) {
+	r.trace = append(r.trace, fmt.Sprintf(format, args...))
+}
+
+func (r *recorder) EventReceived(e hsm.Event) { r.add("received %d", e.Id) }
+func (r *recorder) GuardEvaluated(src, target *hsm.State[*bool], guard string, result bool) {
+	r.add("guard %s --> %s [%s] %t", src, target, guard, result)
+}
+func (r *recorder) TransitionSelected(src, target *hsm.State[*bool]) {
+	r.add("selected %s --> %s", src, target)
+}
+func (r *recorder) StateExited(s *hsm.State[*bool]) { r.add("exited %s", s) }
+func (r *recorder) ActionRun(src, target *hsm.State[*bool], action string) {
+	r.add("action %s --> %s / %s", src, target, action)
+}
+func (r *recorder) StateEntered(s *hsm.State[*bool])           { r.add("entered %s", s) }
+func (r *recorder) HistoryRestored(s, child *hsm.State[*bool]) { r.add("history %s: %s", s, child) }
+func (r *recorder) EventUnhandled(e hsm.Event)                 { r.add("unhandled %d", e.Id) }
+func (r *recorder) Terminated()                                { r.add("terminated") }
+
+func TestTracer(t *testing.T) {
+	const (
+		evGo = iota
+		evBack
+		evStop
+		evOther
+	)
+
+	allowed := func(_ hsm.Event, ok *bool) bool { return *ok }
+	nop := func(hsm.Event, *bool) {}
+
+	sm := hsm.StateMachine[*bool]{}
+	a := sm.State("a").Initial().Build()
+	a1 := a.State("a1").Initial().Build()
+	a2 := a.State("a2").Build()
+	b := sm.State("b").Build()
+	a1.AddTransition(evGo, a2)
+	a.Transition(evGo, b).Guard("allowed", allowed).Action("go", nop).Build()
+	b.Transition(evBack, a).History(hsm.HistoryShallow).Build()
+	b.Transition(evStop, nil).Action("stop", nop).Build()
+	sm.Finalize()
+
+	rec := &recorder{}
+	smi := hsm.StateMachineInstance[*bool]{SM: &sm, Ext: new(bool), Tracer: rec}
+	smi.Initialize(hsm.Event{})
+	assert.Equal(t, []string{"entered a", "entered a1"}, rec.trace)
+
+	// sub-state's transition is not guarded
+	rec.trace = nil
+	smi.Deliver(hsm.Event{Id: evGo})
+	assert.Equal(t, []string{
+		"received 0",
+		"selected a1 --> a2",
+		"exited a1",
+		"entered a2",
+	}, rec.trace)
+
+	rec.trace = nil
+	smi.Deliver(hsm.Event{Id: evGo})
+	assert.Equal(t, []string{
+		"received 0",
+		"guard a --> b [allowed] false",
+		"unhandled 0",
+	}, rec.trace)
+
+	rec.trace = nil
+	*smi.Ext = true
+	smi.Deliver(hsm.Event{Id: evGo})
+	smi.Deliver(hsm.Event{Id: evBack})
+	assert.Equal(t, []string{
+		"received 0",
+		"guard a --> b [allowed] true",
+		"selected a --> b",
+		"exited a2",
+		"exited a",
+		"action a --> b / go",
+		"entered b",
+		"received 1",
+		"selected b --> a",
+		"exited b",
+		"entered a",
+		"history a: a2",
+		"entered a2",
+	}, rec.trace)
+
+	rec.trace = nil
+	smi.Deliver(hsm.Event{Id: evOther})
+	smi.Deliver(hsm.Event{Id: evGo})
+	smi.Deliver(hsm.Event{Id: evStop})
+	smi.Deliver(hsm.Event{Id: evStop})
+	assert.Equal(t, []string{
+		"received 3",
+		"unhandled 3",
+		"received 0",
+		"guard a --> b [allowed] true",
+		"selected a --> b",
+		"exited a2",
+		"exited a",
+		"action a --> b / go",
+		"entered b",
+		"received 2",
+		"selected b --> terminal state",
+		"exited b",
+		"action b --> terminal state / stop",
+		"terminated",
+		"received 2",
+		"unhandled 2",
+	}, rec.trace)
+}
+
+func TestStateMachineTracer(t *testing.T) {
+	rec := &recorder{}
+	sm := hsm.StateMachine[*bool]{Tracer: rec}
+	a := sm.State("a").Initial().Build()
+	c := sm.Choice("c")
+	b := sm.State("b").Build()
+	a.AddTransition(0, c)
+	c.Completion(a).Guard("no", func(hsm.Event, *bool) bool { return false }).Build()
+	c.Completion(b).Action("yes", func(hsm.Event, *bool) {}).Build()
+	sm.Finalize()
+
+	smi := hsm.StateMachineInstance[*bool]{SM: &sm}
+	smi.Initialize(hsm.Event{})
+	smi.Deliver(hsm.Event{})
+	assert.Equal(t, []string{
+		"entered a",
+		"received 0",
+		"selected a --> c",
+		"exited a",
+		"guard c --> a [no] false",
+		"action c --> b / yes",
+		"entered b",
+	}, rec.trace)
+}
@@ -0,0 +1,173 @@
+package hsm
+
+import (
+	"fmt"
+	"math"
+)
+
+// unknownEventId is the id of the events whose keys are not used by a finalized TypedStateMachine.
+const unknownEventId = math.MinInt + 1
+
+// TypedStateMachine is a StateMachine whose events are identified by keys of type K,
+// usually an enumeration type, rather than by bare ints.
+// Using a distinct key type for each state machine lets the compiler catch keys meant for a different state machine,
+// both while building the state machine, and while delivering events to its [TypedInstance]s.
+// Events created by Event are plain [Event]s, though, so delivering them to an instance of another state machine
+// can not be caught.
+//
+// Keys are mapped to event ids as they are used, in order of first use,
+// so a TypedStateMachine should not be mixed with event ids obtained in any other way.
+// The mapping is fixed when the state machine is finalized: after that, events with keys
+// which were never used to build the state machine are not handled by any state.
+// Use Id to obtain the event id for a key, such as for [StateBuilder.Defer],
+// and Instance to create instances accepting events by their keys:
+//
+//	smi := tsm.Instance(&eState{})
+//	smi.Initialize(hsm.Event{})
+//	smi.DeliverKey(evStart, nil)
+//
+// Methods producing diagrams and definitions name the events using the keys' String method,
+// if K implements [fmt.Stringer], and fmt.Sprint otherwise, without the need for an evNameMapper.
+// Zero value of TypedStateMachine is ready for use.
+type TypedStateMachine[E any, K comparable] struct {
+	StateMachine[E]
+	ids  map[K]int
+	keys []K
+}
+
+// Id returns the event id for key k.
+func (tsm *TypedStateMachine[E, K]) Id(k K) int {
+	if id, ok := tsm.ids[k]; ok {
+		return id
+	}
+	if tsm.finalized {
+		return unknownEventId // no mutations after finalizing, since instances may be used concurrently
+	}
+	if tsm.ids == nil {
+		tsm.ids = make(map[K]int)
+	}
+	id := len(tsm.keys)
+	tsm.ids[k] = id
+	tsm.keys = append(tsm.keys, k)
+	return id
+}
+
+// Ids returns the event ids for the given keys.
+func (tsm *TypedStateMachine[E, K]) Ids(keys ...K) []int {
+	ids := make([]int, len(keys))
+	for i, k := range keys {
+		ids[i] = tsm.Id(k)
+	}
+	return ids
+}
+
+// Key returns the key for the given event id, or false if there's no such key.
+func (tsm *TypedStateMachine[E, K]) Key(eventId int) (k K, ok bool) {
+	if eventId < 0 || eventId >= len(tsm.keys) {
+		return
+	}
+	return tsm.keys[eventId], true
+}
+
+// Event creates an event with key k, and optional data.
+func (tsm *TypedStateMachine[E, K]) Event(k K, data any) Event {
+	return Event{Id: tsm.Id(k), Data: data}
+}
+
+// EventName returns the name of the event with the given id.
+// It's used as the evNameMapper for the diagrams and definitions.
+func (tsm *TypedStateMachine[E, K]) EventName(eventId int) string {
+	k, ok := tsm.Key(eventId)
+	if !ok {
+		return fmt.Sprint(eventId)
+	}
+	if s, ok := any(k).(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprint(k)
+}
+
+// Transition creates and returns a builder for the transition from state src into state target,
+// triggered by event with key k. See [State.Transition].
+func (tsm *TypedStateMachine[E, K]) Transition(src *State[E], k K, target *State[E]) *TransitionBuilder[E] {
+	return src.Transition(tsm.Id(k), target)
+}
+
+// AddTransition is a convenience method, equivalent to calling tsm.Transition(src, k, target).Build().
+func (tsm *TypedStateMachine[E, K]) AddTransition(src *State[E], k K, target *State[E]) {
+	src.AddTransition(tsm.Id(k), target)
+}
+
+// DiagramBuilder creates builder for customizing PlantUML or Mermaid diagram, see [StateMachine.DiagramBuilder].
+func (tsm *TypedStateMachine[E, K]) DiagramBuilder() *DiagramBuilder[E] {
+	return tsm.StateMachine.DiagramBuilder(tsm.EventName)
+}
+
+// DiagramPUML builds a PlantUML diagram of a finalized state machine, see [StateMachine.DiagramPUML].
+func (tsm *TypedStateMachine[E, K]) DiagramPUML() string {
+	return tsm.StateMachine.DiagramPUML(tsm.EventName)
+}
+
+// DiagramMermaid builds a Mermaid diagram of a finalized state machine, see [StateMachine.DiagramMermaid].
+func (tsm *TypedStateMachine[E, K]) DiagramMermaid() string {
+	return tsm.StateMachine.DiagramMermaid(tsm.EventName)
+}
+
+// DotBuilder creates builder for customizing Graphviz (DOT) diagram, see [StateMachine.DotBuilder].
+func (tsm *TypedStateMachine[E, K]) DotBuilder() *DotBuilder[E] {
+	return tsm.StateMachine.DotBuilder(tsm.EventName)
+}
+
+// DiagramDOT builds a Graphviz (DOT) diagram of a finalized state machine, see [StateMachine.DiagramDOT].
+func (tsm *TypedStateMachine[E, K]) DiagramDOT() string {
+	return tsm.StateMachine.DiagramDOT(tsm.EventName)
+}
+
+// SCXML exports a finalized state machine as a W3C SCXML document, see [StateMachine.SCXML].
+func (tsm *TypedStateMachine[E, K]) SCXML() string {
+	return tsm.StateMachine.SCXML(tsm.EventName)
+}
+
+// Definition returns the definition of a finalized state machine, see [StateMachine.Definition].
+func (tsm *TypedStateMachine[E, K]) Definition() *Definition {
+	return tsm.StateMachine.Definition(tsm.EventName)
+}
+
+// YAML returns the definition of a finalized state machine as a YAML document, see [StateMachine.YAML].
+func (tsm *TypedStateMachine[E, K]) YAML() string {
+	return tsm.StateMachine.YAML(tsm.EventName)
+}
+
+// JSON returns the definition of a finalized state machine as a JSON document, see [StateMachine.JSON].
+func (tsm *TypedStateMachine[E, K]) JSON() string {
+	return tsm.StateMachine.JSON(tsm.EventName)
+}
+
+// TypedInstance is an instance of a TypedStateMachine, which delivers events by their keys of type K.
+// It embeds the StateMachineInstance, whose fields and methods are available as usual.
+type TypedInstance[E any, K comparable] struct {
+	StateMachineInstance[E]
+	tsm *TypedStateMachine[E, K]
+}
+
+// Instance creates a new, not yet initialized, instance of the state machine, with extended state ext.
+func (tsm *TypedStateMachine[E, K]) Instance(ext E) *TypedInstance[E, K] {
+	return &TypedInstance[E, K]{StateMachineInstance: StateMachineInstance[E]{SM: &tsm.StateMachine, Ext: ext}, tsm: tsm}
+}
+
+// DeliverKey delivers the event with key k, and optional data, to the instance. See [StateMachineInstance.Deliver].
+func (ti *TypedInstance[E, K]) DeliverKey(k K, data any) (handled bool, src *State[E]) {
+	return ti.Deliver(ti.tsm.Event(k, data))
+}
+
+// DeliverKeyE is like DeliverKey, but recovers from failed actions. See [StateMachineInstance.DeliverE].
+func (ti *TypedInstance[E, K]) DeliverKeyE(k K, data any) (handled bool, src *State[E], err error) {
+	return ti.DeliverE(ti.tsm.Event(k, data))
+}
+
+// Payload returns the data of event e as type D, or false if the event's data is not of type D.
+// Use Payload in guards and actions to access the event data without unchecked type assertions.
+func Payload[D any](e Event) (D, bool) {
+	d, ok := e.Data.(D)
+	return d, ok
+}
@@ -0,0 +1,113 @@
+package hsm_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dragomit/hsm"
+)
+
+type lampEvent int
+
+const (
+	lampOn lampEvent = iota
+	lampOff
+	lampDim
+	lampUnused
+)
+
+func (e lampEvent) String() string {
+	return [...]string{"on", "off", "dim", "unused"}[e]
+}
+
+type lamp struct {
+	level int
+}
+
+func lampMachine() (*hsm.TypedStateMachine[*lamp, lampEvent], *hsm.State[*lamp], *hsm.State[*lamp]) {
+	tsm := &hsm.TypedStateMachine[*lamp, lampEvent]{}
+	off := tsm.State("off").Initial().Build()
+	on := tsm.State("on").Defer(tsm.Ids(lampDim)...).Build()
+	tsm.Transition(off, lampOn, on).
+		Guard("level", func(e hsm.Event, l *lamp) bool {
+			level, ok := hsm.Payload[int](e)
+			return ok && level > 0
+		}).
+		Action("set level", func(e hsm.Event, l *lamp) {
+			l.level, _ = hsm.Payload[int](e)
+		}).Build()
+	tsm.AddTransition(on, lampOff, off)
+	tsm.Transition(off, lampDim, off).Internal().Action("dim", func(e hsm.Event, l *lamp) { l.level-- }).Build()
+	tsm.Finalize()
+	return tsm, off, on
+}
+
+func TestTypedStateMachine(t *testing.T) {
+	tsm, off, on := lampMachine()
+	l := &lamp{}
+	smi := hsm.StateMachineInstance[*lamp]{SM: &tsm.StateMachine, Ext: l}
+	smi.Initialize(hsm.Event{})
+
+	if handled, _ := smi.Deliver(tsm.Event(lampOn, "bright")); handled || smi.Current() != off {
+		t.Errorf("payload of the wrong type must fail the guard")
+	}
+	if handled, _ := smi.Deliver(tsm.Event(lampOn, 5)); !handled || smi.Current() != on || l.level != 5 {
+		t.Errorf("expected to be on at level 5, got %s at level %d", smi.Current().Name(), l.level)
+	}
+	smi.Deliver(tsm.Event(lampDim, nil)) // deferred while on
+	smi.Deliver(tsm.Event(lampOff, nil))
+	if smi.Current() != off || l.level != 4 {
+		t.Errorf("expected to be off at level 4, got %s at level %d", smi.Current().Name(), l.level)
+	}
+
+	// keys not used to build the state machine are not handled, and don't change the mapping
+	if handled, _ := smi.Deliver(tsm.Event(lampUnused, nil)); handled {
+		t.Errorf("unused key must not be handled")
+	}
+	if _, ok := tsm.Key(tsm.Id(lampUnused)); ok {
+		t.Errorf("unused key must not be mapped after finalizing")
+	}
+	for _, k := range []lampEvent{lampOn, lampOff, lampDim} {
+		if k1, ok := tsm.Key(tsm.Id(k)); !ok || k1 != k {
+			t.Errorf("key %s did not round trip, got %s", k, k1)
+		}
+	}
+}
+
+func TestTypedInstance(t *testing.T) {
+	tsm, off, on := lampMachine()
+	l := &lamp{}
+	smi := tsm.Instance(l)
+	smi.Initialize(hsm.Event{})
+	if handled, src := smi.DeliverKey(lampOn, 3); !handled || src != off || smi.Current() != on || l.level != 3 {
+		t.Errorf("expected to be on at level 3, got %s at level %d", smi.Current().Name(), l.level)
+	}
+	if handled, _, err := smi.DeliverKeyE(lampOff, nil); !handled || err != nil || smi.Current() != off {
+		t.Errorf("expected to be off, got %s, error %v", smi.Current().Name(), err)
+	}
+	if smi.SM != &tsm.StateMachine || smi.Ext != l {
+		t.Errorf("instance must refer to the state machine and the extended state")
+	}
+}
+
+func TestTypedStateMachineNames(t *testing.T) {
+	tsm, _, _ := lampMachine()
+	puml := tsm.DiagramPUML()
+	for _, want := range []string{"off --> on : on[level] / set level", "on --> off : off", "on : dim / defer"} {
+		if !strings.Contains(puml, want) {
+			t.Errorf("diagram does not contain %q:\n%s", want, puml)
+		}
+	}
+	if name := tsm.EventName(hsm.TimeEvent); name != "-9223372036854775808" {
+		t.Errorf("unexpected name %q for an unknown id", name)
+	}
+
+	// keys without a String method are named using fmt.Sprint
+	ssm := hsm.TypedStateMachine[struct{}, string]{}
+	a := ssm.State("a").Initial().Build()
+	ssm.AddTransition(a, "go away", nil)
+	ssm.Finalize()
+	if yaml := ssm.YAML(); !strings.Contains(yaml, "event: go away") {
+		t.Errorf("definition does not name the event:\n%s", yaml)
+	}
+}